@@ -17,6 +17,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "plugin" {
+		os.Exit(pluginSubcommand(os.Args[2:], os.Stdout))
+	}
+
 	configFile := flag.String("config", "/etc/errplane-agent/config.yml", "The agent config file")
 	flag.Parse()
 
@@ -58,12 +62,14 @@ func main() {
 	go diskSpaceStats(ep, ch)
 	go ioStats(ep, ch)
 	go procStats(ep, ch)
+	processEventsReporter = ep
 	go monitorProceses(ep, ch)
+	detector := NewAnomaliesDetector(ep)
+	pluginsDetector = detector
 	go monitorPlugins(ep)
 	go checkNewPlugins()
 	go startUdpListener(ep)
 	go startLocalServer()
-	detector := NewAnomaliesDetector(ep)
 	go watchLogFile(detector)
 	log.Info("Agent started successfully")
 	err = <-ch
@@ -96,38 +102,53 @@ func initLog() error {
 	return nil
 }
 
-func report(ep *errplane.Errplane, metric string, value float64, timestamp time.Time, dimensions errplane.Dimensions, ch chan error) bool {
-	err := ep.Report(metric, value, timestamp, "", dimensions)
+func report(ep Reporter, metric string, value float64, timestamp time.Time, dimensions errplane.Dimensions, ch chan error) bool {
+	reportWithContext(ep, metric, value, timestamp, "", dimensions)
+	return false
+}
+
+func reportWithContext(ep Reporter, metric string, value float64, timestamp time.Time, context string, dimensions errplane.Dimensions) {
+	err := ep.Report(metric, value, timestamp, context, dimensions)
 	if err != nil {
 		log.Error("Error while sending report. Error: %s", err)
 	}
-	return false
 }
 
 func procStats(ep *errplane.Errplane, ch chan error) {
 	var previousStats map[int]*ProcStat
+	aggregator := NewProcStatsAggregator(AgentConfig.TopNMaxSeries)
 
 	for {
 		_, procStats := getProcesses()
 
 		if previousStats != nil {
 			mergedStats := mergeStats(previousStats, procStats)
+			now := time.Now()
 
-			n := int(math.Min(float64(AgentConfig.TopNProcesses), float64(len(mergedStats))))
+			for _, aggregation := range AgentConfig.TopNAggregateBy {
+				if aggregation != "pid" {
+					groups := aggregator.Aggregate(aggregation, mergedStats, procStats, now)
+					if reportAggregatedProcStats(ep, aggregation, groups, now, ch) {
+						return
+					}
+					continue
+				}
 
-			sort.Sort(ProcStatsSortableByCpu(mergedStats))
-			topNByCpu := mergedStats[0:n]
-			now := time.Now()
-			for _, stat := range topNByCpu {
-				if reportProcessCpuUsage(ep, nil, &stat, now, true, ch) {
-					return
+				n := int(math.Min(float64(AgentConfig.TopNProcesses), float64(len(mergedStats))))
+
+				sort.Sort(ProcStatsSortableByCpu(mergedStats))
+				topNByCpu := mergedStats[0:n]
+				for _, stat := range topNByCpu {
+					if reportProcessCpuUsage(ep, nil, &stat, now, true, ch) {
+						return
+					}
 				}
-			}
-			sort.Sort(ProcStatsSortableByMem(mergedStats))
-			topNByMem := mergedStats[0:n]
-			for _, stat := range topNByMem {
-				if reportProcessMemUsage(ep, nil, &stat, now, true, ch) {
-					return
+				sort.Sort(ProcStatsSortableByMem(mergedStats))
+				topNByMem := mergedStats[0:n]
+				for _, stat := range topNByMem {
+					if reportProcessMemUsage(ep, nil, &stat, now, true, ch) {
+						return
+					}
 				}
 			}
 		}
@@ -137,6 +158,27 @@ func procStats(ep *errplane.Errplane, ch chan error) {
 	}
 }
 
+// report the top n groups by cpu and memory usage, e.g. the
+// server.stats.procs.cpu.by_user metric with a user dimension
+func reportAggregatedProcStats(ep Reporter, aggregation string, groups []MergedProcStat, now time.Time, ch chan error) bool {
+	for _, metric := range []string{"cpu", "mem"} {
+		for _, stat := range topGroups(groups, AgentConfig.TopNProcesses, metric == "cpu") {
+			value := stat.cpuUsage
+			if metric == "mem" {
+				value = stat.memUsage
+			}
+			dimensions := errplane.Dimensions{
+				aggregation: stat.name,
+				"host":      AgentConfig.Hostname,
+			}
+			if report(ep, fmt.Sprintf("server.stats.procs.%s.by_%s", metric, aggregation), value, now, dimensions, ch) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func reportProcessCpuUsage(ep *errplane.Errplane, monitoredProcess *Process, stat *MergedProcStat, now time.Time, top bool, ch chan error) bool {
 	return reportProcessMetric(ep, monitoredProcess, stat, "cpu", now, top, ch)
 }
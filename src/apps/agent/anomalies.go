@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"utils"
 )
@@ -48,6 +49,8 @@ type Detector interface {
 type AnomaliesDetector struct {
 	config   *monitoring.MonitorConfig
 	reporter Reporter
+	// the plugins report their status from the scheduler goroutines
+	eventsLock sync.Mutex
 }
 
 type Reporter interface {
@@ -55,7 +58,7 @@ type Reporter interface {
 }
 
 func NewAnomaliesDetector(reporter Reporter) *AnomaliesDetector {
-	detector := &AnomaliesDetector{nil, reporter}
+	detector := &AnomaliesDetector{config: nil, reporter: reporter}
 	go detector.updateMonitorConfig()
 	return detector
 }
@@ -118,13 +121,16 @@ func (self *AnomaliesDetector) Report(metricName string, value float64, context
 			continue
 		}
 		status := dimensions["status"]
-		self.reportPluginEvent(monitor, pluginName, status)
+		self.reportPluginEvent(monitor, pluginName, dimensions["instance"], status)
 		// stop processing any further plugin monitor
 		break
 	}
 }
 
-func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, name string, status string) {
+func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, name, instance, status string) {
+	self.eventsLock.Lock()
+	defer self.eventsLock.Unlock()
+
 	// we have a monitor that matches the given filename
 	for _, condition := range monitor.Conditions {
 		ok, err := regexp.MatchString(condition.AlertOnMatch, status)
@@ -132,8 +138,8 @@ func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, na
 			log.Error("Error while matching regex: %s. Error: %s", condition.AlertWhen)
 			return
 		}
-		// split lines and see if any one of them matches
-		key := fmt.Sprintf("%#v/%#v", monitor, condition)
+		// the monitor can match several plugins and their instances
+		key := fmt.Sprintf("%#v/%#v/%s/%s", monitor, condition, name, instance)
 		if !ok {
 			eventCache.Delete(key)
 			return
@@ -149,12 +155,18 @@ func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, na
 		metricEvents := _metricEvents.(*MetricEvents)
 		metricEvents.events = append(metricEvents.events, &Event{time.Now()})
 
-		if len(metricEvents.events) > 0 && time.Now().Sub(metricEvents.events[0].timestamp) > condition.OnlyAfter {
-			self.reporter.Report("errplane.anomalies", 1.0, time.Now(), "", errplane.Dimensions{
+		if window := pluginMaintenanceWindow(name, time.Now()); window != nil {
+			log.Debug("Not reporting anomalies of plugin %s during the maintenance window %s", name, window.Name)
+		} else if len(metricEvents.events) > 0 && time.Now().Sub(metricEvents.events[0].timestamp) > condition.OnlyAfter {
+			dimensions := errplane.Dimensions{
 				"PluginName":   name,
 				"AlertOnMatch": condition.AlertOnMatch,
 				"OnlyAfter":    condition.OnlyAfter.String(),
-			})
+			}
+			if instance != "" {
+				dimensions["instance"] = instance
+			}
+			self.reporter.Report("errplane.anomalies", 1.0, time.Now(), "", dimensions)
 		}
 
 		// remove all events that are older than "OnlyAfter"
@@ -171,6 +183,9 @@ func (self *AnomaliesDetector) reportPluginEvent(monitor *monitoring.Monitor, na
 }
 
 func (self *AnomaliesDetector) reportMetricEvent(monitor *monitoring.Monitor, value float64) {
+	self.eventsLock.Lock()
+	defer self.eventsLock.Unlock()
+
 	// we have a monitor that matches the given filename
 	for _, condition := range monitor.Conditions {
 		// split lines and see if any one of them matches
@@ -190,7 +205,9 @@ func (self *AnomaliesDetector) reportMetricEvent(monitor *monitoring.Monitor, va
 		metricEvents := _metricEvents.(*MetricEvents)
 		metricEvents.events = append(metricEvents.events, &Event{time.Now()})
 
-		if len(metricEvents.events) > 0 && time.Now().Sub(metricEvents.events[0].timestamp) > condition.OnlyAfter {
+		if window := hostMaintenanceWindow(time.Now()); window != nil {
+			log.Debug("Not reporting anomalies of %s during the maintenance window %s", monitor.StatName, window.Name)
+		} else if len(metricEvents.events) > 0 && time.Now().Sub(metricEvents.events[0].timestamp) > condition.OnlyAfter {
 			self.reporter.Report("errplane.anomalies", 1.0, time.Now(), "", errplane.Dimensions{
 				"StatName":       monitor.StatName,
 				"AlertWhen":      condition.AlertWhen.String(),
@@ -286,7 +303,9 @@ func (self *AnomaliesDetector) ReportLogEvent(filename string, oldLines []string
 			}
 			logEvents.events = newEvents
 			// log.Debug("new events: %d", len(logEvents.events))
-			if len(logEvents.events) >= int(condition.AlertThreshold) {
+			if window := hostMaintenanceWindow(time.Now()); window != nil {
+				log.Debug("Not reporting anomalies of %s during the maintenance window %s", monitor.LogName, window.Name)
+			} else if len(logEvents.events) >= int(condition.AlertThreshold) {
 				context := ""
 				if condition.AlertThreshold == 1 {
 					event := logEvents.events[0]
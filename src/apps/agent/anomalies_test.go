@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"os"
+	"sync"
 	"time"
 	. "utils"
 )
@@ -31,10 +32,13 @@ type MockedEvent struct {
 }
 
 type ReporterMock struct {
+	lock   sync.Mutex
 	events []*MockedEvent
 }
 
 func (self *ReporterMock) Report(metric string, value float64, timestamp time.Time, context string, dimensions errplane.Dimensions) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	self.events = append(self.events, &MockedEvent{metric, value, timestamp, context, dimensions})
 	return nil
 }
@@ -205,3 +209,72 @@ func (self *LogMonitoringSuite) TestResetPluginMonitoring(c *C) {
 
 	c.Assert(self.reporter.events, HasLen, 0)
 }
+
+type PluginAnomaliesSuite struct {
+	reporter *ReporterMock
+	detector *AnomaliesDetector
+}
+
+var _ = Suite(&PluginAnomaliesSuite{})
+
+func (self *PluginAnomaliesSuite) SetUpTest(c *C) {
+	eventCache.Flush()
+	self.reporter = &ReporterMock{}
+	self.detector = &AnomaliesDetector{
+		reporter: self.reporter,
+		config: &monitoring.MonitorConfig{
+			Monitors: []*monitoring.Monitor{
+				&monitoring.Monitor{
+					PluginName: "^cache-",
+					Conditions: []*monitoring.Condition{
+						&monitoring.Condition{
+							AlertOnMatch: "critical",
+							OnlyAfter:    50 * time.Millisecond,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (self *PluginAnomaliesSuite) TestPluginsMatchedByTheSameMonitor(c *C) {
+	self.detector.Report("plugins.cache-1.status", 1.0, "", errplane.Dimensions{"status": "critical"})
+	// doesn't reset the events of cache-1
+	self.detector.Report("plugins.cache-2.status", 1.0, "", errplane.Dimensions{"status": "ok"})
+	time.Sleep(60 * time.Millisecond)
+	self.detector.Report("plugins.cache-1.status", 1.0, "", errplane.Dimensions{"status": "critical"})
+
+	c.Assert(self.reporter.events, HasLen, 1)
+	c.Assert(self.reporter.events[0].dimensions["PluginName"], Equals, "cache-1")
+}
+
+func (self *PluginAnomaliesSuite) TestInstancesOfTheSamePlugin(c *C) {
+	self.detector.Report("plugins.cache-1.status", 1.0, "", errplane.Dimensions{"status": "critical", "instance": "6379"})
+	// doesn't reset the events of the failing instance
+	self.detector.Report("plugins.cache-1.status", 1.0, "", errplane.Dimensions{"status": "ok", "instance": "6380"})
+	time.Sleep(60 * time.Millisecond)
+	self.detector.Report("plugins.cache-1.status", 1.0, "", errplane.Dimensions{"status": "critical", "instance": "6379"})
+
+	c.Assert(self.reporter.events, HasLen, 1)
+	c.Assert(self.reporter.events[0].dimensions["PluginName"], Equals, "cache-1")
+	c.Assert(self.reporter.events[0].dimensions["instance"], Equals, "6379")
+}
+
+func (self *PluginAnomaliesSuite) TestConcurrentReports(c *C) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(plugin string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				self.detector.Report("plugins."+plugin+".status", 1.0, "", errplane.Dimensions{"status": "critical"})
+			}
+		}(fmt.Sprintf("cache-%d", i%3))
+	}
+	wg.Wait()
+
+	time.Sleep(60 * time.Millisecond)
+	self.detector.Report("plugins.cache-0.status", 1.0, "", errplane.Dimensions{"status": "critical"})
+	c.Assert(len(self.reporter.events) > 0, Equals, true)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	log "code.google.com/p/log4go"
+	"fmt"
 	"github.com/bmizerany/pat"
 	"github.com/pmylund/go-cache"
 	"io/ioutil"
@@ -12,20 +13,28 @@ import (
 )
 
 // this file process local http request that contain commands to stop, start or restart a process
-var snoozedProcesses *cache.Cache
+var (
+	snoozedProcesses = cache.New(0, 0)
+	// the processes restarted through the local server, by nickname
+	restartingProcesses = cache.New(0, 0)
+)
 
 const (
 	PORT_FILE = "/tmp/errplane-agent.port"
 )
 
 func startLocalServer() {
-	snoozedProcesses = cache.New(0, 0)
-
 	m := pat.New()
 
 	m.Get("/stop_monitoring/:process", http.HandlerFunc(stopMonitoring))
 	m.Get("/start_monitoring/:process", http.HandlerFunc(startMonitoring))
 	m.Get("/restart_process/:process", http.HandlerFunc(restartProcess))
+	m.Get("/process_events", http.HandlerFunc(processEventsOutput))
+	m.Get("/process_events/:process", http.HandlerFunc(processEventsOutput))
+	m.Get("/maintenance_windows", http.HandlerFunc(maintenanceWindowsOutput))
+	m.Get("/rollback_plugins", http.HandlerFunc(rollbackPlugins))
+	m.Get("/plugins", http.HandlerFunc(pluginsOutput))
+	m.Get("/plugins/:plugin", http.HandlerFunc(pluginsOutput))
 
 	// Register this pat with the default serve mux so that other packages
 	// may also be exported. (i.e. /debug/pprof/*)
@@ -57,13 +66,16 @@ func getProcess(processName string) (*Process, error) {
 		return nil, err
 	}
 
-	// find the process and add it to our cache
+	return findMonitoredProcess(processName, monitoredProcesses), nil
+}
+
+func findMonitoredProcess(processName string, monitoredProcesses []*Process) *Process {
 	for _, process := range monitoredProcesses {
 		if process.Name == processName {
-			return process, nil
+			return process
 		}
 	}
-	return nil, nil
+	return nil
 }
 
 type InvalidProcessName struct{}
@@ -81,6 +93,12 @@ func snoozeProcess(processName string, duration time.Duration) error {
 	}
 	if process != nil {
 		log.Info("Snoozed %s", processName)
+		context := "until it is unsnoozed"
+		if duration > 0 {
+			context = fmt.Sprintf("for %s", duration)
+		}
+		// report the event before snoozing since the events of snoozed processes aren't sent
+		reportProcessEvent(processEventsReporter, process, context, "snoozed")
 		snoozedProcesses.Set(processName, true, duration)
 		return nil
 	}
@@ -97,6 +115,7 @@ func unsnoozeProcess(processName string) error {
 	if process != nil {
 		log.Info("Unsnoozed %s", processName)
 		snoozedProcesses.Delete(processName)
+		reportProcessEvent(processEventsReporter, process, "", "unsnoozed")
 		return nil
 	}
 	return &InvalidProcessName{}
@@ -145,20 +164,89 @@ func startMonitoring(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// the restart runs in the background since it waits for the process and
+// its dependents to be up, its events are available at /process_events
 func restartProcess(w http.ResponseWriter, req *http.Request) {
 	processName := req.URL.Query().Get(":process")
 
-	process, err := getProcess(processName)
-
+	monitoredProcesses, err := GetMonitoredProcesses(nil)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	process := findMonitoredProcess(processName, monitoredProcesses)
+	if process == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// fails if the process is already being restarted
+	if err := restartingProcesses.Add(process.Nickname, true, -1); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
 
-	log.Info("Restarting '%s'", processName)
+	go func() {
+		if err := restartWithDependents(process, monitoredProcesses); err != nil {
+			log.Error("Error while restarting '%s'. Error: %s", processName, err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
 
-	snoozedProcesses.Set(process.Name, true, -1)
-	defer snoozedProcesses.Delete(process.Name)
+// stop the processes that depend on the process, restart it and start
+// the dependents again once it is up. The process is unsnoozed, the
+// snoozed dependents are left alone and the dependents that can't be started are restarted by
+// monitorProceses
+func restartWithDependents(process *Process, monitoredProcesses []*Process) error {
+	dependents := make([]*Process, 0)
+	for _, dependent := range processDependents(process, monitoredProcesses) {
+		if _, ok := snoozedProcesses.Get(dependent.Name); ok {
+			log.Info("Not restarting '%s' since it is snoozed", dependent.Nickname)
+			continue
+		}
+		dependents = append(dependents, dependent)
+	}
+	restarted := append([]*Process{process}, dependents...)
+
+	log.Info("Restarting '%s' and %d dependent processes", process.Name, len(dependents))
+
+	// monitorProceses doesn't restart the processes in the meantime
+	for _, p := range restarted {
+		restartingProcesses.Set(p.Nickname, true, -1)
+		defer restartingProcesses.Delete(p.Nickname)
+	}
+
+	// stop the dependents in the reverse order they are started
+	for i := len(dependents) - 1; i >= 0; i-- {
+		stopProcess(dependents[i])
+	}
 	stopProcess(process)
-	startProcess(process)
+
+	reason := "requested through the local server"
+	for _, p := range restarted {
+		if result := attemptRestart(processEventsReporter, p, reason); result.Failed() {
+			return fmt.Errorf("Cannot start %s. %s", p.Nickname, result)
+		}
+		if !waitForProcessUp(p, p.CommandTimeout) {
+			return fmt.Errorf("%s isn't up %s after it was started", p.Nickname, p.CommandTimeout)
+		}
+		reportRestartSucceeded(processEventsReporter, p)
+		reason = fmt.Sprintf("%s was restarted", process.Nickname)
+	}
+
+	// the process is monitored again once it is restarted
+	snoozedProcesses.Delete(process.Name)
+	return nil
+}
+
+func rollbackPlugins(w http.ResponseWriter, req *http.Request) {
+	version, err := RollbackPlugins()
+	if err != nil {
+		log.Error("Cannot rollback plugins. Error: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Info("Plugins rolled back to version %s", version)
+	detectionCache.Flush()
+	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// builtin dns check, it resolves the given name and reports
+// plugins.dns.<resolve_time|records>
+//
+// Arguments:
+//   name:                  the name to resolve (required)
+//   type:                  A, AAAA, CNAME, MX, NS or TXT (default A)
+//   resolver:              the address of the resolver, e.g. 8.8.8.8 or 10.0.0.1:5353 (default the system resolvers)
+//   expect:                comma separated list of records that must be returned
+//   timeout:               resolution timeout (default 5s)
+//   resolve-time-warning:  warning if resolving takes longer than this duration
+//   resolve-time-critical: critical if resolving takes longer than this duration
+
+const (
+	DNS_DEFAULT_PORT    = "53"
+	DNS_DEFAULT_TIMEOUT = 5 * time.Second
+)
+
+func init() {
+	RegisterBuiltinPlugin(func() BuiltinPlugin { return &DnsCheck{} })
+}
+
+type DnsCheck struct {
+	name                string
+	recordType          string
+	resolver            *net.Resolver
+	resolverAddress     string
+	expect              []string
+	timeout             time.Duration
+	resolveTimeWarning  time.Duration
+	resolveTimeCritical time.Duration
+}
+
+func (self *DnsCheck) Name() string {
+	return "dns"
+}
+
+func (self *DnsCheck) Configure(args map[string]string) error {
+	self.name = args["name"]
+	if self.name == "" {
+		return fmt.Errorf("The dns check requires a name")
+	}
+
+	self.recordType = strings.ToUpper(args["type"])
+	switch self.recordType {
+	case "":
+		self.recordType = "A"
+	case "A", "AAAA", "CNAME", "MX", "NS", "TXT":
+	default:
+		return fmt.Errorf("Unsupported record type '%s'", self.recordType)
+	}
+
+	self.resolver = net.DefaultResolver
+	self.resolverAddress = "the system resolver"
+	if resolver := args["resolver"]; resolver != "" {
+		address := resolver
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			address = net.JoinHostPort(resolver, DNS_DEFAULT_PORT)
+		}
+		self.resolverAddress = address
+		self.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				dialer := &net.Dialer{}
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+
+	self.expect = nil
+	if expect := args["expect"]; expect != "" {
+		for _, record := range strings.Split(expect, ",") {
+			self.expect = append(self.expect, normalizeDnsRecord(record))
+		}
+	}
+
+	var err error
+	if self.timeout, err = parseDurationArg(args, "timeout", DNS_DEFAULT_TIMEOUT); err != nil {
+		return err
+	}
+	if self.resolveTimeWarning, err = parseDurationArg(args, "resolve-time-warning", 0); err != nil {
+		return err
+	}
+	if self.resolveTimeCritical, err = parseDurationArg(args, "resolve-time-critical", 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (self *DnsCheck) Collect() (*PluginOutput, error) {
+	started := time.Now()
+	records, err := self.lookup()
+	resolveTime := time.Now().Sub(started)
+	if err != nil {
+		return &PluginOutput{
+			state:     CRITICAL,
+			msg:       fmt.Sprintf("Critical: cannot resolve %s %s using %s. Error: %s", self.recordType, self.name, self.resolverAddress, err),
+			timestamp: time.Now(),
+		}, nil
+	}
+
+	metrics := map[string]float64{
+		"resolve_time": resolveTime.Seconds(),
+		"records":      float64(len(records)),
+	}
+
+	state := OK
+	problems := make([]string, 0)
+	for _, expected := range self.expect {
+		if !containsDnsRecord(records, expected) {
+			state = CRITICAL
+			problems = append(problems, fmt.Sprintf("%s is missing", expected))
+		}
+	}
+
+	switch {
+	case self.resolveTimeCritical > 0 && resolveTime > self.resolveTimeCritical:
+		state = CRITICAL
+		problems = append(problems, fmt.Sprintf("resolving took %s", resolveTime))
+	case self.resolveTimeWarning > 0 && resolveTime > self.resolveTimeWarning:
+		if state == OK {
+			state = WARNING
+		}
+		problems = append(problems, fmt.Sprintf("resolving took %s", resolveTime))
+	}
+
+	msg := fmt.Sprintf("%s: %s %s resolved to %s in %s", stateLabel(state), self.recordType, self.name, strings.Join(records, ", "), resolveTime)
+	if len(problems) > 0 {
+		msg = fmt.Sprintf("%s, %s", msg, strings.Join(problems, ", "))
+	}
+	return &PluginOutput{state: state, msg: msg, metrics: metrics, timestamp: time.Now()}, nil
+}
+
+func (self *DnsCheck) lookup() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), self.timeout)
+	defer cancel()
+
+	records := make([]string, 0)
+	switch self.recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if self.recordType == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := self.resolver.LookupIP(ctx, network, self.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			records = append(records, ip.String())
+		}
+	case "CNAME":
+		cname, err := self.resolver.LookupCNAME(ctx, self.name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, normalizeDnsRecord(cname))
+	case "MX":
+		mxs, err := self.resolver.LookupMX(ctx, self.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			records = append(records, normalizeDnsRecord(mx.Host))
+		}
+	case "NS":
+		nss, err := self.resolver.LookupNS(ctx, self.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			records = append(records, normalizeDnsRecord(ns.Host))
+		}
+	case "TXT":
+		txts, err := self.resolver.LookupTXT(ctx, self.name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, txts...)
+	}
+
+	sort.Strings(records)
+	return records, nil
+}
+
+// host names are compared without the trailing dot and case insensitively
+func normalizeDnsRecord(record string) string {
+	return strings.TrimSuffix(strings.TrimSpace(record), ".")
+}
+
+func containsDnsRecord(records []string, expected string) bool {
+	for _, record := range records {
+		if strings.EqualFold(record, expected) {
+			return true
+		}
+	}
+	return false
+}
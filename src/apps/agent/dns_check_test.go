@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	. "launchpad.net/gocheck"
+	"net"
+	"strings"
+)
+
+type DnsCheckSuite struct {
+	conn net.PacketConn
+}
+
+var _ = Suite(&DnsCheckSuite{})
+
+/* Mocks */
+
+// a dns server that knows the A records of www.example.com
+func (self *DnsCheckSuite) SetUpSuite(c *C) {
+	var err error
+	self.conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := self.conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if response := dnsResponse(buffer[:n]); response != nil {
+				self.conn.WriteTo(response, addr)
+			}
+		}
+	}()
+}
+
+func (self *DnsCheckSuite) TearDownSuite(c *C) {
+	self.conn.Close()
+}
+
+func dnsResponse(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// the question is the name followed by the type and class
+	end := 12
+	labels := make([]string, 0)
+	for end < len(query) && query[end] != 0 {
+		length := int(query[end])
+		if end+1+length > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+length]))
+		end += 1 + length
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, "."))
+	recordType := binary.BigEndian.Uint16(query[end-4 : end-2])
+
+	answers := make([][]byte, 0)
+	flags := uint16(0x8180) // response, recursion desired and available
+	switch {
+	case name != "www.example.com":
+		flags |= 3 // NXDOMAIN
+	case recordType == 1:
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			answer := []byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4}
+			answers = append(answers, append(answer, net.ParseIP(ip).To4()...))
+		}
+	}
+
+	response := make([]byte, 12, 512)
+	copy(response, query[:2])
+	binary.BigEndian.PutUint16(response[2:], flags)
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+	response = append(response, query[12:end]...)
+	for _, answer := range answers {
+		response = append(response, answer...)
+	}
+	return response
+}
+
+func (self *DnsCheckSuite) collect(c *C, args map[string]string) *PluginOutput {
+	args["resolver"] = self.conn.LocalAddr().String()
+	check := &DnsCheck{}
+	c.Assert(check.Configure(args), IsNil)
+	output, err := check.Collect()
+	c.Assert(err, IsNil)
+	return output
+}
+
+/* Tests */
+
+func (self *DnsCheckSuite) TestResolving(c *C) {
+	output := self.collect(c, map[string]string{"name": "www.example.com."})
+	c.Assert(output.state, Equals, OK)
+	c.Assert(output.metrics["records"], Equals, 2.0)
+	c.Assert(output.msg, Matches, "Ok: A www.example.com. resolved to 10.0.0.1, 10.0.0.2 in .*")
+
+	output = self.collect(c, map[string]string{"name": "www.example.com.", "expect": "10.0.0.2"})
+	c.Assert(output.state, Equals, OK)
+}
+
+func (self *DnsCheckSuite) TestMissingRecord(c *C) {
+	output := self.collect(c, map[string]string{"name": "www.example.com.", "expect": "10.0.0.1,10.0.0.3"})
+	c.Assert(output.state, Equals, CRITICAL)
+	c.Assert(output.msg, Matches, ".*10.0.0.3 is missing.*")
+}
+
+func (self *DnsCheckSuite) TestUnknownName(c *C) {
+	output := self.collect(c, map[string]string{"name": "unknown.example.com."})
+	c.Assert(output.state, Equals, CRITICAL)
+	c.Assert(output.metrics, IsNil)
+}
+
+func (self *DnsCheckSuite) TestInvalidArguments(c *C) {
+	check := &DnsCheck{}
+	c.Assert(check.Configure(map[string]string{}), NotNil)
+	c.Assert(check.Configure(map[string]string{"name": "example.com", "type": "SRV"}), NotNil)
+}
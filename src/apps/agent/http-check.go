@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// builtin http check, it requests the given url and reports
+// plugins.http.<response_time|status_code|body_size|cert_days_to_expiry>
+//
+// Arguments:
+//   url:                    the url to request (required)
+//   method:                 the request method (default GET)
+//   expected-status:        comma separated list of status codes or classes, e.g. 200,3xx (default 2xx,3xx)
+//   body-regex:             critical if the response body doesn't match this regex
+//   timeout:                request timeout (default 10s)
+//   follow-redirects:       follow redirects (default true)
+//   insecure:               don't verify the server certificate (default false)
+//   ca-file:                verify the server certificate using the certificates in this PEM file
+//   response-time-warning:  warning if the response takes longer than this duration
+//   response-time-critical: critical if the response takes longer than this duration
+//   cert-warning-days:      warning if the certificate expires in less than this many days (default 30)
+//   cert-critical-days:     critical if the certificate expires in less than this many days (default 7)
+
+const (
+	HTTP_DEFAULT_TIMEOUT            = 10 * time.Second
+	HTTP_DEFAULT_CERT_WARNING_DAYS  = 30
+	HTTP_DEFAULT_CERT_CRITICAL_DAYS = 7
+	HTTP_MAX_BODY_SIZE              = 1024 * 1024
+)
+
+func init() {
+	RegisterBuiltinPlugin(func() BuiltinPlugin { return &HttpCheck{} })
+}
+
+type HttpCheck struct {
+	url                  string
+	method               string
+	expectedStatus       []string
+	bodyRegex            *regexp.Regexp
+	responseTimeWarning  time.Duration
+	responseTimeCritical time.Duration
+	certWarningDays      float64
+	certCriticalDays     float64
+	client               *http.Client
+	transport            *http.Transport
+}
+
+func (self *HttpCheck) Name() string {
+	return "http"
+}
+
+func (self *HttpCheck) Configure(args map[string]string) error {
+	self.url = args["url"]
+	if self.url == "" {
+		return fmt.Errorf("The http check requires a url")
+	}
+
+	self.method = strings.ToUpper(args["method"])
+	if self.method == "" {
+		self.method = "GET"
+	}
+
+	self.expectedStatus = []string{"2xx", "3xx"}
+	if expected := args["expected-status"]; expected != "" {
+		self.expectedStatus = nil
+		for _, status := range strings.Split(expected, ",") {
+			status = strings.ToLower(strings.TrimSpace(status))
+			if len(status) != 3 {
+				return fmt.Errorf("Invalid expected status '%s'", status)
+			}
+			self.expectedStatus = append(self.expectedStatus, status)
+		}
+	}
+
+	self.bodyRegex = nil
+	if bodyRegex := args["body-regex"]; bodyRegex != "" {
+		var err error
+		if self.bodyRegex, err = regexp.Compile(bodyRegex); err != nil {
+			return err
+		}
+	}
+
+	timeout, err := parseDurationArg(args, "timeout", HTTP_DEFAULT_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	if self.responseTimeWarning, err = parseDurationArg(args, "response-time-warning", 0); err != nil {
+		return err
+	}
+	if self.responseTimeCritical, err = parseDurationArg(args, "response-time-critical", 0); err != nil {
+		return err
+	}
+	if self.certWarningDays, err = parseFloatArg(args, "cert-warning-days", HTTP_DEFAULT_CERT_WARNING_DAYS); err != nil {
+		return err
+	}
+	if self.certCriticalDays, err = parseFloatArg(args, "cert-critical-days", HTTP_DEFAULT_CERT_CRITICAL_DAYS); err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: args["insecure"] == "true"}
+	if caFile := args["ca-file"]; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Cannot find any certificate in %s", caFile)
+		}
+	}
+
+	self.transport = &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+	self.client = &http.Client{Timeout: timeout, Transport: self.transport}
+	if args["follow-redirects"] == "false" {
+		self.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return nil
+}
+
+// the check is replaced when its arguments change, don't leave the
+// connections of the previous configuration open
+func (self *HttpCheck) Close() {
+	self.transport.CloseIdleConnections()
+}
+
+func (self *HttpCheck) Collect() (*PluginOutput, error) {
+	request, err := http.NewRequest(self.method, self.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	response, err := self.client.Do(request)
+	if err != nil {
+		return &PluginOutput{
+			state:     CRITICAL,
+			msg:       fmt.Sprintf("Critical: %s %s failed. Error: %s", self.method, self.url, err),
+			timestamp: time.Now(),
+		}, nil
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, HTTP_MAX_BODY_SIZE))
+	responseTime := time.Now().Sub(started)
+	if err != nil {
+		return &PluginOutput{
+			state:     CRITICAL,
+			msg:       fmt.Sprintf("Critical: cannot read the response of %s %s. Error: %s", self.method, self.url, err),
+			timestamp: time.Now(),
+		}, nil
+	}
+
+	metrics := map[string]float64{
+		"response_time": responseTime.Seconds(),
+		"status_code":   float64(response.StatusCode),
+		"body_size":     float64(len(body)),
+	}
+
+	state := OK
+	problems := make([]string, 0)
+	addProblem := func(problemState PluginStateOutput, problem string) {
+		if problemState > state {
+			state = problemState
+		}
+		problems = append(problems, problem)
+	}
+
+	if !self.isExpectedStatus(response.StatusCode) {
+		addProblem(CRITICAL, fmt.Sprintf("unexpected status %d", response.StatusCode))
+	}
+
+	if self.bodyRegex != nil && !self.bodyRegex.Match(body) {
+		addProblem(CRITICAL, fmt.Sprintf("body doesn't match '%s'", self.bodyRegex))
+	}
+
+	switch {
+	case self.responseTimeCritical > 0 && responseTime > self.responseTimeCritical:
+		addProblem(CRITICAL, fmt.Sprintf("response took %s", responseTime))
+	case self.responseTimeWarning > 0 && responseTime > self.responseTimeWarning:
+		addProblem(WARNING, fmt.Sprintf("response took %s", responseTime))
+	}
+
+	if response.TLS != nil && len(response.TLS.PeerCertificates) > 0 {
+		expiry := response.TLS.PeerCertificates[0].NotAfter
+		days := math.Floor(expiry.Sub(time.Now()).Hours() / 24)
+		metrics["cert_days_to_expiry"] = days
+
+		switch {
+		case days < self.certCriticalDays:
+			addProblem(CRITICAL, fmt.Sprintf("certificate expires in %.0f days", days))
+		case days < self.certWarningDays:
+			addProblem(WARNING, fmt.Sprintf("certificate expires in %.0f days", days))
+		}
+	}
+
+	msg := fmt.Sprintf("%s %s returned %d in %s", self.method, self.url, response.StatusCode, responseTime)
+	if len(problems) > 0 {
+		msg = fmt.Sprintf("%s, %s", msg, strings.Join(problems, ", "))
+	}
+	msg = stateLabel(state) + ": " + msg
+
+	return &PluginOutput{state: state, msg: msg, metrics: metrics, timestamp: time.Now()}, nil
+}
+
+func (self *HttpCheck) isExpectedStatus(statusCode int) bool {
+	status := strconv.Itoa(statusCode)
+	for _, expected := range self.expectedStatus {
+		if expected == status || strings.HasSuffix(expected, "xx") && expected[0] == status[0] {
+			return true
+		}
+	}
+	return false
+}
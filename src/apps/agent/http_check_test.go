@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+type HttpCheckSuite struct {
+	server *httptest.Server
+}
+
+var _ = Suite(&HttpCheckSuite{})
+
+func (self *HttpCheckSuite) SetUpSuite(c *C) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "everything is fine, method: %s", req.Method)
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/ok", http.StatusFound)
+	})
+	self.server = httptest.NewServer(mux)
+}
+
+func (self *HttpCheckSuite) TearDownSuite(c *C) {
+	self.server.Close()
+}
+
+func (self *HttpCheckSuite) collect(c *C, args map[string]string) *PluginOutput {
+	check := &HttpCheck{}
+	c.Assert(check.Configure(args), IsNil)
+	output, err := check.Collect()
+	c.Assert(err, IsNil)
+	return output
+}
+
+func (self *HttpCheckSuite) TestSuccessfulRequest(c *C) {
+	output := self.collect(c, map[string]string{"url": self.server.URL + "/ok", "body-regex": "method: GET"})
+	c.Assert(output.state, Equals, OK)
+	c.Assert(output.metrics["status_code"], Equals, 200.0)
+	c.Assert(output.metrics["body_size"], Equals, float64(len("everything is fine, method: GET")))
+	c.Assert(output.metrics["response_time"] > 0, Equals, true)
+	_, ok := output.metrics["cert_days_to_expiry"]
+	c.Assert(ok, Equals, false)
+}
+
+func (self *HttpCheckSuite) TestMethod(c *C) {
+	output := self.collect(c, map[string]string{"url": self.server.URL + "/ok", "method": "post", "body-regex": "method: POST"})
+	c.Assert(output.state, Equals, OK)
+}
+
+func (self *HttpCheckSuite) TestUnexpectedStatus(c *C) {
+	output := self.collect(c, map[string]string{"url": self.server.URL + "/error"})
+	c.Assert(output.state, Equals, CRITICAL)
+	c.Assert(output.metrics["status_code"], Equals, 500.0)
+
+	output = self.collect(c, map[string]string{"url": self.server.URL + "/error", "expected-status": "200, 500"})
+	c.Assert(output.state, Equals, OK)
+
+	output = self.collect(c, map[string]string{"url": self.server.URL + "/redirect", "expected-status": "302", "follow-redirects": "false"})
+	c.Assert(output.state, Equals, OK)
+
+	output = self.collect(c, map[string]string{"url": self.server.URL + "/redirect", "expected-status": "302"})
+	c.Assert(output.state, Equals, CRITICAL)
+	c.Assert(output.metrics["status_code"], Equals, 200.0)
+}
+
+func (self *HttpCheckSuite) TestBodyRegex(c *C) {
+	output := self.collect(c, map[string]string{"url": self.server.URL + "/ok", "body-regex": "^not fine"})
+	c.Assert(output.state, Equals, CRITICAL)
+}
+
+func (self *HttpCheckSuite) TestResponseTime(c *C) {
+	output := self.collect(c, map[string]string{"url": self.server.URL + "/slow", "response-time-warning": "50ms"})
+	c.Assert(output.state, Equals, WARNING)
+
+	output = self.collect(c, map[string]string{"url": self.server.URL + "/slow", "response-time-warning": "10ms", "response-time-critical": "50ms"})
+	c.Assert(output.state, Equals, CRITICAL)
+
+	output = self.collect(c, map[string]string{"url": self.server.URL + "/slow", "timeout": "50ms"})
+	c.Assert(output.state, Equals, CRITICAL)
+	c.Assert(output.metrics, IsNil)
+}
+
+func (self *HttpCheckSuite) TestConnectionRefused(c *C) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	output := self.collect(c, map[string]string{"url": url})
+	c.Assert(output.state, Equals, CRITICAL)
+}
+
+func (self *HttpCheckSuite) TestTls(c *C) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	// the test certificate isn't signed by a known authority
+	output := self.collect(c, map[string]string{"url": server.URL, "expected-status": "404"})
+	c.Assert(output.state, Equals, CRITICAL)
+
+	output = self.collect(c, map[string]string{"url": server.URL, "expected-status": "404", "insecure": "true"})
+	c.Assert(output.state, Equals, OK)
+	expiry := server.Certificate().NotAfter
+	c.Assert(output.metrics["cert_days_to_expiry"] > 0, Equals, true)
+	c.Assert(output.metrics["cert_days_to_expiry"] <= expiry.Sub(time.Now()).Hours()/24, Equals, true)
+
+	days := fmt.Sprintf("%.0f", output.metrics["cert_days_to_expiry"]+10)
+	output = self.collect(c, map[string]string{"url": server.URL, "expected-status": "404", "insecure": "true", "cert-warning-days": days})
+	c.Assert(output.state, Equals, WARNING)
+}
+
+func (self *HttpCheckSuite) TestCloseIdleConnections(c *C) {
+	closed := make(chan bool, 1)
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- true
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	check := &HttpCheck{}
+	c.Assert(check.Configure(map[string]string{"url": server.URL, "expected-status": "404"}), IsNil)
+	output, err := check.Collect()
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, OK)
+
+	check.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		c.Fatalf("the idle connection wasn't closed")
+	}
+}
+
+func (self *HttpCheckSuite) TestInvalidArguments(c *C) {
+	check := &HttpCheck{}
+	c.Assert(check.Configure(map[string]string{}), NotNil)
+	c.Assert(check.Configure(map[string]string{"url": "http://localhost", "expected-status": "20"}), NotNil)
+	c.Assert(check.Configure(map[string]string{"url": "http://localhost", "body-regex": "("}), NotNil)
+	c.Assert(check.Configure(map[string]string{"url": "http://localhost", "timeout": "10"}), NotNil)
+}
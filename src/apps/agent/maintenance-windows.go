@@ -0,0 +1,121 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// The maintenance windows come from the agent configuration and from the
+// config service. The windows of the config service are refreshed every
+// time the plugins configuration is fetched.
+
+var (
+	maintenanceWindowsLock   sync.Mutex
+	remoteMaintenanceWindows []*MaintenanceWindow
+)
+
+type MaintenanceWindowState struct {
+	*MaintenanceWindow
+	Active    bool       `json:"active"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	NextStart *time.Time `json:"next_start,omitempty"`
+}
+
+// replace the windows of the config service, invalid windows are
+// ignored. The windows of the config are copied since the previous
+// windows may still be in use
+func updateMaintenanceWindows(config *AgentConfiguration) {
+	windows := make([]*MaintenanceWindow, 0, len(config.MaintenanceWindows))
+	for _, window := range config.MaintenanceWindows {
+		window := *window
+		if err := window.Parse(); err != nil {
+			log.Error("Invalid maintenance window '%s'. Error: %s", window.Name, err)
+			continue
+		}
+		windows = append(windows, &window)
+	}
+
+	maintenanceWindowsLock.Lock()
+	defer maintenanceWindowsLock.Unlock()
+	remoteMaintenanceWindows = windows
+}
+
+func getMaintenanceWindows() []*MaintenanceWindow {
+	maintenanceWindowsLock.Lock()
+	defer maintenanceWindowsLock.Unlock()
+
+	windows := make([]*MaintenanceWindow, 0, len(AgentConfig.MaintenanceWindows)+len(remoteMaintenanceWindows))
+	windows = append(windows, AgentConfig.MaintenanceWindows...)
+	return append(windows, remoteMaintenanceWindows...)
+}
+
+// the first active window that applies, or nil
+func activeMaintenanceWindow(now time.Time, applies func(*MaintenanceWindow) bool) *MaintenanceWindow {
+	for _, window := range getMaintenanceWindows() {
+		if _, active := window.ActiveSince(now); active && applies(window) {
+			return window
+		}
+	}
+	return nil
+}
+
+func processMaintenanceWindow(process *Process, now time.Time) *MaintenanceWindow {
+	return activeMaintenanceWindow(now, func(window *MaintenanceWindow) bool {
+		return window.AppliesToProcess(process)
+	})
+}
+
+func pluginMaintenanceWindow(plugin string, now time.Time) *MaintenanceWindow {
+	return activeMaintenanceWindow(now, func(window *MaintenanceWindow) bool {
+		return window.AppliesToPlugin(plugin)
+	})
+}
+
+func hostMaintenanceWindow(now time.Time) *MaintenanceWindow {
+	return activeMaintenanceWindow(now, func(window *MaintenanceWindow) bool {
+		return window.WholeHost()
+	})
+}
+
+// the reason the events and restarts of the process are suppressed, if
+// they are
+func processSilenced(process *Process, now time.Time) (string, bool) {
+	if _, ok := snoozedProcesses.Get(process.Name); ok {
+		return "it is snoozed", true
+	}
+	if window := processMaintenanceWindow(process, now); window != nil {
+		return "of the maintenance window " + window.Name, true
+	}
+	return "", false
+}
+
+func maintenanceWindowsState(now time.Time) []*MaintenanceWindowState {
+	states := make([]*MaintenanceWindowState, 0)
+	for _, window := range getMaintenanceWindows() {
+		state := &MaintenanceWindowState{MaintenanceWindow: window}
+		if start, active := window.ActiveSince(now); active {
+			end := start.Add(window.Duration)
+			state.Active = true
+			state.EndsAt = &end
+		}
+		if next, ok := window.NextStart(now); ok {
+			state.NextStart = &next
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+func maintenanceWindowsOutput(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(maintenanceWindowsState(time.Now()))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	. "utils"
+)
+
+type MaintenanceWindowsSuite struct{}
+
+var _ = Suite(&MaintenanceWindowsSuite{})
+
+func (self *MaintenanceWindowsSuite) SetUpTest(c *C) {
+	processEventsLock.Lock()
+	processEvents = processEvents[:0]
+	processEventsLock.Unlock()
+}
+
+func (self *MaintenanceWindowsSuite) TearDownTest(c *C) {
+	updateMaintenanceWindows(&AgentConfiguration{})
+}
+
+func (self *MaintenanceWindowsSuite) TestProcessEventsAreOnlyKeptLocally(c *C) {
+	updateMaintenanceWindows(&AgentConfiguration{
+		MaintenanceWindows: []*MaintenanceWindow{
+			{Name: "backups", Schedule: "* * * * *", RawDuration: "1h", Processes: []string{"worker"}},
+			// invalid windows are ignored
+			{Name: "invalid", Schedule: "* * *", RawDuration: "1h"},
+		},
+	})
+	c.Assert(getMaintenanceWindows(), HasLen, 1)
+
+	reporter := &ReporterMock{}
+	reportProcessEvent(reporter, &Process{Name: "worker", Nickname: "worker"}, "", "down")
+	reportProcessEvent(reporter, &Process{Name: "nginx", Nickname: "nginx"}, "", "down")
+
+	c.Assert(getProcessEvents(""), HasLen, 2)
+	c.Assert(reporter.events, HasLen, 1)
+	c.Assert(reporter.events[0].dimensions["nickname"], Equals, "nginx")
+
+	reason, silenced := processSilenced(&Process{Name: "worker", Nickname: "worker"}, time.Now())
+	c.Assert(silenced, Equals, true)
+	c.Assert(reason, Equals, "of the maintenance window backups")
+}
+
+func (self *MaintenanceWindowsSuite) TestHostWindow(c *C) {
+	updateMaintenanceWindows(&AgentConfiguration{
+		MaintenanceWindows: []*MaintenanceWindow{
+			{Name: "plugins", Schedule: "* * * * *", RawDuration: "1h", Plugins: []string{"redis"}},
+		},
+	})
+	now := time.Now()
+	c.Assert(pluginMaintenanceWindow("redis", now), NotNil)
+	c.Assert(pluginMaintenanceWindow("mysql", now), IsNil)
+	c.Assert(hostMaintenanceWindow(now), IsNil)
+
+	updateMaintenanceWindows(&AgentConfiguration{
+		MaintenanceWindows: []*MaintenanceWindow{{Name: "host", Schedule: "* * * * *", RawDuration: "1h"}},
+	})
+	c.Assert(hostMaintenanceWindow(now).Name, Equals, "host")
+	c.Assert(pluginMaintenanceWindow("mysql", now).Name, Equals, "host")
+}
+
+func (self *MaintenanceWindowsSuite) TestUpdatingTheSameConfig(c *C) {
+	config := &AgentConfiguration{
+		MaintenanceWindows: []*MaintenanceWindow{{Name: "host", Schedule: "* * * * *", RawDuration: "1h"}},
+	}
+	updateMaintenanceWindows(config)
+	windows := getMaintenanceWindows()
+	c.Assert(windows, HasLen, 1)
+
+	// the windows in use aren't parsed again
+	updateMaintenanceWindows(config)
+	c.Assert(windows[0] == config.MaintenanceWindows[0], Equals, false)
+	c.Assert(windows[0] == getMaintenanceWindows()[0], Equals, false)
+	c.Assert(hostMaintenanceWindow(time.Now()).Name, Equals, "host")
+}
+
+func (self *MaintenanceWindowsSuite) TestOutput(c *C) {
+	updateMaintenanceWindows(&AgentConfiguration{
+		MaintenanceWindows: []*MaintenanceWindow{
+			{Name: "active", Schedule: "* * * * *", RawDuration: "1h"},
+			{Name: "never", Schedule: "0 0 30 2 *", RawDuration: "1h"},
+		},
+	})
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/maintenance_windows", nil)
+	maintenanceWindowsOutput(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+
+	states := []map[string]interface{}{}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &states), IsNil)
+	c.Assert(states, HasLen, 2)
+	c.Assert(states[0]["name"], Equals, "active")
+	c.Assert(states[0]["active"], Equals, true)
+	c.Assert(states[0]["ends_at"], NotNil)
+	c.Assert(states[0]["next_start"], NotNil)
+	c.Assert(states[1]["active"], Equals, false)
+	c.Assert(states[1]["next_start"], IsNil)
+}
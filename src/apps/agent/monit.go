@@ -5,19 +5,22 @@ import (
 	"fmt"
 	"github.com/errplane/errplane-go"
 	"github.com/errplane/gosigar"
-	"os/exec"
+	"github.com/pmylund/go-cache"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	. "utils"
 )
 
-type ProcsByName map[string]*ProcStat
+type ProcsByName map[string][]*ProcStat
 type ProcsByPid map[int]*ProcStat
 
 func getProcesses() (ProcsByName, ProcsByPid) {
-	processes := make(map[string]*ProcStat)
-	processesByPid := make(map[int]*ProcStat)
+	processes := make(ProcsByName)
+	processesByPid := make(ProcsByPid)
 
 	pids := sigar.ProcList{}
 	pids.Get()
@@ -29,10 +32,8 @@ func getProcesses() (ProcsByName, ProcsByPid) {
 			continue
 		}
 
-		state := procStat.state
-
-		// FIXME: what if there is more than one process ?
-		processes[state.Name] = procStat
+		name := procStat.state.Name
+		processes[name] = append(processes[name], procStat)
 		processesByPid[pid] = procStat
 	}
 
@@ -41,67 +42,161 @@ func getProcesses() (ProcsByName, ProcsByPid) {
 
 func monitorProceses(ep *errplane.Errplane, ch chan error) {
 
-	var previousProcessesSnapshot map[string]*ProcStat
-	var previousProcessesSnapshotByPid map[int]*ProcStat
+	var previousProcessesSnapshot ProcsByName
+	var previousProcessesSnapshotByPid ProcsByPid
 
 	var monitoredProcesses []*Process
+	restarts := NewProcessRestarts()
+	metrics := NewProcessMetrics()
 
-	for {
-		// get the list of monitored processes from the config service
+	var connector *ProcConnector
+	var wakeup chan bool
+	pollInterval := AgentConfig.MonitoredSleep
+	if AgentConfig.ProcConnector {
 		var err error
-		monitoredProcesses, err = GetMonitoredProcesses(monitoredProcesses)
-		if err != nil {
-			log.Error("Error while getting the list of processes to monitor. Error: %s", err)
+		if connector, err = NewProcConnector(); err != nil {
+			log.Warn("Cannot listen to the proc connector, polling the processes every %s. Error: %s", AgentConfig.MonitoredSleep, err)
+		} else {
+			log.Info("Listening to the proc connector")
+			wakeup = connector.Wakeup
+			if pollInterval < PROC_CONNECTOR_POLL_INTERVAL {
+				pollInterval = PROC_CONNECTOR_POLL_INTERVAL
+			}
+		}
+	}
+
+	nextPoll := time.Now()
+	for {
+		now := time.Now()
+
+		// the checks in between the polls only update the status of the
+		// processes and restart them, the config and the metrics are
+		// updated when polling
+		poll := !now.Before(nextPoll)
+		if poll {
+			nextPoll = now.Add(pollInterval)
+
+			// get the list of monitored processes from the config service
+			// keep monitoring the previous list if the config service is down
+			if processes, err := GetMonitoredProcesses(monitoredProcesses); err != nil {
+				log.Error("Error while getting the list of processes to monitor. Error: %s", err)
+			} else {
+				monitoredProcesses = processes
+			}
 		}
 
 		processes, processesByPid := getProcesses()
 
-		now := time.Now()
+		watchedPids := make(map[int]bool)
+		watchedNames := make(map[string]bool)
+		allUp := previousProcessesSnapshot != nil
 
 		if previousProcessesSnapshot != nil {
+			var mergedStats []MergedProcStat
+			if poll {
+				mergedStats = mergeStats(previousProcessesSnapshotByPid, processesByPid)
+			}
 
 			for _, monitoredProcess := range monitoredProcesses {
 				log.Debug("Checking process health %#v", monitoredProcess)
 
-				status := getProcessStatus(monitoredProcess, processesByPid)
+				status, instances, context := getProcessStatus(monitoredProcess, processesByPid)
 
-				if status != monitoredProcess.LastStatus {
-					if status == UP {
-						reportProcessUp(ep, monitoredProcess)
-					} else {
-						// holy shit, process down!
-						reportProcessDown(ep, monitoredProcess)
-					}
+				handleProcessStatus(ep, monitoredProcess, status, context, monitoredProcesses, restarts, now)
+				if status != UP {
+					allUp = false
 				}
 
-				if status == DOWN {
-					if _, ok := snoozedProcesses.Get(monitoredProcess.Name); !ok {
-						startProcess(monitoredProcess)
-					}
+				for _, instance := range instances {
+					watchedPids[instance.pid] = true
+				}
+				if monitoredProcess.Name != "" {
+					watchedNames[monitoredProcess.Name] = true
 				}
 
-				monitoredProcess.LastStatus = status
-				// process is still up, or is still down. Do nothing in both cases.
-			}
+				if !poll {
+					continue
+				}
+
+				reportProcessInstances(ep, monitoredProcess, len(instances), now, ch)
+				reportProcessRestarts(ep, monitoredProcess, restarts.Count(monitoredProcess, now), now, ch)
 
-			// report the cpu usage and memory usage
-			mergedStats := mergeStats(previousProcessesSnapshotByPid, processesByPid)
-			i := 0
-			for _, stat := range mergedStats {
-				for _, monitoredProcess := range monitoredProcesses {
-					if processMatches(monitoredProcess, stat) {
-						i += 1
-						reportProcessCpuUsage(ep, monitoredProcess, &stat, now, false, ch)
-						reportProcessMemUsage(ep, monitoredProcess, &stat, now, false, ch)
-					}
+				// report the cpu usage and memory usage of all the instances
+				if stat := aggregateStats(instances, mergedStats); stat != nil {
+					reportProcessCpuUsage(ep, monitoredProcess, stat, now, false, ch)
+					reportProcessMemUsage(ep, monitoredProcess, stat, now, false, ch)
 				}
+				reportProcessMetrics(ep, monitoredProcess, metrics.Collect(instances, processesByPid, now), now, ch)
+			}
+			if poll {
+				metrics.Next()
 			}
 		}
 
-		previousProcessesSnapshot = processes
-		previousProcessesSnapshotByPid = processesByPid
+		// the cpu usage is computed over the poll interval
+		if poll {
+			previousProcessesSnapshot = processes
+			previousProcessesSnapshotByPid = processesByPid
+		}
+
+		nextCheck := nextPoll
+		if connector != nil {
+			connector.Watch(watchedPids, watchedNames)
+			nextCheck = procConnectorNextCheck(now, nextPoll, allUp)
+		}
+
+		// a nil wakeup channel blocks forever
+		select {
+		case <-wakeup:
+			log.Debug("A monitored process exited or started, checking the processes")
+			time.Sleep(procConnectorDelay(now, time.Now()))
+		case <-time.After(nextCheck.Sub(time.Now())):
+		}
+	}
+}
+
+// report the status changes of the process and restart it if it's down,
+// unless it's snoozed, in a maintenance window or one of its dependencies
+// is down
+func handleProcessStatus(ep Reporter, process *Process, status Status, context string, monitoredProcesses []*Process, restarts *ProcessRestarts, now time.Time) {
+	if status != process.LastStatus {
+		flapping, startedFlapping := restarts.Transition(process, status, now)
+		if startedFlapping {
+			reportProcessFlapping(ep, process)
+		} else if flapping {
+			log.Debug("Not reporting the status of %s since it is flapping", process.Nickname)
+		} else if status == UP {
+			reportProcessUp(ep, process, context)
+			reportRestartSucceeded(ep, process)
+		} else if status == TOO_MANY_INSTANCES {
+			reportProcessTooManyInstances(ep, process, context)
+		} else {
+			// holy shit, process down!
+			reportProcessDown(ep, process, context)
+		}
+	}
+	process.LastStatus = status
+	if status == UP {
+		attemptedRestarts.Delete(process.Nickname)
+	}
 
-		time.Sleep(AgentConfig.MonitoredSleep)
+	if status != DOWN {
+		return
+	}
+	if reason, silenced := processSilenced(process, now); silenced {
+		log.Debug("Not restarting '%s' since %s", process.Nickname, reason)
+	} else if _, restarting := restartingProcesses.Get(process.Nickname); restarting {
+		log.Debug("Not restarting '%s' since it is being restarted through the local server", process.Nickname)
+	} else if down := dependenciesDown(process, monitoredProcesses); len(down) > 0 {
+		log.Info("Not restarting '%s' until its dependencies %s are up", process.Nickname, strings.Join(down, ", "))
+	} else {
+		restart, gaveUp := restarts.ShouldRestart(process, now)
+		if restart {
+			attemptRestart(ep, process, fmt.Sprintf("restart %d in %s", restarts.Count(process, now)+1, process.RestartWindow))
+			restarts.Restarted(process, now)
+		} else if gaveUp {
+			reportProcessGaveUp(ep, process)
+		}
 	}
 }
 
@@ -120,9 +215,12 @@ func processMatches(monitoredProcess *Process, process interface{}) bool {
 		panic(fmt.Errorf("Unknwon type %T", process))
 	}
 
-	if len(args) == 0 || monitoredProcess.StatusCmd == "name" {
+	// the port status matches the owner of the port by name unless a regex is given
+	useRegex := monitoredProcess.StatusCmd == "regex" || (monitoredProcess.StatusCmd == "port" && monitoredProcess.Regex != "")
+
+	if len(args) == 0 || monitoredProcess.StatusCmd == "name" || (monitoredProcess.StatusCmd == "port" && !useRegex) {
 		return name == monitoredProcess.Name
-	} else if monitoredProcess.StatusCmd == "regex" {
+	} else if useRegex {
 		fullCmd := strings.Join(args, " ")
 		log.Debug("Matching %s to %s", fullCmd, monitoredProcess.Regex)
 		matches, err := regexp.MatchString(monitoredProcess.Regex, fullCmd)
@@ -135,93 +233,251 @@ func processMatches(monitoredProcess *Process, process interface{}) bool {
 	return false
 }
 
-func findProcess(process *Process, processes ProcsByPid) *ProcStat {
-	for _, proc := range processes {
-		if processMatches(process, proc) {
-			return proc
+// all the running instances of the process, returns an error explaining
+// why the process is considered down when the status isn't checked by
+// matching the process name or command line
+func findProcesses(process *Process, processes ProcsByPid) ([]*ProcStat, error) {
+	switch process.StatusCmd {
+	case "pidfile":
+		return findProcessByPidFile(process, processes)
+	case "systemd":
+		return findProcessBySystemdUnit(process, processes)
+	case "port":
+		return findProcessByPort(process, processes)
+	}
+	return findMatchingProcesses(process, processes), nil
+}
+
+// all the running instances matching the process sorted by pid
+func findMatchingProcesses(process *Process, processes ProcsByPid) []*ProcStat {
+	pids := make([]int, 0)
+	for pid, proc := range processes {
+		if proc.state.State != sigar.RunStateZombie && processMatches(process, proc) {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+
+	instances := make([]*ProcStat, 0, len(pids))
+	for _, pid := range pids {
+		instances = append(instances, processes[pid])
+	}
+	return instances
+}
+
+// returns the status of the process, its running instances and the
+// context of the status
+func getProcessStatus(process *Process, currentProcessesSnapshot ProcsByPid) (Status, []*ProcStat, string) {
+	instances, err := findProcesses(process, currentProcessesSnapshot)
+	if err != nil {
+		log.Debug("Process %s is down. Error: %s", process.Nickname, err)
+		return DOWN, instances, err.Error()
+	}
+	if process.StatusCmd == "systemd" && len(instances) == 0 {
+		return UP, instances, fmt.Sprintf("Unit %s is active without a main process", process.Unit)
+	}
+	return process.InstancesStatus(len(instances)), instances, instancesContext(process, len(instances))
+}
+
+// the sum of the cpu and memory usage of the given instances, nil if no
+// instance was running in both snapshots
+func aggregateStats(instances []*ProcStat, stats []MergedProcStat) *MergedProcStat {
+	pids := make(map[int]bool)
+	for _, instance := range instances {
+		pids[instance.pid] = true
+	}
+
+	var aggregated *MergedProcStat
+	for _, stat := range stats {
+		if !pids[stat.pid] {
+			continue
 		}
+		if aggregated == nil {
+			aggregated = &MergedProcStat{pid: stat.pid, name: stat.name, args: stat.args}
+		}
+		aggregated.cpuUsage += stat.cpuUsage
+		aggregated.memUsage += stat.memUsage
+	}
+	return aggregated
+}
+
+func instancesContext(process *Process, count int) string {
+	expected := fmt.Sprintf("at least %d", process.MinInstances)
+	if process.MaxInstances > 0 {
+		expected = fmt.Sprintf("between %d and %d", process.MinInstances, process.MaxInstances)
 	}
+	return fmt.Sprintf("%d instances running, expected %s", count, expected)
+}
+
+func reportProcessDown(ep Reporter, process *Process, context string) {
+	log.Info("Process %s went down, %s", process.Name, context)
+	reportProcessEvent(ep, process, context, "down")
+}
+
+func reportProcessTooManyInstances(ep Reporter, process *Process, context string) {
+	log.Info("Process %s has too many instances, %s", process.Name, context)
+	reportProcessEvent(ep, process, context, "too-many-instances")
+}
 
-	return nil
+func reportProcessFlapping(ep Reporter, process *Process) {
+	log.Warn("Process %s is flapping", process.Name)
+	reportProcessEvent(ep, process, fmt.Sprintf("went down %d times in %s", process.FlapThreshold, process.RestartWindow), "flapping")
 }
 
-func getProcessStatus(process *Process, currentProcessesSnapshot ProcsByPid) Status {
-	if process := findProcess(process, currentProcessesSnapshot); process != nil {
-		return UP
+func reportProcessGaveUp(ep Reporter, process *Process) {
+	log.Error("Giving up restarting process %s", process.Name)
+	reportProcessEvent(ep, process, fmt.Sprintf("restarted %d times in %s", process.MaxRestarts, process.RestartWindow), "gave-up")
+}
+
+func reportProcessRestarts(ep *errplane.Errplane, process *Process, count int, now time.Time, ch chan error) bool {
+	dimensions := errplane.Dimensions{
+		"nickname": process.Nickname,
+		"host":     AgentConfig.Hostname,
 	}
-	return DOWN
+	return report(ep, "server.stats.procs.restarts", float64(count), now, dimensions, ch)
 }
 
-func reportProcessDown(ep *errplane.Errplane, process *Process) {
-	log.Info("Process %s went down", process.Name)
-	reportProcessEvent(ep, process, process.Regex, "down")
+func reportProcessMetrics(ep *errplane.Errplane, process *Process, metrics map[string]float64, now time.Time, ch chan error) bool {
+	dimensions := errplane.Dimensions{
+		"nickname": process.Nickname,
+		"host":     AgentConfig.Hostname,
+	}
+	for name, value := range metrics {
+		if report(ep, "server.stats.procs."+name, value, now, dimensions, ch) {
+			return true
+		}
+	}
+	return false
 }
 
-func runCmd(cmd, user string) error {
-	args := []string{"-u", user, "-n"}
-	args = append(args, strings.Fields(cmd)...)
-	log.Info("Executing 'sudo -u %s -n %s'", user, cmd)
-	command := exec.Command("sudo", args...)
-	return command.Run()
+func reportProcessInstances(ep *errplane.Errplane, process *Process, count int, now time.Time, ch chan error) bool {
+	dimensions := errplane.Dimensions{
+		"nickname": process.Nickname,
+		"host":     AgentConfig.Hostname,
+	}
+	return report(ep, "server.stats.procs.instances", float64(count), now, dimensions, ch)
 }
 
-func startProcess(process *Process) {
-	if process.StartCmd == "" {
+func startProcess(process *Process) *CommandResult {
+	if len(process.StartCmd) == 0 {
 		log.Warn("No start command found for service %s", process.Name)
 	}
 
-	if err := runCmd(process.StartCmd, process.User); err != nil {
-		log.Error("Error while starting service %s. Error: %s", process.Name, err)
+	result := runProcessCommand(process.StartCmd, process.User, process.CommandTimeout)
+	if result.Failed() {
+		log.Error("Error while starting service %s. %s", process.Name, result)
+	} else {
+		log.Info("Started service %s. %s", process.Name, result)
 	}
+	return result
 }
 
 func stopProcess(process *Process) {
 	log.Info("Trying to stop process %s", process.Name)
 
-	if process.StopCmd == "kill" || process.StopCmd == "" {
+	if len(process.StopCmd) == 0 || (len(process.StopCmd) == 1 && process.StopCmd[0] == "kill") {
 		killProcess(process)
 		return
 	}
 
-	if err := runCmd(process.StopCmd, process.User); err != nil {
-		log.Error("Error while stopping service %s. Error: %s", process.Name, err)
+	if result := runProcessCommand(process.StopCmd, process.User, process.CommandTimeout); result.Failed() {
+		log.Error("Error while stopping service %s. %s", process.Name, result)
 	}
 }
 
 func killProcess(process *Process) {
 	_, processes := getProcesses()
-	stat := findProcess(process, processes)
-	if stat == nil {
-		log.Warn("Cannot find process %s", process.Name)
+	stats, err := findProcesses(process, processes)
+	if len(stats) == 0 {
+		log.Warn("Cannot find process %s. Error: %v", process.Name, err)
 		return
 	}
-	command := fmt.Sprintf("kill %d", stat.pid)
-	log.Debug("Running: %s", command)
-	if err := runCmd(command, process.Name); err == nil {
+	// a name or a regex can match unrelated processes, e.g. every java
+	// process on the host, only the instances found using the pidfile, the
+	// systemd unit or the port are surely the service
+	if len(stats) > 1 && process.StatusCmd != "pidfile" && process.StatusCmd != "systemd" && process.StatusCmd != "port" {
+		log.Error("Not killing the %d processes matching %s, a stop command is required to stop more than one instance", len(stats), process.Nickname)
 		return
 	}
-	command = fmt.Sprintf("kill -9 %d", stat.pid)
-	log.Warn("Cannot kill process '%s', trying %s", process.Name, command)
-	if err := runCmd(command, process.Name); err == nil {
-		return
+
+	for _, stat := range stats {
+		pid := strconv.Itoa(stat.pid)
+		if result := runProcessCommand(Command{"kill", pid}, process.User, process.CommandTimeout); !result.Failed() {
+			continue
+		}
+		log.Warn("Cannot kill process '%s', trying kill -9 %s", process.Name, pid)
+		result := runProcessCommand(Command{"kill", "-9", pid}, process.User, process.CommandTimeout)
+		if !result.Failed() {
+			continue
+		}
+		log.Error("Couldn't kill process '%s' with pid %s. %s", process.Name, pid, result)
 	}
-	log.Error("Couldn't kill process '%s'", process.Name)
 }
 
-func reportProcessUp(ep *errplane.Errplane, process *Process) {
+func reportProcessUp(ep Reporter, process *Process, context string) {
 	log.Info("Process %s came back up reporting event", process.Name)
-	reportProcessEvent(ep, process, process.Regex, "up")
+	reportProcessEvent(ep, process, context, "up")
+}
+
+// the processes that were restarted since they were last up, by nickname
+var attemptedRestarts = cache.New(0, 0)
+
+// start the process and report the attempt and the result of the start
+// command, the process being up is reported by the next check
+func attemptRestart(ep Reporter, process *Process, reason string) *CommandResult {
+	reportProcessEvent(ep, process, reason, "restart-attempted")
+	attemptedRestarts.Set(process.Nickname, true, -1)
+	result := startProcess(process)
+	status := "start-command-succeeded"
+	if result.Failed() {
+		status = "restart-failed"
+	}
+	reportProcessCommandEvent(ep, process, "", status, result)
+	return result
 }
 
-func reportProcessEvent(ep *errplane.Errplane, process *Process, regex, status string) {
-	if _, ok := snoozedProcesses.Get(process.Nickname); ok {
-		log.Debug("Not reporting %s event for '%s' since it is snoozed", status, process.Nickname)
+// report that the process is up after a restart was attempted
+func reportRestartSucceeded(ep Reporter, process *Process) {
+	if _, attempted := attemptedRestarts.Get(process.Nickname); attempted {
+		attemptedRestarts.Delete(process.Nickname)
+		reportProcessEvent(ep, process, "", "restart-succeeded")
+	}
+}
+
+func reportProcessEvent(ep Reporter, process *Process, context, status string) {
+	reportProcessCommandEvent(ep, process, context, status, nil)
+}
+
+// record the event in the history and report it unless the process is
+// snoozed or in a maintenance window, the result of the command is added to the event context
+func reportProcessCommandEvent(ep Reporter, process *Process, context, status string, result *CommandResult) {
+	event := newProcessEvent(process, status, context, result)
+	recordProcessEvent(event)
+
+	if reason, silenced := processSilenced(process, event.Timestamp); silenced {
+		log.Debug("Not reporting %s event for '%s' since %s", status, process.Nickname, reason)
+		return
+	}
+	if isNilReporter(ep) {
 		return
 	}
 
-	ep.Report("server.process.monitoring", 1.0, time.Now(), "", errplane.Dimensions{
+	if result != nil {
+		context = strings.TrimSpace(context + "\n" + result.String())
+	}
+	ep.Report("server.process.monitoring", 1.0, event.Timestamp, context, errplane.Dimensions{
 		"host":     AgentConfig.Hostname,
 		"nickname": process.Nickname,
 		"status":   status,
 	})
 }
+
+// processEventsReporter is nil until the agent starts and a nil
+// *errplane.Errplane isn't a nil Reporter
+func isNilReporter(ep Reporter) bool {
+	if ep == nil {
+		return true
+	}
+	value := reflect.ValueOf(ep)
+	return value.Kind() == reflect.Ptr && value.IsNil()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/errplane/gosigar"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"time"
+	. "utils"
+)
+
+type MonitSuite struct{}
+
+var _ = Suite(&MonitSuite{})
+
+func fakeProcStat(pid int, name string, args ...string) *ProcStat {
+	return &ProcStat{
+		pid:   pid,
+		state: sigar.ProcState{Name: name},
+		args:  sigar.ProcArgs{List: append([]string{name}, args...)},
+	}
+}
+
+func (self *MonitSuite) TestFindAllInstances(c *C) {
+	processes := ProcsByPid{
+		12: fakeProcStat(12, "worker"),
+		10: fakeProcStat(10, "worker"),
+		11: fakeProcStat(11, "nginx"),
+	}
+	process := &Process{Name: "worker", StatusCmd: "name", MinInstances: 1}
+
+	instances, err := findProcesses(process, processes)
+	c.Assert(err, IsNil)
+	c.Assert(instances, HasLen, 2)
+	c.Assert(instances[0].pid, Equals, 10)
+	c.Assert(instances[1].pid, Equals, 12)
+
+	status, instances, context := getProcessStatus(process, processes)
+	c.Assert(status, Equals, UP)
+	c.Assert(instances, HasLen, 2)
+	c.Assert(context, Equals, "2 instances running, expected at least 1")
+}
+
+func (self *MonitSuite) TestInstancesStatus(c *C) {
+	processes := ProcsByPid{
+		10: fakeProcStat(10, "worker"),
+		11: fakeProcStat(11, "worker"),
+		12: fakeProcStat(12, "worker"),
+	}
+
+	status, _, _ := getProcessStatus(&Process{Name: "worker", StatusCmd: "name", MinInstances: 4}, processes)
+	c.Assert(status, Equals, DOWN)
+	status, _, context := getProcessStatus(&Process{Name: "worker", StatusCmd: "name", MinInstances: 1, MaxInstances: 2}, processes)
+	c.Assert(status, Equals, TOO_MANY_INSTANCES)
+	c.Assert(context, Equals, "3 instances running, expected between 1 and 2")
+	status, _, _ = getProcessStatus(&Process{Name: "worker", StatusCmd: "name", MinInstances: 2, MaxInstances: 3}, processes)
+	c.Assert(status, Equals, UP)
+	status, instances, _ := getProcessStatus(&Process{Name: "nginx", StatusCmd: "name"}, processes)
+	c.Assert(status, Equals, DOWN)
+	c.Assert(instances, HasLen, 0)
+}
+
+func (self *MonitSuite) TestTooManyInstancesAreNotRestarted(c *C) {
+	marker := path.Join(c.MkDir(), "started")
+	process := &Process{
+		Name:           "worker",
+		Nickname:       "worker",
+		StatusCmd:      "name",
+		MinInstances:   1,
+		MaxInstances:   2,
+		StartCmd:       Command{"touch", marker},
+		CommandTimeout: time.Second,
+		RestartWindow:  time.Minute,
+		FlapThreshold:  5,
+	}
+	reporter := &ReporterMock{}
+	restarts := NewProcessRestarts()
+
+	handleProcessStatus(reporter, process, TOO_MANY_INSTANCES, "3 instances running, expected between 1 and 2", []*Process{process}, restarts, time.Now())
+
+	_, err := os.Stat(marker)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(restarts.Count(process, time.Now()), Equals, 0)
+	c.Assert(process.LastStatus, Equals, TOO_MANY_INSTANCES)
+	c.Assert(reporter.events, HasLen, 1)
+	c.Assert(reporter.events[0].dimensions["status"], Equals, "too-many-instances")
+
+	// a down process is restarted
+	handleProcessStatus(reporter, process, DOWN, "0 instances running, expected between 1 and 2", []*Process{process}, restarts, time.Now())
+	_, err = os.Stat(marker)
+	c.Assert(err, IsNil)
+}
+
+func (self *MonitSuite) TestAggregateStats(c *C) {
+	stats := []MergedProcStat{
+		MergedProcStat{pid: 10, name: "worker", args: []string{"worker"}, cpuUsage: 10, memUsage: 100},
+		MergedProcStat{pid: 11, name: "worker", args: []string{"worker"}, cpuUsage: 5, memUsage: 200},
+		MergedProcStat{pid: 12, name: "nginx", args: []string{"nginx"}, cpuUsage: 50, memUsage: 1000},
+	}
+
+	stat := aggregateStats([]*ProcStat{fakeProcStat(10, "worker"), fakeProcStat(11, "worker")}, stats)
+	c.Assert(stat, NotNil)
+	c.Assert(stat.cpuUsage, Equals, 15.0)
+	c.Assert(stat.memUsage, Equals, 300.0)
+
+	c.Assert(aggregateStats([]*ProcStat{fakeProcStat(13, "mysqld")}, stats), IsNil)
+}
+
+func (self *MonitSuite) TestPidFileStatus(c *C) {
+	pidFile := path.Join(c.MkDir(), "worker.pid")
+	processes := ProcsByPid{10: fakeProcStat(10, "worker"), 11: fakeProcStat(11, "nginx")}
+	process := &Process{Name: "worker", StatusCmd: "pidfile", PidFile: pidFile}
+
+	status, _, _ := getProcessStatus(process, processes)
+	c.Assert(status, Equals, DOWN)
+
+	c.Assert(ioutil.WriteFile(pidFile, []byte("10\n"), 0644), IsNil)
+	status, instances, _ := getProcessStatus(process, processes)
+	c.Assert(status, Equals, UP)
+	c.Assert(instances, HasLen, 1)
+	c.Assert(instances[0].pid, Equals, 10)
+
+	// the pid was reused by another process
+	c.Assert(ioutil.WriteFile(pidFile, []byte("11\n"), 0644), IsNil)
+	status, _, context := getProcessStatus(process, processes)
+	c.Assert(status, Equals, DOWN)
+	c.Assert(context, Matches, ".*is nginx not worker")
+}
+
+func (self *MonitSuite) TestSystemdStatus(c *C) {
+	dir := c.MkDir()
+	defer func(command string) { systemctlCommand = command }(systemctlCommand)
+	systemctlCommand = path.Join(dir, "systemctl")
+	processes := ProcsByPid{10: fakeProcStat(10, "worker")}
+	process := &Process{Name: "worker", StatusCmd: "systemd", Unit: "worker.service"}
+
+	writeSystemctl := func(state string, pid int) {
+		script := fmt.Sprintf("#!/usr/bin/env bash\n[ \"$6\" = worker.service ] || exit 1\necho ActiveState=%s\necho MainPID=%d\n", state, pid)
+		c.Assert(ioutil.WriteFile(systemctlCommand, []byte(script), 0755), IsNil)
+	}
+
+	writeSystemctl("active", 10)
+	status, instances, _ := getProcessStatus(process, processes)
+	c.Assert(status, Equals, UP)
+	c.Assert(instances, HasLen, 1)
+
+	// oneshot units are up while they are active
+	writeSystemctl("active", 0)
+	status, instances, _ = getProcessStatus(process, processes)
+	c.Assert(status, Equals, UP)
+	c.Assert(instances, HasLen, 0)
+
+	writeSystemctl("failed", 0)
+	status, _, context := getProcessStatus(process, processes)
+	c.Assert(status, Equals, DOWN)
+	c.Assert(context, Equals, "Unit worker.service is failed")
+
+	// a hung systemctl is killed
+	defer func(timeout time.Duration) { processCheckTimeout = timeout }(processCheckTimeout)
+	processCheckTimeout = 100 * time.Millisecond
+	c.Assert(ioutil.WriteFile(systemctlCommand, []byte("#!/usr/bin/env bash\nexec sleep 10\n"), 0755), IsNil)
+	started := time.Now()
+	status, _, context = getProcessStatus(process, processes)
+	c.Assert(time.Now().Sub(started) < 5*time.Second, Equals, true)
+	c.Assert(status, Equals, DOWN)
+	c.Assert(context, Matches, ".*Didn't finish in 100ms")
+}
+
+func (self *MonitSuite) TestPortStatus(c *C) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// the test process owns the listening socket
+	processes := ProcsByPid{os.Getpid(): fakeProcStat(os.Getpid(), "agent.test"), 10: fakeProcStat(10, "agent.test")}
+	process := &Process{Name: "agent.test", StatusCmd: "port", Port: port}
+
+	status, instances, _ := getProcessStatus(process, processes)
+	c.Assert(status, Equals, UP)
+	c.Assert(instances, HasLen, 1)
+	c.Assert(instances[0].pid, Equals, os.Getpid())
+
+	process.Name = "nginx"
+	status, _, _ = getProcessStatus(process, processes)
+	c.Assert(status, Equals, DOWN)
+
+	listener.Close()
+	process.Name = "agent.test"
+	status, _, context := getProcessStatus(process, processes)
+	c.Assert(status, Equals, DOWN)
+	c.Assert(context, Equals, fmt.Sprintf("Nothing is listening on port %d", port))
+}
+
+func (self *MonitSuite) TestPortStatusOnNonLoopbackAddress(c *C) {
+	var address net.IP
+	addresses, _ := net.InterfaceAddrs()
+	for _, a := range addresses {
+		if ip, ok := a.(*net.IPNet); ok && ip.IP.To4() != nil && !ip.IP.IsLoopback() {
+			address = ip.IP
+			break
+		}
+	}
+	if address == nil {
+		c.Skip("requires a non loopback address")
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(address.String(), "0"))
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	processes := ProcsByPid{os.Getpid(): fakeProcStat(os.Getpid(), "agent.test")}
+	process := &Process{Name: "agent.test", StatusCmd: "port", Port: port}
+	status, _, context := getProcessStatus(process, processes)
+	c.Assert(status, Equals, UP, Commentf("%s", context))
+}
+
+func (self *MonitSuite) TestProcNetAddress(c *C) {
+	addresses := map[string]string{
+		"0100007F":                         "127.0.0.1",
+		"0500000A":                         "10.0.0.5",
+		"00000000":                         "127.0.0.1",
+		"00000000000000000000000000000000": "::1",
+		"00000000000000000000000001000000": "::1",
+	}
+	if nativeEndian == binary.BigEndian {
+		c.Skip("the addresses are little endian")
+	}
+	for hexAddress, expected := range addresses {
+		address, err := procNetAddress(hexAddress)
+		c.Assert(err, IsNil)
+		c.Assert(address, Equals, expected, Commentf("%s", hexAddress))
+	}
+
+	_, err := procNetAddress("0100")
+	c.Assert(err, NotNil)
+}
+
+func (self *MonitSuite) TestKillOnlyASingleMatch(c *C) {
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+	process := &Process{
+		Name:           "sleep",
+		Nickname:       "sleep",
+		Regex:          "^sleep 123\\.456$",
+		StatusCmd:      "regex",
+		User:           current.Username,
+		CommandTimeout: time.Second,
+	}
+
+	first := exec.Command("sleep", "123.456")
+	c.Assert(first.Start(), IsNil)
+	defer first.Process.Kill()
+	second := exec.Command("sleep", "123.456")
+	c.Assert(second.Start(), IsNil)
+	defer second.Process.Kill()
+
+	// both instances match the regex
+	killProcess(process)
+	_, processes := getProcesses()
+	c.Assert(findMatchingProcesses(process, processes), HasLen, 2)
+
+	second.Process.Kill()
+	second.Wait()
+	killProcess(process)
+	c.Assert(first.Wait(), NotNil)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// Checks that are compiled into the agent. They are configured through
+// the same plugins map of the agent configuration as the external
+// plugins and their output is reported the same way, i.e. to
+// plugins.<name>.status and plugins.<name>.<metric>
+type BuiltinPlugin interface {
+	Name() string
+	// called with the instance arguments before the first Collect and
+	// whenever the arguments change
+	Configure(args map[string]string) error
+	Collect() (*PluginOutput, error)
+}
+
+// Builtin plugins can implement this interface to be reported as
+// available on this server, the same way should_monitor is used by
+// external plugins
+type BuiltinPluginDetector interface {
+	ShouldMonitor() bool
+}
+
+// Builtin plugins can implement this interface to release their
+// resources, e.g. idle connections, when their arguments change and they
+// are replaced by a new instance
+type BuiltinPluginCloser interface {
+	Close()
+}
+
+type builtinPluginInfo struct {
+	metadata *PluginMetadata
+	factory  func() BuiltinPlugin
+}
+
+type configuredBuiltinPlugin struct {
+	args   string
+	plugin BuiltinPlugin
+	lock   sync.Mutex
+}
+
+const (
+	BUILTIN_PLUGINS_VERSION = "builtin"
+)
+
+var (
+	builtinPlugins       = make(map[string]*builtinPluginInfo)
+	builtinInstances     = make(map[string]*configuredBuiltinPlugin)
+	builtinInstancesLock sync.Mutex
+)
+
+// Register a builtin plugin, metrics matching any of the calculateRates
+// regexes will have their rate of change reported to
+// plugins.<name>.<metric>.rate
+func RegisterBuiltinPlugin(factory func() BuiltinPlugin, calculateRates ...string) {
+	name := factory().Name()
+	if _, ok := builtinPlugins[name]; ok {
+		panic(fmt.Errorf("Builtin plugin %s is registered twice", name))
+	}
+
+	builtinPlugins[name] = &builtinPluginInfo{
+		metadata: &PluginMetadata{
+			Name:           name,
+			Verion:         BUILTIN_PLUGINS_VERSION,
+			Mode:           PLUGIN_MODE_ONESHOT,
+			IsBuiltin:      true,
+			CalculateRates: calculateRates,
+		},
+		factory: factory,
+	}
+}
+
+// removes a builtin plugin and its configured instances, used by the tests
+// to register fake plugins
+func unregisterBuiltinPlugin(name string) {
+	builtinInstancesLock.Lock()
+	defer builtinInstancesLock.Unlock()
+
+	delete(builtinPlugins, name)
+	for key := range builtinInstances {
+		if strings.HasPrefix(key, name+"/") {
+			delete(builtinInstances, key)
+		}
+	}
+}
+
+func getBuiltinPlugins() map[string]*PluginMetadata {
+	plugins := make(map[string]*PluginMetadata)
+	for name, info := range builtinPlugins {
+		metadata := *info.metadata
+		plugins[name] = &metadata
+	}
+	return plugins
+}
+
+// returns the configured builtin plugin for the given instance, creating
+// it or reconfiguring it if the instance arguments changed
+func getBuiltinInstance(plugin *PluginMetadata, instance *Instance) (*configuredBuiltinPlugin, error) {
+	info, ok := builtinPlugins[plugin.Name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown builtin plugin %s", plugin.Name)
+	}
+
+	args := serializeArgs(instance.Args)
+	key := fmt.Sprintf("%s/%s", plugin.Name, instance.Name)
+
+	builtinInstancesLock.Lock()
+	defer builtinInstancesLock.Unlock()
+
+	previous, ok := builtinInstances[key]
+	if ok && previous.args == args {
+		return previous, nil
+	}
+
+	builtin := info.factory()
+	if err := builtin.Configure(instance.Args); err != nil {
+		return nil, err
+	}
+	configured := &configuredBuiltinPlugin{args: args, plugin: builtin}
+	builtinInstances[key] = configured
+	if previous != nil {
+		go closeBuiltinPlugin(previous)
+	}
+	return configured, nil
+}
+
+// close the plugin once it's done collecting
+func closeBuiltinPlugin(configured *configuredBuiltinPlugin) {
+	closer, ok := configured.plugin.(BuiltinPluginCloser)
+	if !ok {
+		return
+	}
+	configured.lock.Lock()
+	defer configured.lock.Unlock()
+	closer.Close()
+}
+
+func serializeArgs(args map[string]string) string {
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	serialized := make([]string, 0, len(keys))
+	for _, key := range keys {
+		serialized = append(serialized, key+"="+args[key])
+	}
+	return strings.Join(serialized, "\x00")
+}
+
+func executeBuiltinPlugin(plugin *PluginMetadata, instance *Instance) (*PluginRun, *PluginOutput) {
+	run := &PluginRun{Plugin: plugin.Name, Instance: instance.Name, Timestamp: time.Now()}
+
+	output, err := collectBuiltinPlugin(plugin, instance)
+	if output == nil && err == nil {
+		err = fmt.Errorf("Plugin didn't return any output")
+	}
+	run.Duration = time.Now().Sub(run.Timestamp).String()
+	if err != nil {
+		log.Error("Builtin plugin %s failed. Error: %s", plugin.Name, err)
+		run.Error = err.Error()
+		output = &PluginOutput{state: UNKNOWN, msg: err.Error(), timestamp: time.Now()}
+	}
+
+	run.ExitStatus = int(output.state)
+	run.Stdout = strings.TrimSpace(output.msg + "\n" + output.longOutput)
+	if output.timestamp.IsZero() {
+		output.timestamp = time.Now()
+	}
+	return run, output
+}
+
+func collectBuiltinPlugin(plugin *PluginMetadata, instance *Instance) (*PluginOutput, error) {
+	configured, err := getBuiltinInstance(plugin, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		output *PluginOutput
+		err    error
+	}
+
+	// make sure the plugin isn't collecting twice at the same time, a
+	// collect that timed out may still be running
+	if !configured.lock.TryLock() {
+		return nil, fmt.Errorf("Plugin is still collecting")
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		defer configured.lock.Unlock()
+		output, err := configured.plugin.Collect()
+		ch <- result{output, err}
+	}()
+
+	timeout := pluginTimeout(plugin, instance)
+	select {
+	case result := <-ch:
+		return result.output, result.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Plugin took more than %s to collect", timeout)
+	}
+}
+
+// the state prefix of the plugin message, e.g. "Ok" or "Critical"
+func stateLabel(state PluginStateOutput) string {
+	name := state.String()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// helpers to parse the instance arguments of builtin plugins
+
+func parseDurationArg(args map[string]string, name string, defaultValue time.Duration) (time.Duration, error) {
+	value := args[name]
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s '%s'. Error: %s", name, value, err)
+	}
+	return duration, nil
+}
+
+func parseFloatArg(args map[string]string, name string, defaultValue float64) (float64, error) {
+	value := args[name]
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s '%s'. Error: %s", name, value, err)
+	}
+	return number, nil
+}
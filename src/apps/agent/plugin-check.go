@@ -2,10 +2,10 @@ package main
 
 import (
 	log "code.google.com/p/log4go"
+	"fmt"
 	"io/ioutil"
 	"launchpad.net/goyaml"
 	"os"
-	"os/exec"
 	"path"
 	"time"
 	. "utils"
@@ -32,57 +32,38 @@ func checkNewPlugins() {
 			pluginsToCheck = plugins
 		}
 
-		// remove the plugins that are already running
-
 		availablePlugins := make([]string, 0)
+		detections := make(map[string]*PluginDetection)
 
 		for name, plugin := range pluginsToCheck {
 			log.Debug("checking whether plugin %s needs to be installed on this server or not", name)
 
-			cmd := exec.Command(path.Join(plugin.Path, "should_monitor"))
-			err := cmd.Run()
-			if err != nil {
-				log.Debug("Doesn't seem like %s is installed on this server. Error: %s.", name, err)
+			detection := detectPlugin(plugin)
+			detections[name] = detection
+			if !detection.Available {
 				continue
 			}
 
 			availablePlugins = append(availablePlugins, name)
-			log.Debug("Plugin %s should be installed on this server. availablePlugins: %v", name, availablePlugins)
+			log.Debug("Plugin %s should be installed on this server (%s). availablePlugins: %v", name, detection.Reason, availablePlugins)
 		}
 
 		// update the agent information
-		SendPluginStatus(&AgentStatus{availablePlugins, time.Now().Unix()})
+		SendPluginStatus(&AgentStatus{Plugins: availablePlugins, Detections: detections, Timestamp: time.Now().Unix()})
 
 		time.Sleep(AgentConfig.Sleep)
 	}
 }
 
+// the plugins of the installed bundle, the builtin plugins and the custom
+// plugins. The builtin plugins don't depend on the bundle, they are
+// available even if the bundle can't be installed or listed
 func getAvailablePlugins() map[string]*PluginMetadata {
-	version, err := GetInstalledPluginsVersion()
-	if err != nil && !os.IsNotExist(err) {
-		return nil
-	}
-
-	latestVersion, err := GetCurrentPluginsVersion()
-	if err != nil {
-		log.Error("Cannot current plugins version. Error: %s", err)
-		return nil
-	}
+	plugins := getBundlePlugins()
 
-	if string(version) != string(latestVersion) {
-		InstallPlugin(latestVersion)
-	}
-
-	pluginsDir := path.Join(PLUGINS_DIR, string(latestVersion))
-	plugins, err := getPluginsInfo(pluginsDir)
-	if err != nil {
-		log.Error("Cannot list directory '%s'. Error: %s", pluginsDir, err)
-		return nil
-	}
 	customPlugins, err := getPluginsInfo(CUSTOM_PLUGINS_DIR)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		log.Error("Cannot list directory '%s'. Error: %s", CUSTOM_PLUGINS_DIR, err)
-		return nil
 	}
 
 	// report these plugins to the config api to be shown to the user on the UI
@@ -109,7 +90,12 @@ func getAvailablePlugins() map[string]*PluginMetadata {
 		}
 	}
 
-	// custom plugins take precendence
+	// builtin plugins replace the plugins with the same name, and custom
+	// plugins take precendence over both
+	for name, info := range getBuiltinPlugins() {
+		plugins[name] = info
+	}
+
 	for name, info := range customPlugins {
 		info.IsCustom = true
 		plugins[name] = info
@@ -117,6 +103,44 @@ func getAvailablePlugins() map[string]*PluginMetadata {
 	return plugins
 }
 
+// install the current plugins version if it changed and return its
+// plugins, the installed version is used if the config service is
+// unreachable
+func getBundlePlugins() map[string]*PluginMetadata {
+	plugins := make(map[string]*PluginMetadata)
+
+	version, err := GetInstalledPluginsVersion()
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Cannot read the installed plugins version. Error: %s", err)
+		return plugins
+	}
+
+	latestVersion, err := GetCurrentPluginsVersion()
+	if err != nil {
+		log.Error("Cannot get the current plugins version. Error: %s", err)
+	} else if version != latestVersion && !IsRolledBackPluginsVersion(latestVersion) {
+		if err := InstallPlugin(latestVersion); err != nil {
+			log.Error("Cannot install plugins version %s. Error: %s", latestVersion, err)
+		} else {
+			version = latestVersion
+			detectionCache.Flush()
+		}
+	}
+
+	if version == "" {
+		log.Error("No plugins version is installed")
+		return plugins
+	}
+
+	pluginsDir := path.Join(PLUGINS_DIR, version)
+	bundlePlugins, err := getPluginsInfo(pluginsDir)
+	if err != nil {
+		log.Error("Cannot list directory '%s'. Error: %s", pluginsDir, err)
+		return plugins
+	}
+	return bundlePlugins
+}
+
 func getPluginsInfo(dir string) (map[string]*PluginMetadata, error) {
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -158,5 +182,25 @@ func parsePluginInfo(dirname string) (*PluginMetadata, error) {
 	metadata.Name = path.Base(dirname)
 	metadata.Path = dirname
 
+	switch metadata.Mode {
+	case "":
+		metadata.Mode = PLUGIN_MODE_ONESHOT
+	case PLUGIN_MODE_ONESHOT, PLUGIN_MODE_STREAMING:
+	default:
+		return nil, fmt.Errorf("Unknown plugin mode '%s', supported modes are '%s' and '%s'", metadata.Mode, PLUGIN_MODE_ONESHOT, PLUGIN_MODE_STREAMING)
+	}
+
+	if metadata.RawInterval != "" {
+		if metadata.Interval, err = ParsePositiveDuration(metadata.RawInterval); err != nil {
+			return nil, fmt.Errorf("Invalid interval '%s'. Error: %s", metadata.RawInterval, err)
+		}
+	}
+
+	if metadata.RawTimeout != "" {
+		if metadata.Timeout, err = ParsePositiveDuration(metadata.RawTimeout); err != nil {
+			return nil, fmt.Errorf("Invalid timeout '%s'. Error: %s", metadata.RawTimeout, err)
+		}
+	}
+
 	return &metadata, nil
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/pmylund/go-cache"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// Plugins with needs-dependencies set in their info.yml have a setup
+// script that installs the dependencies in the directory passed as its
+// first argument. Setup runs once per version of the plugin, the status
+// and should_monitor scripts get the directory in
+// ERRPLANE_PLUGIN_DEPENDENCIES and its bin directory in their PATH.
+
+const (
+	PLUGIN_DEPS_ENV            = "ERRPLANE_PLUGIN_DEPENDENCIES"
+	PLUGIN_DEPS_INSTALLED_FILE = ".installed"
+	PLUGIN_SETUP_TIMEOUT       = 10 * time.Minute
+	PLUGIN_SETUP_RETRY         = 10 * time.Minute
+)
+
+var (
+	pluginsDepsDir    = PLUGINS_DEPS_DIR
+	pluginSetupLocks  = make(map[string]*sync.Mutex)
+	pluginSetupLock   sync.Mutex
+	runningSetups     = make(map[string]bool)
+	failedSetupsCache = cache.New(PLUGIN_SETUP_RETRY, time.Minute)
+)
+
+// the directory of the dependencies of this version of the plugin, the
+// setup script is part of the version so that custom plugins, which
+// don't have versions, are set up again when their setup changes
+func pluginDependenciesDir(plugin *PluginMetadata) (string, error) {
+	setup, err := ioutil.ReadFile(path.Join(plugin.Path, "setup"))
+	if err != nil {
+		return "", err
+	}
+	hash := sha1.Sum(setup)
+	version := plugin.Verion
+	if version == "" {
+		version = "custom"
+	}
+	return path.Join(pluginsDepsDir, plugin.Name, version+"-"+hex.EncodeToString(hash[:4])), nil
+}
+
+// install the dependencies of the plugin if they aren't installed yet
+// and return their directory
+func setupPluginDependencies(plugin *PluginMetadata) (string, error) {
+	dir, err := pluginDependenciesDir(plugin)
+	if err != nil {
+		return "", err
+	}
+
+	pluginSetupLock.Lock()
+	lock, ok := pluginSetupLocks[plugin.Name]
+	if !ok {
+		lock = &sync.Mutex{}
+		pluginSetupLocks[plugin.Name] = lock
+	}
+	pluginSetupLock.Unlock()
+
+	// other instances of the plugin wait for the setup to finish
+	lock.Lock()
+	defer lock.Unlock()
+
+	if dependenciesInstalled(dir) {
+		return dir, nil
+	}
+
+	if failure, ok := failedSetupsCache.Get(dir); ok {
+		return "", failure.(error)
+	}
+
+	if err := runPluginSetup(plugin, dir); err != nil {
+		err = fmt.Errorf("Cannot install the dependencies of plugin %s. Error: %s", plugin.Name, err)
+		failedSetupsCache.Set(dir, err, 0)
+		return "", err
+	}
+
+	prunePluginDependencies(plugin.Name, dir)
+	return dir, nil
+}
+
+// returns nil if the dependencies of the plugin are installed, otherwise
+// starts installing them in the background and returns an error. The
+// scheduler uses it so that a setup, which can take up to
+// PLUGIN_SETUP_TIMEOUT, doesn't hold one of its slots
+func pluginDependenciesReady(plugin *PluginMetadata) error {
+	dir, err := pluginDependenciesDir(plugin)
+	if err != nil {
+		return err
+	}
+	if dependenciesInstalled(dir) {
+		return nil
+	}
+	if failure, ok := failedSetupsCache.Get(dir); ok {
+		return failure.(error)
+	}
+
+	pluginSetupLock.Lock()
+	defer pluginSetupLock.Unlock()
+	if !runningSetups[dir] {
+		runningSetups[dir] = true
+		go func() {
+			setupPluginDependencies(plugin)
+			pluginSetupLock.Lock()
+			defer pluginSetupLock.Unlock()
+			delete(runningSetups, dir)
+		}()
+	}
+	return fmt.Errorf("The dependencies of plugin %s are being installed", plugin.Name)
+}
+
+func runPluginSetup(plugin *PluginMetadata, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// the setup runs in the plugin sandbox and must be able to write
+	// to the dependencies directory
+	if username := AgentConfig.PluginsSandbox.ForPlugin(plugin.Name).User; username != "" {
+		if err := chownToUser(dir, username); err != nil {
+			return err
+		}
+	}
+
+	cmdPath := path.Join(plugin.Path, "setup")
+	cmd, err := sandboxCommand(plugin.Name, plugin.Path, cmdPath, dir)
+	if err != nil {
+		return err
+	}
+	output := NewBoundedBuffer(PLUGIN_MAX_STDERR)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ch := make(chan error, 1)
+	go killPlugin(cmdPath, cmd, PLUGIN_SETUP_TIMEOUT, ch)
+	err = cmd.Wait()
+	ch <- err
+	if err != nil {
+		return fmt.Errorf("%s. Output: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	return ioutil.WriteFile(path.Join(dir, PLUGIN_DEPS_INSTALLED_FILE), []byte(time.Now().Format(time.RFC3339)), 0644)
+}
+
+func dependenciesInstalled(dir string) bool {
+	_, err := os.Stat(path.Join(dir, PLUGIN_DEPS_INSTALLED_FILE))
+	return err == nil
+}
+
+// remove the dependencies of the other versions of the plugin
+func prunePluginDependencies(name, current string) {
+	pluginDir := path.Join(pluginsDepsDir, name)
+	infos, err := ioutil.ReadDir(pluginDir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if dir := path.Join(pluginDir, info.Name()); dir != current {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func chownToUser(dir, username string) error {
+	owner, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(owner.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(owner.Gid)
+	if err != nil {
+		return err
+	}
+	return os.Chown(dir, uid, gid)
+}
+
+// expose the dependencies directory to the plugin command
+func setDependenciesEnv(cmd *exec.Cmd, dir string) {
+	for idx, variable := range cmd.Env {
+		if strings.HasPrefix(variable, "PATH=") {
+			cmd.Env[idx] = "PATH=" + path.Join(dir, "bin") + ":" + strings.TrimPrefix(variable, "PATH=")
+		}
+	}
+	cmd.Env = append(cmd.Env, PLUGIN_DEPS_ENV+"="+dir)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"github.com/pmylund/go-cache"
+	"os"
+	"path"
+	"strings"
+	"time"
+	. "utils"
+)
+
+const (
+	SHOULD_MONITOR_TIMEOUT   = 10 * time.Second
+	SHOULD_MONITOR_CACHE_TTL = 1 * time.Hour
+)
+
+// should_monitor results keyed by the plugin path, version and the
+// modification time of should_monitor, custom plugins don't have a
+// version and are edited in place. The cache is flushed when the plugins
+// are installed or rolled back
+var detectionCache = cache.New(SHOULD_MONITOR_CACHE_TTL, 10*time.Minute)
+
+func detectionCacheKey(plugin *PluginMetadata) string {
+	if plugin.IsBuiltin {
+		return BUILTIN_PLUGINS_VERSION + "/" + plugin.Name
+	}
+	var modified int64
+	if info, err := os.Stat(path.Join(plugin.Path, "should_monitor")); err == nil {
+		modified = info.ModTime().UnixNano()
+	}
+	return fmt.Sprintf("%s/%s/%d", plugin.Path, plugin.Verion, modified)
+}
+
+func detectPlugin(plugin *PluginMetadata) *PluginDetection {
+	key := detectionCacheKey(plugin)
+
+	if detection, ok := detectionCache.Get(key); ok {
+		return detection.(*PluginDetection)
+	}
+
+	var detection *PluginDetection
+	if plugin.IsBuiltin {
+		detection = detectBuiltinPlugin(plugin.Name)
+	} else {
+		detection = runShouldMonitor(plugin)
+	}
+	detectionCache.Set(key, detection, 0)
+	return detection
+}
+
+func detectBuiltinPlugin(name string) *PluginDetection {
+	info, ok := builtinPlugins[name]
+	if !ok {
+		return &PluginDetection{Available: false, Reason: "unknown builtin plugin"}
+	}
+	detector, ok := info.factory().(BuiltinPluginDetector)
+	if !ok {
+		return &PluginDetection{Available: false, Reason: "the builtin plugin cannot detect whether it's useful on this server"}
+	}
+	if detector.ShouldMonitor() {
+		return &PluginDetection{Available: true, Reason: "detected by the builtin plugin"}
+	}
+	return &PluginDetection{Available: false, Reason: "not detected by the builtin plugin"}
+}
+
+func runShouldMonitor(plugin *PluginMetadata) *PluginDetection {
+	cmdPath := path.Join(plugin.Path, "should_monitor")
+	cmd, err := sandboxCommand(plugin.Name, plugin.Path, cmdPath)
+	if err != nil {
+		return &PluginDetection{Available: false, Reason: fmt.Sprintf("cannot create the sandbox. Error: %s", err)}
+	}
+	// should_monitor can use the dependencies once they are installed
+	if plugin.HasDependencies {
+		if dir, err := pluginDependenciesDir(plugin); err == nil && dependenciesInstalled(dir) {
+			setDependenciesEnv(cmd, dir)
+		}
+	}
+
+	stdout := NewBoundedBuffer(PLUGIN_MAX_STDERR)
+	cmd.Stdout = stdout
+	if err := cmd.Start(); err != nil {
+		return &PluginDetection{Available: false, Reason: err.Error()}
+	}
+
+	ch := make(chan error, 1)
+	go killPlugin(cmdPath, cmd, SHOULD_MONITOR_TIMEOUT, ch)
+	err = cmd.Wait()
+	ch <- err
+
+	reason, instances, parseErr := parseShouldMonitorOutput(stdout.String())
+	if err != nil {
+		if !cmd.ProcessState.Exited() {
+			err = fmt.Errorf("should_monitor didn't finish in %s", SHOULD_MONITOR_TIMEOUT)
+		}
+		log.Debug("Doesn't seem like %s is installed on this server. Error: %s.", plugin.Name, err)
+		if reason == "" {
+			reason = err.Error()
+		}
+		return &PluginDetection{Available: false, Reason: reason}
+	}
+
+	if parseErr != nil {
+		log.Error("Cannot parse the instances discovered by plugin %s. Error: %s", plugin.Name, parseErr)
+		return &PluginDetection{Available: false, Reason: parseErr.Error()}
+	}
+
+	if reason == "" {
+		reason = "should_monitor exited with status 0"
+	}
+	return &PluginDetection{Available: true, Reason: reason, Instances: instances}
+}
+
+// should_monitor either prints the reason on its first line or the
+// instances it discovered as json, e.g.
+//
+//	[{"name": "3306", "args": {"port": "3306"}}]
+//
+// or
+//
+//	{"reason": "found 2 servers", "instances": [...]}
+func parseShouldMonitorOutput(output string) (string, []*Instance, error) {
+	output = strings.TrimSpace(output)
+	if !strings.HasPrefix(output, "[") && !strings.HasPrefix(output, "{") {
+		return strings.TrimSpace(strings.SplitN(output, "\n", 2)[0]), nil, nil
+	}
+
+	discovery := struct {
+		Reason    string      `json:"reason"`
+		Instances []*Instance `json:"instances"`
+	}{}
+	var err error
+	if strings.HasPrefix(output, "[") {
+		err = json.Unmarshal([]byte(output), &discovery.Instances)
+	} else {
+		err = json.Unmarshal([]byte(output), &discovery)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid should_monitor output. Error: %s", err)
+	}
+
+	names := make(map[string]bool)
+	instances := make([]*Instance, 0, len(discovery.Instances))
+	for _, instance := range discovery.Instances {
+		if instance == nil {
+			continue
+		}
+		if instance.Name == "" {
+			return "", nil, fmt.Errorf("Discovered instance without a name")
+		}
+		if names[instance.Name] {
+			return "", nil, fmt.Errorf("Discovered instance %s more than once", instance.Name)
+		}
+		names[instance.Name] = true
+		instances = append(instances, instance)
+	}
+
+	reason := discovery.Reason
+	if reason == "" && len(instances) > 0 {
+		reason = fmt.Sprintf("discovered %d instances", len(instances))
+	}
+	return reason, instances, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// Output formats used by other monitoring ecosystems. The plugin state is
+// always taken from the exit status of the plugin.
+
+// A json object of metrics, e.g. {"connections": 10, "memory": {"used": 100}}.
+// Nested objects are flattened using '.' as a separator and non numeric
+// values are ignored.
+func parseJsonOutput(cmdState ProcessState, output string) (*PluginOutput, error) {
+	object := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(output))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	metrics := make(map[string]float64)
+	flattenJsonMetrics("", object, metrics)
+
+	return &PluginOutput{state: pluginState(cmdState), metrics: metrics, timestamp: time.Now()}, nil
+}
+
+func flattenJsonMetrics(prefix string, object map[string]interface{}, metrics map[string]float64) {
+	for key, value := range object {
+		name := prefix + key
+		switch x := value.(type) {
+		case json.Number:
+			number, err := x.Float64()
+			if err != nil {
+				continue
+			}
+			metrics[name] = number
+		case bool:
+			if x {
+				metrics[name] = 1
+			} else {
+				metrics[name] = 0
+			}
+		case map[string]interface{}:
+			flattenJsonMetrics(name+".", x, metrics)
+		}
+	}
+}
+
+// Graphite plaintext protocol, one `name value [timestamp]` per line
+func parseGraphiteOutput(cmdState ProcessState, output string) (*PluginOutput, error) {
+	points := newPointsBuilder()
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("Invalid graphite line '%s'", line)
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value in graphite line '%s'. Error: %s", line, err)
+		}
+
+		timestamp := time.Now().Unix()
+		if len(fields) == 3 {
+			seconds, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid timestamp in graphite line '%s'. Error: %s", line, err)
+			}
+			timestamp = int64(seconds)
+		}
+
+		points.add(fields[0], value, timestamp, nil)
+	}
+
+	return &PluginOutput{state: pluginState(cmdState), points: points.writes, timestamp: time.Now()}, nil
+}
+
+// InfluxDB line protocol, `measurement[,tag=value...] field=value[,field=value...] [timestamp]`.
+// Tags become dimensions, each field is written to <measurement>.<field>
+// or just <measurement> if the field is called 'value'. String fields
+// are ignored.
+func parseInfluxOutput(cmdState ProcessState, output string) (*PluginOutput, error) {
+	points := newPointsBuilder()
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		sections := splitUnescaped(line, ' ')
+		if len(sections) < 2 || len(sections) > 3 {
+			return nil, fmt.Errorf("Invalid line protocol '%s'", line)
+		}
+
+		key := splitUnescaped(sections[0], ',')
+		measurement := unescapeInflux(key[0])
+		dimensions := errplane.Dimensions{}
+		for _, tag := range key[1:] {
+			keyAndValue := splitUnescaped(tag, '=')
+			if len(keyAndValue) != 2 {
+				return nil, fmt.Errorf("Invalid tag '%s' in line protocol '%s'", tag, line)
+			}
+			dimensions[unescapeInflux(keyAndValue[0])] = unescapeInflux(keyAndValue[1])
+		}
+
+		timestamp := time.Now().Unix()
+		if len(sections) == 3 {
+			nanoseconds, err := strconv.ParseInt(sections[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid timestamp in line protocol '%s'. Error: %s", line, err)
+			}
+			timestamp = nanoseconds / int64(time.Second)
+		}
+
+		for _, field := range splitUnescaped(sections[1], ',') {
+			keyAndValue := splitUnescaped(field, '=')
+			if len(keyAndValue) != 2 {
+				return nil, fmt.Errorf("Invalid field '%s' in line protocol '%s'", field, line)
+			}
+
+			value, ok := parseInfluxFieldValue(keyAndValue[1])
+			if !ok {
+				continue
+			}
+
+			name := measurement
+			if fieldName := unescapeInflux(keyAndValue[0]); fieldName != "value" {
+				name = measurement + "." + fieldName
+			}
+			points.add(name, value, timestamp, dimensions)
+		}
+	}
+
+	return &PluginOutput{state: pluginState(cmdState), points: points.writes, timestamp: time.Now()}, nil
+}
+
+func parseInfluxFieldValue(value string) (float64, bool) {
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true
+	}
+
+	if strings.HasPrefix(value, "\"") {
+		return 0, false
+	}
+
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "i"), "u")
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+// split on the given separator ignoring escaped separators and
+// separators inside double quotes
+func splitUnescaped(value string, separator byte) []string {
+	parts := make([]string, 0)
+	token := bytes.NewBufferString("")
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value):
+			token.WriteByte(value[i])
+			token.WriteByte(value[i+1])
+			i++
+		case value[i] == '"':
+			quoted = !quoted
+			token.WriteByte(value[i])
+		case value[i] == separator && !quoted:
+			parts = append(parts, token.String())
+			token = bytes.NewBufferString("")
+		default:
+			token.WriteByte(value[i])
+		}
+	}
+	return append(parts, token.String())
+}
+
+func unescapeInflux(value string) string {
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\\`, `\`).Replace(value)
+}
+
+// groups points by metric name, keeping the order in which the metrics
+// were first seen
+type pointsBuilder struct {
+	writes []*errplane.JsonPoints
+	byName map[string]*errplane.JsonPoints
+}
+
+func newPointsBuilder() *pointsBuilder {
+	return &pointsBuilder{make([]*errplane.JsonPoints, 0), make(map[string]*errplane.JsonPoints)}
+}
+
+func (self *pointsBuilder) add(name string, value float64, timestamp int64, dimensions errplane.Dimensions) {
+	pointDimensions := errplane.Dimensions{"host": AgentConfig.Hostname}
+	for key, value := range dimensions {
+		pointDimensions[key] = value
+	}
+
+	write, ok := self.byName[name]
+	if !ok {
+		write = &errplane.JsonPoints{Name: name}
+		self.byName[name] = write
+		self.writes = append(self.writes, write)
+	}
+	write.Points = append(write.Points, &errplane.JsonPoint{Value: value, Time: timestamp, Dimensions: pointDimensions})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PLUGIN_MAX_STDOUT = 64 * 1024
+	PLUGIN_MAX_STDERR = 8 * 1024
+)
+
+// a writer that keeps the first limit bytes and silently drops the rest
+type BoundedBuffer struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func NewBoundedBuffer(limit int) *BoundedBuffer {
+	return &BoundedBuffer{limit: limit}
+}
+
+func (self *BoundedBuffer) Write(p []byte) (int, error) {
+	remaining := self.limit - self.buffer.Len()
+	if remaining < len(p) {
+		self.truncated = true
+		if remaining > 0 {
+			self.buffer.Write(p[:remaining])
+		}
+		return len(p), nil
+	}
+	return self.buffer.Write(p)
+}
+
+func (self *BoundedBuffer) String() string {
+	if self.truncated {
+		return self.buffer.String() + "\n[truncated]"
+	}
+	return self.buffer.String()
+}
+
+// the result of the last run of a plugin instance, kept in memory for
+// debugging
+type PluginRun struct {
+	Plugin     string    `json:"plugin"`
+	Instance   string    `json:"instance"`
+	Timestamp  time.Time `json:"timestamp"`
+	Duration   string    `json:"duration"`
+	ExitStatus int       `json:"exit_status"`
+	Stdout     string    `json:"stdout"`
+	Stderr     string    `json:"stderr"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// the context that is sent with the plugins.<name>.status point
+func (self *PluginRun) Context() string {
+	context := make([]string, 0, 3)
+	lines := strings.SplitN(strings.TrimSpace(self.Stdout), "\n", 2)
+	if len(lines) == 2 {
+		context = append(context, lines[1])
+	}
+	if stderr := strings.TrimSpace(self.Stderr); stderr != "" {
+		context = append(context, "stderr:\n"+stderr)
+	}
+	if self.Error != "" {
+		context = append(context, "error: "+self.Error)
+	}
+	return strings.Join(context, "\n")
+}
+
+var (
+	pluginRunsLock sync.Mutex
+	pluginRuns     = make(map[string]*PluginRun)
+)
+
+func recordPluginRun(run *PluginRun) {
+	pluginRunsLock.Lock()
+	defer pluginRunsLock.Unlock()
+	pluginRuns[fmt.Sprintf("%s/%s", run.Plugin, run.Instance)] = run
+}
+
+func getPluginRuns(pluginName string) []*PluginRun {
+	pluginRunsLock.Lock()
+	defer pluginRunsLock.Unlock()
+
+	keys := make([]string, 0, len(pluginRuns))
+	for key, run := range pluginRuns {
+		if pluginName == "" || run.Plugin == pluginName {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	runs := make([]*PluginRun, 0, len(keys))
+	for _, key := range keys {
+		runs = append(runs, pluginRuns[key])
+	}
+	return runs
+}
+
+func pluginsOutput(w http.ResponseWriter, req *http.Request) {
+	runs := getPluginRuns(req.URL.Query().Get(":plugin"))
+	data, err := json.Marshal(runs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
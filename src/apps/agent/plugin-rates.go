@@ -0,0 +1,185 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// The previous values of the metrics matching calculate-rates are kept in
+// the agent state directory so that the rates aren't lost when the agent
+// restarts. Values are assumed to be monotonic counters, a value lower
+// than the previous one means the counter was reset.
+
+const (
+	PLUGIN_RATES_FILE          = "plugin-rates.json"
+	PLUGIN_RATES_SAVE_INTERVAL = 1 * time.Minute
+	// samples older than this aren't used to calculate rates
+	PLUGIN_RATES_MAX_AGE = 1 * time.Hour
+)
+
+type rateSample struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+type PluginRates struct {
+	lock     sync.Mutex
+	file     string
+	loaded   bool
+	lastSave time.Time
+	samples  map[string]*rateSample
+	regexes  map[string][]*regexp.Regexp
+}
+
+var pluginRates = NewPluginRates(path.Join(AGENT_STATE_DIR, PLUGIN_RATES_FILE))
+
+// file is where the samples are persisted, nothing is persisted if it's empty
+func NewPluginRates(file string) *PluginRates {
+	return &PluginRates{
+		file:    file,
+		samples: make(map[string]*rateSample),
+		regexes: make(map[string][]*regexp.Regexp),
+	}
+}
+
+// whether the rate of the given metric should be reported, the
+// calculate-rates regexes are compiled once per version of the plugin
+func (self *PluginRates) ShouldCalculateRate(plugin *PluginMetadata, metric string) bool {
+	if len(plugin.CalculateRates) == 0 {
+		return false
+	}
+
+	self.lock.Lock()
+	key := fmt.Sprintf("%s/%s/%s", plugin.Name, plugin.Verion, plugin.Path)
+	regexes, ok := self.regexes[key]
+	if !ok {
+		regexes = make([]*regexp.Regexp, 0, len(plugin.CalculateRates))
+		for _, rate := range plugin.CalculateRates {
+			regex, err := regexp.Compile(rate)
+			if err != nil {
+				log.Error("Invalid regex %s in plugin %s. Error: %s", rate, plugin.Name, err)
+				continue
+			}
+			regexes = append(regexes, regex)
+		}
+		self.regexes[key] = regexes
+	}
+	self.lock.Unlock()
+
+	for _, regex := range regexes {
+		if regex.MatchString(metric) {
+			return true
+		}
+	}
+	return false
+}
+
+// store the current values of the given plugin instance and return the
+// rate of change of the values since the previous sample
+func (self *PluginRates) Update(key string, timestamp time.Time, values map[string]float64) map[string]float64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.load()
+
+	rates := make(map[string]float64)
+	if len(values) == 0 {
+		return rates
+	}
+
+	previous := self.samples[key]
+	self.samples[key] = &rateSample{timestamp, values}
+	defer self.save()
+
+	if previous == nil {
+		return rates
+	}
+
+	timeDiff := timestamp.Sub(previous.Timestamp)
+	if timeDiff <= 0 || timeDiff > PLUGIN_RATES_MAX_AGE {
+		return rates
+	}
+
+	for name, value := range values {
+		previousValue, ok := previous.Values[name]
+		if !ok {
+			continue
+		}
+
+		diff := value - previousValue
+		if diff < 0 {
+			// the counter was reset, assume it started from zero
+			log.Debug("Counter %s of %s was reset from %f to %f", name, key, previousValue, value)
+			diff = value
+		}
+		rates[name] = diff / timeDiff.Seconds()
+	}
+	return rates
+}
+
+func (self *PluginRates) load() {
+	if self.loaded || self.file == "" {
+		return
+	}
+	self.loaded = true
+
+	content, err := ioutil.ReadFile(self.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Cannot read the plugins rate state from %s. Error: %s", self.file, err)
+		}
+		return
+	}
+
+	samples := make(map[string]*rateSample)
+	if err := json.Unmarshal(content, &samples); err != nil {
+		log.Error("Cannot parse the plugins rate state in %s. Error: %s", self.file, err)
+		return
+	}
+	for key, sample := range samples {
+		if _, ok := self.samples[key]; !ok && sample != nil {
+			self.samples[key] = sample
+		}
+	}
+}
+
+func (self *PluginRates) save() {
+	if self.file == "" || time.Now().Sub(self.lastSave) < PLUGIN_RATES_SAVE_INTERVAL {
+		return
+	}
+	self.lastSave = time.Now()
+
+	// drop the samples of the instances that aren't running anymore
+	for key, sample := range self.samples {
+		if time.Now().Sub(sample.Timestamp) > PLUGIN_RATES_MAX_AGE {
+			delete(self.samples, key)
+		}
+	}
+
+	content, err := json.Marshal(self.samples)
+	if err != nil {
+		log.Error("Cannot marshal the plugins rate state. Error: %s", err)
+		return
+	}
+
+	if err := os.MkdirAll(path.Dir(self.file), 0755); err != nil {
+		log.Error("Cannot create directory %s. Error: %s", path.Dir(self.file), err)
+		return
+	}
+	temp := self.file + ".tmp"
+	if err := ioutil.WriteFile(temp, content, 0644); err != nil {
+		log.Error("Cannot write the plugins rate state to %s. Error: %s", temp, err)
+		return
+	}
+	if err := os.Rename(temp, self.file); err != nil {
+		log.Error("Cannot write the plugins rate state to %s. Error: %s", self.file, err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	. "utils"
+)
+
+// Plugins are executed with a sanitized environment and optionally as a
+// different user with resource limits. Go cannot set the resource limits
+// of a child process, so the agent executes itself with the limits in
+// the environment, sets them, switches to the plugin user and then execs
+// the plugin.
+
+const (
+	PLUGIN_SANDBOX_LIMITS_ENV = "ERRPLANE_AGENT_PLUGIN_LIMITS"
+	PLUGIN_SANDBOX_USER_ENV   = "ERRPLANE_AGENT_PLUGIN_USER"
+	PLUGIN_SANDBOX_PATH       = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+var rlimitResources = map[string]int{
+	"cpu":    syscall.RLIMIT_CPU,
+	"as":     syscall.RLIMIT_AS,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"fsize":  syscall.RLIMIT_FSIZE,
+}
+
+func init() {
+	if limits := os.Getenv(PLUGIN_SANDBOX_LIMITS_ENV); limits != "" {
+		execWithLimits(limits, os.Getenv(PLUGIN_SANDBOX_USER_ENV), os.Args[1:])
+	}
+}
+
+func execWithLimits(limits, credential string, args []string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "Cannot start plugin in its sandbox. Error: %s\n", err)
+		os.Exit(int(UNKNOWN))
+	}
+
+	if len(args) == 0 {
+		fail(fmt.Errorf("Missing plugin command"))
+	}
+
+	for _, limit := range strings.Split(limits, ",") {
+		nameAndValue := strings.SplitN(limit, "=", 2)
+		if len(nameAndValue) != 2 {
+			fail(fmt.Errorf("Invalid limit '%s'", limit))
+		}
+		resource, ok := rlimitResources[nameAndValue[0]]
+		if !ok {
+			fail(fmt.Errorf("Unknown limit '%s'", nameAndValue[0]))
+		}
+		value, err := strconv.ParseUint(nameAndValue[1], 10, 64)
+		if err != nil {
+			fail(err)
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value}); err != nil {
+			fail(fmt.Errorf("Cannot set %s limit to %d. Error: %s", nameAndValue[0], value, err))
+		}
+	}
+
+	if credential != "" {
+		if err := switchCredential(credential); err != nil {
+			fail(err)
+		}
+	}
+
+	env := make([]string, 0)
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, PLUGIN_SANDBOX_LIMITS_ENV+"=") && !strings.HasPrefix(variable, PLUGIN_SANDBOX_USER_ENV+"=") {
+			env = append(env, variable)
+		}
+	}
+
+	fail(syscall.Exec(args[0], args, env))
+}
+
+// credential is formatted as uid:gid:group1,group2
+func switchCredential(credential string) error {
+	fields := strings.Split(credential, ":")
+	if len(fields) != 3 {
+		return fmt.Errorf("Invalid credential '%s'", credential)
+	}
+	uid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return err
+	}
+	groups := make([]int, 0)
+	for _, group := range strings.Split(fields[2], ",") {
+		if group == "" {
+			continue
+		}
+		id, err := strconv.Atoi(group)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, id)
+	}
+
+	// the groups have to be changed while we are still privileged
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("Cannot set the groups. Error: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("Cannot set the gid. Error: %s", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("Cannot set the uid. Error: %s", err)
+	}
+	return nil
+}
+
+// the resource limits of the sandbox in the format expected by execWithLimits
+func sandboxLimits(sandbox *PluginSandbox) string {
+	limits := make([]string, 0)
+	if sandbox.MaxCpuTime > 0 {
+		limits = append(limits, fmt.Sprintf("cpu=%d", int64(math.Ceil(sandbox.MaxCpuTime.Seconds()))))
+	}
+	if sandbox.MaxMemory > 0 {
+		limits = append(limits, fmt.Sprintf("as=%d", sandbox.MaxMemory*1024*1024))
+	}
+	if sandbox.MaxOpenFiles > 0 {
+		limits = append(limits, fmt.Sprintf("nofile=%d", sandbox.MaxOpenFiles))
+	}
+	if sandbox.MaxFileSize > 0 {
+		limits = append(limits, fmt.Sprintf("fsize=%d", sandbox.MaxFileSize*1024*1024))
+	}
+	return strings.Join(limits, ",")
+}
+
+// create the command that runs the given plugin script in the sandbox
+// configured for the plugin, dir is the default working directory
+func sandboxCommand(pluginName, dir, cmdPath string, args ...string) (*exec.Cmd, error) {
+	sandbox := AgentConfig.PluginsSandbox.ForPlugin(pluginName)
+
+	env := map[string]string{
+		"PATH": PLUGIN_SANDBOX_PATH,
+		"HOME": os.Getenv("HOME"),
+		"USER": os.Getenv("USER"),
+		"LANG": "C",
+	}
+
+	var credential *syscall.Credential
+	if sandbox.User != "" {
+		runAs, err := user.Lookup(sandbox.User)
+		if err != nil {
+			return nil, err
+		}
+		if credential, err = userCredential(runAs); err != nil {
+			return nil, err
+		}
+		env["HOME"] = runAs.HomeDir
+		env["USER"] = runAs.Username
+	}
+	env["LOGNAME"] = env["USER"]
+
+	for key, value := range sandbox.Environment {
+		env[key] = value
+	}
+
+	var cmd *exec.Cmd
+	if limits := sandboxLimits(sandbox); limits != "" {
+		agent, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(agent, append([]string{cmdPath}, args...)...)
+		env[PLUGIN_SANDBOX_LIMITS_ENV] = limits
+		if credential != nil {
+			// the agent binary may not be executable by the plugin user,
+			// switch the user after setting the limits instead
+			env[PLUGIN_SANDBOX_USER_ENV] = formatCredential(credential)
+			credential = nil
+		}
+	} else {
+		cmd = exec.Command(cmdPath, args...)
+	}
+
+	cmd.Env = make([]string, 0, len(env))
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	sort.Strings(cmd.Env)
+
+	cmd.Dir = dir
+	if sandbox.WorkingDirectory != "" {
+		cmd.Dir = sandbox.WorkingDirectory
+	}
+
+	if credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
+	return cmd, nil
+}
+
+func userCredential(runAs *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(runAs.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(runAs.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groupIds, err := runAs.GroupIds()
+	if err != nil {
+		return credential, nil
+	}
+	for _, groupId := range groupIds {
+		if id, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, nil
+}
+
+func formatCredential(credential *syscall.Credential) string {
+	groups := make([]string, 0, len(credential.Groups))
+	for _, group := range credential.Groups {
+		groups = append(groups, strconv.FormatUint(uint64(group), 10))
+	}
+	return fmt.Sprintf("%d:%d:%s", credential.Uid, credential.Gid, strings.Join(groups, ","))
+}
+
+// the maximum number of bytes read from the plugin stdout
+func pluginMaxOutput(plugin *PluginMetadata) int {
+	if maxOutput := AgentConfig.PluginsSandbox.ForPlugin(plugin.Name).MaxOutput; maxOutput > 0 {
+		return maxOutput
+	}
+	return PLUGIN_MAX_STDOUT
+}
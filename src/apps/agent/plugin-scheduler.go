@@ -0,0 +1,141 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"math/rand"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	SCHEDULER_TICK = 1 * time.Second
+)
+
+type scheduledInstance struct {
+	plugin   *PluginMetadata
+	instance *Instance
+	nextRun  time.Time
+	running  bool
+}
+
+// Runs every plugin instance on its own interval, making sure that two
+// runs of the same instance never overlap and that no more than
+// AgentConfig.MaxConcurrentPlugins plugins are running at the same time
+type PluginScheduler struct {
+	ep        *errplane.Errplane
+	lock      sync.Mutex
+	instances map[string]*scheduledInstance
+	slots     chan bool
+}
+
+func NewPluginScheduler(ep *errplane.Errplane) *PluginScheduler {
+	return &PluginScheduler{
+		ep:        ep,
+		instances: make(map[string]*scheduledInstance),
+		slots:     make(chan bool, AgentConfig.MaxConcurrentPlugins),
+	}
+}
+
+// the invalid intervals and timeouts of the instances are reported when
+// the configuration is fetched, see GetPluginsToRun
+func pluginInterval(plugin *PluginMetadata, instance *Instance) time.Duration {
+	if interval, err := ParsePositiveDuration(instance.Interval); err == nil {
+		return interval
+	}
+	if plugin.Interval > 0 {
+		return plugin.Interval
+	}
+	return AgentConfig.Sleep
+}
+
+func pluginTimeout(plugin *PluginMetadata, instance *Instance) time.Duration {
+	if timeout, err := ParsePositiveDuration(instance.Timeout); err == nil {
+		return timeout
+	}
+	if plugin.Timeout > 0 {
+		return plugin.Timeout
+	}
+	return pluginInterval(plugin, instance)
+}
+
+// Replace the set of scheduled instances. New instances start at a random
+// point of their first interval to avoid running all plugins at once.
+func (self *PluginScheduler) Update(instances map[*PluginMetadata][]*Instance) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+
+	for plugin, pluginInstances := range instances {
+		for _, instance := range pluginInstances {
+			key := fmt.Sprintf("%s/%s", plugin.Name, instance.Name)
+			seen[key] = true
+
+			if scheduled, ok := self.instances[key]; ok {
+				scheduled.plugin = plugin
+				scheduled.instance = instance
+				continue
+			}
+
+			interval := pluginInterval(plugin, instance)
+			jitter := time.Duration(rand.Int63n(int64(interval)))
+			log.Debug("Scheduling plugin %s every %s starting in %s", key, interval, jitter)
+			self.instances[key] = &scheduledInstance{plugin, instance, now.Add(jitter), false}
+		}
+	}
+
+	for key := range self.instances {
+		if !seen[key] {
+			log.Debug("Unscheduling plugin %s", key)
+			delete(self.instances, key)
+		}
+	}
+}
+
+func (self *PluginScheduler) Run() {
+	for {
+		self.runDueInstances(time.Now())
+		time.Sleep(SCHEDULER_TICK)
+	}
+}
+
+func (self *PluginScheduler) runDueInstances(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for key, scheduled := range self.instances {
+		if now.Before(scheduled.nextRun) {
+			continue
+		}
+
+		interval := pluginInterval(scheduled.plugin, scheduled.instance)
+		scheduled.nextRun = scheduled.nextRun.Add(interval)
+		if scheduled.nextRun.Before(now) {
+			scheduled.nextRun = now.Add(interval)
+		}
+
+		if scheduled.running {
+			log.Warn("Plugin %s is still running, skipping this run", key)
+			continue
+		}
+
+		scheduled.running = true
+		go self.run(scheduled, scheduled.plugin, scheduled.instance)
+	}
+}
+
+func (self *PluginScheduler) run(scheduled *scheduledInstance, plugin *PluginMetadata, instance *Instance) {
+	self.slots <- true
+	defer func() {
+		<-self.slots
+		self.lock.Lock()
+		scheduled.running = false
+		self.lock.Unlock()
+	}()
+
+	runPlugin(self.ep, instance, plugin)
+}
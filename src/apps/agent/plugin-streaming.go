@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	. "utils"
+)
+
+const (
+	STREAMING_MIN_BACKOFF = 1 * time.Second
+	STREAMING_MAX_BACKOFF = 5 * time.Minute
+)
+
+// streaming plugins are running while printing metrics, there's no exit
+// status to take the state from, each line carries its own state instead
+type streamingLineState struct {
+	state PluginStateOutput
+}
+
+func (self *streamingLineState) ExitStatus() int { return int(self.state) }
+
+// parse a line printed by a streaming plugin, the line can start with
+// the state of the plugin followed by a tab, e.g. "critical\tdisk is
+// full", the lines without a state are ok
+func parseStreamingLine(plugin *PluginMetadata, line string) (*PluginOutput, error) {
+	state := OK
+	if stateAndOutput := strings.SplitN(line, "\t", 2); len(stateAndOutput) == 2 {
+		name := strings.ToLower(strings.TrimSpace(stateAndOutput[0]))
+		for _, candidate := range []PluginStateOutput{OK, WARNING, CRITICAL, UNKNOWN} {
+			if candidate.String() == name {
+				state = candidate
+				line = stateAndOutput[1]
+				break
+			}
+		}
+	}
+	return parsePluginOutput(plugin, &streamingLineState{state}, line)
+}
+
+type streamingPlugin struct {
+	plugin   *PluginMetadata
+	instance *Instance
+	stop     chan bool
+}
+
+// Keeps streaming plugins running, restarting them with an exponential
+// backoff whenever they exit. Each line printed by the plugin is parsed
+// according to the plugin output type and reported the same way the
+// output of a one shot plugin is reported.
+type StreamingPluginSupervisor struct {
+	ep      PluginReporter
+	lock    sync.Mutex
+	plugins map[string]*streamingPlugin
+}
+
+func NewStreamingPluginSupervisor(ep PluginReporter) *StreamingPluginSupervisor {
+	return &StreamingPluginSupervisor{ep: ep, plugins: make(map[string]*streamingPlugin)}
+}
+
+// Start the new instances and stop the ones that aren't in the given
+// map anymore. Instances whose plugin or configuration changed, e.g. the
+// plugin was upgraded or the instance arguments changed, are restarted.
+func (self *StreamingPluginSupervisor) Update(instances map[*PluginMetadata][]*Instance) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	seen := make(map[string]bool)
+
+	for plugin, pluginInstances := range instances {
+		for _, instance := range pluginInstances {
+			key := fmt.Sprintf("%s/%s", plugin.Name, instance.Name)
+			seen[key] = true
+
+			if running, ok := self.plugins[key]; ok {
+				if reflect.DeepEqual(running.plugin, plugin) && reflect.DeepEqual(running.instance, instance) {
+					continue
+				}
+				log.Info("Plugin %s or its configuration changed, restarting it", key)
+				close(running.stop)
+			}
+
+			streaming := &streamingPlugin{plugin, instance, make(chan bool)}
+			self.plugins[key] = streaming
+			go self.supervise(streaming)
+		}
+	}
+
+	for key, running := range self.plugins {
+		if !seen[key] {
+			log.Info("Stopping streaming plugin %s", key)
+			close(running.stop)
+			delete(self.plugins, key)
+		}
+	}
+}
+
+func (self *StreamingPluginSupervisor) supervise(streaming *streamingPlugin) {
+	backoff := STREAMING_MIN_BACKOFF
+
+	for {
+		started := time.Now()
+		err := self.run(streaming)
+
+		select {
+		case <-streaming.stop:
+			return
+		default:
+		}
+
+		// the plugin was running long enough, start over with the minimum backoff
+		if time.Now().Sub(started) > STREAMING_MAX_BACKOFF {
+			backoff = STREAMING_MIN_BACKOFF
+		}
+
+		log.Error("Streaming plugin %s exited, restarting it in %s. Error: %s", streaming.plugin.Name, backoff, err)
+		msg := fmt.Sprintf("Plugin exited. Error: %s", err)
+		output := &PluginOutput{state: UNKNOWN, msg: msg, timestamp: time.Now()}
+		reportPluginOutput(self.ep, streaming.plugin, streaming.instance, output, "")
+
+		select {
+		case <-streaming.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > STREAMING_MAX_BACKOFF {
+			backoff = STREAMING_MAX_BACKOFF
+		}
+	}
+}
+
+func (self *StreamingPluginSupervisor) run(streaming *streamingPlugin) error {
+	plugin, instance := streaming.plugin, streaming.instance
+
+	cmd, err := pluginCommand(plugin, instance)
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := NewBoundedBuffer(PLUGIN_MAX_STDERR)
+	cmd.Stderr = stderr
+
+	cmdPath := path.Join(plugin.Path, "status")
+	log.Info("Starting streaming plugin %s", cmdPath)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-streaming.stop:
+			log.Debug("Killing streaming plugin %s", cmdPath)
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 4096), pluginMaxOutput(plugin))
+	for scanner.Scan() {
+		line := scanner.Text()
+		run := &PluginRun{Plugin: plugin.Name, Instance: instance.Name, Timestamp: time.Now(), Stdout: line}
+		output, err := parseStreamingLine(plugin, line)
+		if err != nil {
+			log.Error("Cannot parse plugin %s output. Output: %s. Error: %s", cmdPath, line, err)
+			run.Error = fmt.Sprintf("Cannot parse output. Error: %s", err)
+			recordPluginRun(run)
+			continue
+		}
+		recordPluginRun(run)
+		reportPluginOutput(self.ep, plugin, instance, output, "")
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error("Error while reading output from plugin %s. Error: %s", cmdPath, err)
+		// stop the plugin, otherwise it will block writing to its stdout
+		cmd.Process.Kill()
+	}
+
+	err = cmd.Wait()
+	run := &PluginRun{Plugin: plugin.Name, Instance: instance.Name, Timestamp: time.Now(), Stderr: stderr.String()}
+	if cmd.ProcessState != nil {
+		run.ExitStatus = (&ProcessStateWrapper{cmd.ProcessState}).ExitStatus()
+	}
+	if err == nil {
+		err = fmt.Errorf("Plugin exited with status 0")
+	}
+	run.Error = err.Error()
+	recordPluginRun(run)
+	return err
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	"flag"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// `errplane-agent plugin test` runs a plugin the same way the agent does
+// and prints the parsed output and every metric that would be reported,
+// without sending anything to errplane
+
+var PLUGIN_OUTPUT_TYPES = []string{"errplane", "nagios", "json", "graphite", "influxdb"}
+
+type instanceArgs map[string]string
+
+func (self instanceArgs) String() string {
+	return serializeArgs(self)
+}
+
+func (self instanceArgs) Set(value string) error {
+	nameAndValue := strings.SplitN(value, "=", 2)
+	if len(nameAndValue) != 2 {
+		return fmt.Errorf("Arguments should be in the form name=value")
+	}
+	self[nameAndValue[0]] = nameAndValue[1]
+	return nil
+}
+
+func pluginSubcommand(args []string, out io.Writer) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintf(out, "Usage: errplane-agent plugin test [options] <plugin-directory|builtin-plugin-name>\n")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("plugin test", flag.ContinueOnError)
+	flags.SetOutput(out)
+	configFile := flags.String("config", "/etc/errplane-agent/config.yml", "The agent config file, used for the plugins sandbox")
+	instanceName := flags.String("instance", "", "The name of the instance")
+	runs := flags.Int("runs", 1, "The number of times the plugin is run, rates are reported from the second run")
+	interval := flags.Duration("interval", 10*time.Second, "The time to wait between two runs")
+	pluginArgs := make(instanceArgs)
+	flags.Var(pluginArgs, "arg", "An instance argument in the form name=value, can be repeated")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *runs < 1 {
+		fmt.Fprintf(out, "Usage: errplane-agent plugin test [options] <plugin-directory|builtin-plugin-name>\n")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	// only show the errors of the agent
+	log.AddFilter("stdout", log.ERROR, log.NewConsoleLogWriter())
+
+	if err := InitConfig(*configFile); err != nil {
+		fmt.Fprintf(out, "Cannot read the agent configuration, the plugin will run without a sandbox. Error: %s\n", err)
+		AgentConfig.PluginsSandbox = PluginSandbox{}
+		AgentConfig.Hostname, _ = os.Hostname()
+	}
+
+	plugin, info, problems, err := loadPluginToTest(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(out, "Cannot load plugin %s. Error: %s\n", flags.Arg(0), err)
+		return 1
+	}
+
+	instance := &Instance{Name: *instanceName, Args: pluginArgs}
+	problems = append(problems, validateInstanceArgs(info, instance)...)
+
+	fmt.Fprintf(out, "Plugin:   %s\n", plugin.Name)
+	if !plugin.IsBuiltin {
+		fmt.Fprintf(out, "Path:     %s\n", plugin.Path)
+		fmt.Fprintf(out, "Output:   %s\n", plugin.Output)
+		fmt.Fprintf(out, "Mode:     %s\n", plugin.Mode)
+	}
+	fmt.Fprintf(out, "Interval: %s\n", pluginInterval(plugin, instance))
+	fmt.Fprintf(out, "Timeout:  %s\n", pluginTimeout(plugin, instance))
+
+	// the agent installs the dependencies in the background, wait for them
+	if plugin.HasDependencies {
+		dir, err := setupPluginDependencies(plugin)
+		if err != nil {
+			fmt.Fprintf(out, "Cannot install the dependencies. Error: %s\n", err)
+			return 1
+		}
+		fmt.Fprintf(out, "Dependencies: %s\n", dir)
+	}
+
+	reporter := &printingReporter{out: out, metrics: make(map[string]bool)}
+	// don't use nor overwrite the rates of the running agent
+	pluginRates = NewPluginRates("")
+
+	if plugin.Mode == PLUGIN_MODE_STREAMING {
+		testStreamingPlugin(plugin, instance, *runs, reporter)
+	} else {
+		for i := 0; i < *runs; i++ {
+			if i > 0 {
+				time.Sleep(*interval)
+			}
+			fmt.Fprintf(out, "\nRun %d:\n", i+1)
+			testPluginRun(plugin, instance, reporter)
+		}
+	}
+
+	problems = append(problems, validateBasicStats(plugin, info, reporter.metrics)...)
+
+	fmt.Fprintf(out, "\n")
+	if len(problems) == 0 {
+		fmt.Fprintf(out, "No problems found\n")
+		return 0
+	}
+	fmt.Fprintf(out, "Problems:\n")
+	for _, problem := range problems {
+		fmt.Fprintf(out, "  - %s\n", problem)
+	}
+	return 1
+}
+
+// load the plugin and validate its info.yml, problems are things that
+// wouldn't prevent the agent from running the plugin but are probably
+// mistakes
+func loadPluginToTest(nameOrPath string) (*PluginMetadata, *PluginInformation, []string, error) {
+	problems := make([]string, 0)
+
+	if _, err := os.Stat(nameOrPath); os.IsNotExist(err) {
+		builtins := getBuiltinPlugins()
+		if plugin, ok := builtins[nameOrPath]; ok {
+			return plugin, &PluginInformation{}, problems, nil
+		}
+		return nil, nil, nil, err
+	}
+
+	dir := path.Clean(nameOrPath)
+	plugin, err := parsePluginInfo(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	infoContent, err := ioutil.ReadFile(path.Join(dir, "info.yml"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info := &PluginInformation{}
+	if err := goyaml.Unmarshal(infoContent, info); err != nil {
+		return nil, nil, nil, err
+	}
+
+	supported := false
+	for _, outputType := range PLUGIN_OUTPUT_TYPES {
+		supported = supported || outputType == plugin.Output
+	}
+	if !supported {
+		problems = append(problems, fmt.Sprintf("output '%s' isn't supported, supported types are %s", plugin.Output, strings.Join(PLUGIN_OUTPUT_TYPES, ", ")))
+	}
+
+	for _, rate := range plugin.CalculateRates {
+		if _, err := regexp.Compile(rate); err != nil {
+			problems = append(problems, fmt.Sprintf("calculate-rates regex '%s' is invalid. Error: %s", rate, err))
+		}
+	}
+
+	for idx, stat := range info.BasicStats {
+		if stat.Name == "" || stat.Metric == "" {
+			problems = append(problems, fmt.Sprintf("basic-stats entry %d must have a name and a metric", idx+1))
+		}
+	}
+
+	for idx, argument := range info.Arguments {
+		if argument.Name == "" {
+			problems = append(problems, fmt.Sprintf("arguments entry %d must have a name", idx+1))
+		}
+	}
+
+	scripts := []string{"status", "should_monitor"}
+	if plugin.HasDependencies {
+		scripts = append(scripts, "setup")
+	}
+	for _, script := range scripts {
+		stat, err := os.Stat(path.Join(dir, script))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is missing", script))
+			continue
+		}
+		if stat.Mode()&0111 == 0 {
+			problems = append(problems, fmt.Sprintf("%s isn't executable", script))
+		}
+	}
+
+	return plugin, info, problems, nil
+}
+
+func validateInstanceArgs(info *PluginInformation, instance *Instance) []string {
+	problems := make([]string, 0)
+	if len(info.Arguments) == 0 {
+		return problems
+	}
+
+	declared := make(map[string]bool)
+	for _, argument := range info.Arguments {
+		declared[argument.Name] = true
+	}
+	for name := range instance.Args {
+		if !declared[name] {
+			problems = append(problems, fmt.Sprintf("argument '%s' isn't declared in info.yml", name))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// the basic stats are shown on the UI, they should be reported by the plugin
+func validateBasicStats(plugin *PluginMetadata, info *PluginInformation, reported map[string]bool) []string {
+	problems := make([]string, 0)
+	for _, stat := range info.BasicStats {
+		if stat.Metric == "" {
+			continue
+		}
+		metric := fmt.Sprintf("plugins.%s.%s", plugin.Name, stat.Metric)
+		if !reported[metric] && !reported[stat.Metric] {
+			problems = append(problems, fmt.Sprintf("basic stat '%s' uses metric %s which wasn't reported", stat.Name, stat.Metric))
+		}
+	}
+	return problems
+}
+
+func testPluginRun(plugin *PluginMetadata, instance *Instance, reporter *printingReporter) {
+	var run *PluginRun
+	var output *PluginOutput
+	if plugin.IsBuiltin {
+		run, output = executeBuiltinPlugin(plugin, instance)
+	} else {
+		run, output = executePlugin(plugin, instance)
+	}
+
+	out := reporter.out
+	if !plugin.IsBuiltin {
+		fmt.Fprintf(out, "  exit status: %d\n", run.ExitStatus)
+		fmt.Fprintf(out, "  duration:    %s\n", run.Duration)
+		fmt.Fprintf(out, "  stdout:\n%s\n", indent(run.Stdout, "    "))
+		if run.Stderr != "" {
+			fmt.Fprintf(out, "  stderr:\n%s\n", indent(run.Stderr, "    "))
+		}
+	}
+	if run.Error != "" {
+		fmt.Fprintf(out, "  error:       %s\n", run.Error)
+	}
+	if output == nil {
+		fmt.Fprintf(out, "  nothing would be reported\n")
+		return
+	}
+	printPluginOutput(plugin, instance, output, run.Context(), reporter)
+}
+
+func testStreamingPlugin(plugin *PluginMetadata, instance *Instance, lines int, reporter *printingReporter) {
+	out := reporter.out
+	cmd, err := pluginCommand(plugin, instance)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot run plugin. Error: %s\n", err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Fprintf(out, "Cannot run plugin. Error: %s\n", err)
+		return
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(out, "Cannot run plugin. Error: %s\n", err)
+		return
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	scanner := bufio.NewScanner(stdout)
+	for i := 0; i < lines && scanner.Scan(); i++ {
+		line := scanner.Text()
+		fmt.Fprintf(out, "\nLine %d: %s\n", i+1, line)
+		output, err := parseStreamingLine(plugin, line)
+		if err != nil {
+			fmt.Fprintf(out, "  cannot parse output. Error: %s\n", err)
+			continue
+		}
+		printPluginOutput(plugin, instance, output, "", reporter)
+	}
+}
+
+func printPluginOutput(plugin *PluginMetadata, instance *Instance, output *PluginOutput, context string, reporter *printingReporter) {
+	out := reporter.out
+	fmt.Fprintf(out, "  state:       %s\n", output.state.String())
+	fmt.Fprintf(out, "  message:     %s\n", output.msg)
+	if output.longOutput != "" {
+		fmt.Fprintf(out, "  long output:\n%s\n", indent(output.longOutput, "    "))
+	}
+	fmt.Fprintf(out, "  reported metrics:\n")
+	reportPluginOutput(reporter, plugin, instance, output, context)
+}
+
+func indent(text, prefix string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for idx, line := range lines {
+		lines[idx] = prefix + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// prints the metrics instead of sending them to errplane
+type printingReporter struct {
+	out     io.Writer
+	metrics map[string]bool
+}
+
+func (self *printingReporter) Report(metric string, value float64, timestamp time.Time, context string, dimensions errplane.Dimensions) error {
+	self.metrics[metric] = true
+	fmt.Fprintf(self.out, "    %s %v %s\n", metric, value, formatDimensions(dimensions))
+	if context != "" {
+		fmt.Fprintf(self.out, "      context:\n%s\n", indent(context, "        "))
+	}
+	return nil
+}
+
+func (self *printingReporter) SendHttp(data *errplane.WriteOperation) error {
+	for _, write := range data.Writes {
+		self.metrics[write.Name] = true
+		for _, point := range write.Points {
+			fmt.Fprintf(self.out, "    %s %v %s\n", write.Name, point.Value, formatDimensions(point.Dimensions))
+		}
+	}
+	return nil
+}
+
+func formatDimensions(dimensions errplane.Dimensions) string {
+	keys := make([]string, 0, len(dimensions))
+	for key := range dimensions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	formatted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		formatted = append(formatted, fmt.Sprintf("%s=%q", key, dimensions[key]))
+	}
+	return "{" + strings.Join(formatted, ", ") + "}"
+}
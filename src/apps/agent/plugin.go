@@ -6,8 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/errplane/errplane-go"
-	"github.com/pmylund/go-cache"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
@@ -56,23 +54,31 @@ const (
 )
 
 var (
-	DEFAULT_INSTANCE  = &Instance{"default", nil, nil}
-	DEFAULT_INSTANCES = []*Instance{&Instance{"", nil, nil}}
-	OutputCache       = cache.New(0, 0)
+	DEFAULT_INSTANCE  = &Instance{Name: "default"}
+	DEFAULT_INSTANCES = []*Instance{&Instance{Name: ""}}
+	pluginsDetector   Detector
 )
 
 type PluginOutput struct {
-	state     PluginStateOutput
-	msg       string
-	points    []*errplane.JsonPoints
-	metrics   map[string]float64
-	timestamp time.Time
+	state      PluginStateOutput
+	msg        string
+	longOutput string
+	points     []*errplane.JsonPoints
+	metrics    map[string]float64
+	thresholds map[string]float64
+	timestamp  time.Time
 }
 
 // handles running plugins
 func monitorPlugins(ep *errplane.Errplane) {
 	var previousConfig *AgentConfiguration
 	var plugins map[string]*PluginMetadata
+	var scheduledInstances map[*PluginMetadata][]*Instance
+	var streamingInstances map[*PluginMetadata][]*Instance
+
+	scheduler := NewPluginScheduler(ep)
+	go scheduler.Run()
+	supervisor := NewStreamingPluginSupervisor(ep)
 
 	for {
 		config, err := GetPluginsToRun()
@@ -82,192 +88,306 @@ func monitorPlugins(ep *errplane.Errplane) {
 				goto sleep
 			}
 			config = previousConfig
+		} else {
+			updateMaintenanceWindows(config)
 		}
+		previousConfig = config
 
 		log.Debug("Iterating through %d plugins", len(config.Plugins))
 
 		// get the list of plugins that should be turned from the config service
 		plugins = getAvailablePlugins()
 
-		for name, instances := range config.Plugins {
-			plugin, ok := plugins[name]
-			if !ok {
-				log.Error("Cannot find plugin '%s'. Error: %s", name, err)
-				continue
-			}
+		scheduledInstances, streamingInstances = pluginInstancesToRun(config, plugins)
+		scheduler.Update(scheduledInstances)
+		supervisor.Update(streamingInstances)
 
-			if len(instances) == 0 {
-				instances = DEFAULT_INSTANCES
-			}
+	sleep:
+		time.Sleep(AgentConfig.Sleep)
+	}
+}
 
-			for _, instance := range instances {
-				go runPlugin(ep, instance, plugin)
-			}
+// split the instances of the enabled plugins, and of the detected plugins
+// if auto-discover-plugins is on, into scheduled and streaming instances
+func pluginInstancesToRun(config *AgentConfiguration, plugins map[string]*PluginMetadata) (scheduled, streaming map[*PluginMetadata][]*Instance) {
+	scheduled = make(map[*PluginMetadata][]*Instance)
+	streaming = make(map[*PluginMetadata][]*Instance)
+
+	add := func(plugin *PluginMetadata, instances []*Instance) {
+		if len(instances) == 0 {
+			instances = DEFAULT_INSTANCES
 		}
 
-	sleep:
-		time.Sleep(AgentConfig.Sleep)
+		if plugin.Mode == PLUGIN_MODE_STREAMING {
+			streaming[plugin] = instances
+		} else {
+			scheduled[plugin] = instances
+		}
+	}
+
+	for name, instances := range config.Plugins {
+		plugin, ok := plugins[name]
+		if !ok {
+			log.Error("Cannot find plugin '%s'", name)
+			continue
+		}
+		add(plugin, instances)
 	}
+
+	if !AgentConfig.AutoDiscoverPlugins {
+		return
+	}
+
+	// plugins enabled from the backend take precedence over the discovered ones
+	for name, plugin := range plugins {
+		if _, ok := config.Plugins[name]; ok {
+			continue
+		}
+		detection := detectPlugin(plugin)
+		if !detection.Available {
+			continue
+		}
+		log.Debug("Running discovered plugin %s with %d instances", name, len(detection.Instances))
+		add(plugin, detection.Instances)
+	}
+	return
 }
 
-func runPlugin(ep *errplane.Errplane, instance *Instance, plugin *PluginMetadata) {
+// returns the command that runs the status script of the plugin with
+// the instance arguments
+func pluginCommand(plugin *PluginMetadata, instance *Instance) (*exec.Cmd, error) {
 	args := instance.ArgsList
 	for name, value := range instance.Args {
 		args = append(args, "--"+name, value)
 	}
 	log.Debug("Running command %s %s", path.Join(plugin.Path, "status"), strings.Join(args, " "))
 	cmdPath := path.Join(plugin.Path, "status")
-	cmd := exec.Command(cmdPath, args...)
+	cmd, err := sandboxCommand(plugin.Name, plugin.Path, cmdPath, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if plugin.HasDependencies {
+		dir, err := setupPluginDependencies(plugin)
+		if err != nil {
+			return nil, err
+		}
+		setDependenciesEnv(cmd, dir)
+	}
+	return cmd, nil
+}
+
+// the destination of the plugin metrics, *errplane.Errplane in the agent
+type PluginReporter interface {
+	Reporter
+	SendHttp(data *errplane.WriteOperation) error
+}
+
+func runPlugin(ep PluginReporter, instance *Instance, plugin *PluginMetadata) {
+	var run *PluginRun
+	var output *PluginOutput
+	if plugin.IsBuiltin {
+		run, output = executeBuiltinPlugin(plugin, instance)
+	} else {
+		run, output = executePlugin(plugin, instance)
+	}
+	recordPluginRun(run)
+
+	if output != nil {
+		reportPluginOutput(ep, plugin, instance, output, run.Context())
+	}
+}
+
+// run the status script of the plugin and parse its output, the output
+// is nil if there's nothing to report
+func executePlugin(plugin *PluginMetadata, instance *Instance) (*PluginRun, *PluginOutput) {
+	cmdPath := path.Join(plugin.Path, "status")
+	run := &PluginRun{Plugin: plugin.Name, Instance: instance.Name, Timestamp: time.Now()}
+
+	// don't wait for the dependencies to be installed, the setup runs in
+	// the background. Nothing is reported in the meantime, the plugin
+	// monitors would alert on every install
+	if plugin.HasDependencies {
+		if err := pluginDependenciesReady(plugin); err != nil {
+			log.Info("Not running plugin %s. %s", cmdPath, err)
+			run.Error = err.Error()
+			return run, nil
+		}
+	}
 
-	stdout, err := cmd.StdoutPipe()
+	cmd, err := pluginCommand(plugin, instance)
 	if err != nil {
-		log.Error("Cannot run plugin %s. Error: %s", cmd, err)
-		return
+		log.Error("Cannot run plugin %s. Error: %s", cmdPath, err)
+		run.Error = err.Error()
+		return run, &PluginOutput{state: UNKNOWN, msg: err.Error(), timestamp: time.Now()}
 	}
 
+	stdout := NewBoundedBuffer(pluginMaxOutput(plugin))
+	stderr := NewBoundedBuffer(PLUGIN_MAX_STDERR)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
 	if err := cmd.Start(); err != nil {
 		log.Error("Cannot run plugin %s. Error: %s", cmdPath, err)
-		return
+		run.Error = err.Error()
+		return run, nil
 	}
 
-	ch := make(chan error)
-	go killPlugin(cmdPath, cmd, ch)
+	// buffered, killPlugin doesn't read from the channel after killing the plugin
+	ch := make(chan error, 1)
+	go killPlugin(cmdPath, cmd, pluginTimeout(plugin, instance), ch)
+
+	err = cmd.Wait()
+	ch <- err
 
-	output, err := ioutil.ReadAll(stdout)
+	run.Duration = time.Now().Sub(run.Timestamp).String()
+	run.ExitStatus = (&ProcessStateWrapper{cmd.ProcessState}).ExitStatus()
+	run.Stdout = stdout.String()
+	run.Stderr = stderr.String()
 	if err != nil {
-		log.Error("Error while reading output from plugin %s. Error: %s", cmdPath, err)
-		ch <- err
-		return
+		run.Error = err.Error()
 	}
 
-	lines := strings.Split(string(output), "\n")
+	if stderr.buffer.Len() > 0 {
+		log.Debug("stderr of plugin %s is %s", cmdPath, run.Stderr)
+	}
 
-	err = cmd.Wait()
-	ch <- err
+	if !cmd.ProcessState.Exited() {
+		log.Error("Plugin %s didn't exit normally. Error: %s", cmdPath, err)
+		msg := fmt.Sprintf("Plugin didn't exit normally. Error: %s", err)
+		return run, &PluginOutput{state: UNKNOWN, msg: msg, timestamp: time.Now()}
+	}
 
-	if len(lines) > 0 {
-		log.Debug("output of plugin %s is %s", cmdPath, lines[0])
-		firstLine := lines[0]
-		output, err := parsePluginOutput(plugin, &ProcessStateWrapper{cmd.ProcessState}, firstLine)
-		if err != nil {
-			log.Error("Cannot parse plugin %s output. Output: %s. Error: %s", cmdPath, firstLine, err)
-			return
-		}
+	firstLine := strings.Split(run.Stdout, "\n")[0]
+	log.Debug("output of plugin %s is %s", cmdPath, firstLine)
+	output, err := parsePluginOutput(plugin, &ProcessStateWrapper{cmd.ProcessState}, run.Stdout)
+	if err != nil {
+		log.Error("Cannot parse plugin %s output. Output: %s. Error: %s", cmdPath, firstLine, err)
+		run.Error = fmt.Sprintf("Cannot parse output. Error: %s", err)
+		return run, nil
+	}
 
-		log.Debug("parsed output is %#v", output)
+	log.Debug("parsed output is %#v", output)
+	return run, output
+}
 
-		// status are printed to plugins.<plugin-name>.status with a value of 1 and dimension status that is either ok, warning, critical or unknown
-		// other metrics are written to plugins.<plugin-name>.<metric-name> with the given value
-		// all metrics have the host name as a dimension
+func reportPluginOutput(ep PluginReporter, plugin *PluginMetadata, instance *Instance, output *PluginOutput, context string) {
+	// status are printed to plugins.<plugin-name>.status with a value of 1 and dimension status that is either ok, warning, critical or unknown
+	// other metrics are written to plugins.<plugin-name>.<metric-name> with the given value
+	// all metrics have the host name as a dimension
 
-		dimensions := errplane.Dimensions{
-			"host":       AgentConfig.Hostname,
-			"status":     output.state.String(),
-			"status_msg": output.msg,
-		}
-		if instance.Name != "" {
-			dimensions["instance"] = instance.Name
-		}
+	dimensions := errplane.Dimensions{
+		"host":       AgentConfig.Hostname,
+		"status":     output.state.String(),
+		"status_msg": output.msg,
+	}
+	if instance.Name != "" {
+		dimensions["instance"] = instance.Name
+	}
 
-		report(ep, fmt.Sprintf("plugins.%s.status", plugin.Name), 1.0, time.Now(), dimensions, nil)
-
-		// create a map from metric name to current value
-		currentValues := make(map[string]float64)
-		log.Debug("Calculating the rates for plugin %s %v", plugin.Name, plugin.CalculateRates)
-
-		// process the errplane output
-		if output.points != nil {
-			// add the plugins.<plugin-name>.<instance-name> to the metric names
-			// if the instance name isn't empty add it to the dimensions
-			for _, write := range output.points {
-				for _, metric := range plugin.CalculateRates {
-					ok, err := regexp.MatchString(metric, write.Name)
-					if err != nil {
-						log.Error("Invalid regex %s. Error: %s", metric, err)
-						continue
-					}
-					if ok && len(write.Points) > 0 {
-						currentValues[write.Name] = write.Points[0].Value
-					}
-				}
+	statusMetric := fmt.Sprintf("plugins.%s.status", plugin.Name)
+	reportWithContext(ep, statusMetric, 1.0, time.Now(), context, dimensions)
+	if pluginsDetector != nil {
+		// let the plugin monitors alert on the status of the plugin
+		pluginsDetector.Report(statusMetric, 1.0, context, dimensions)
+	}
 
-				write.Name = fmt.Sprintf("plugins.%s.%s", plugin.Name, write.Name)
-				if instance.Name != "" {
-					for _, point := range write.Points {
-						point.Dimensions["instance"] = instance.Name
-					}
-				}
-			}
+	metricDimensions := errplane.Dimensions{"host": AgentConfig.Hostname}
+	if instance.Name != "" {
+		metricDimensions["instance"] = instance.Name
+	}
 
-			ep.SendHttp(&errplane.WriteOperation{Writes: output.points})
-		}
+	// create a map from metric name to current value
+	currentValues := make(map[string]float64)
+	log.Debug("Calculating the rates for plugin %s %v", plugin.Name, plugin.CalculateRates)
+
+	// process the errplane output
+	if output.points != nil {
+		// add the plugins.<plugin-name>.<instance-name> to the metric names
+		// if the instance name isn't empty add it to the dimensions
+		for _, write := range output.points {
+			if len(write.Points) > 0 && pluginRates.ShouldCalculateRate(plugin, write.Name) {
+				currentValues[write.Name] = write.Points[0].Value
+			}
 
-		// process nagios output
-		if output.metrics != nil {
-			dimensions := errplane.Dimensions{"host": AgentConfig.Hostname}
+			write.Name = fmt.Sprintf("plugins.%s.%s", plugin.Name, write.Name)
 			if instance.Name != "" {
-				dimensions["instance"] = instance.Name
-			}
-			for name, value := range output.metrics {
-				for _, metric := range plugin.CalculateRates {
-					ok, err := regexp.MatchString(metric, name)
-					if err != nil {
-						log.Error("Invalid regex %s. Error: %s", metric, err)
-						continue
+				for _, point := range write.Points {
+					if point.Dimensions == nil {
+						point.Dimensions = errplane.Dimensions{}
 					}
-					if ok {
-						currentValues[name] = value
-					}
-
+					point.Dimensions["instance"] = instance.Name
 				}
-				report(ep, fmt.Sprintf("plugins.%s.%s", plugin.Name, name), value, time.Now(), dimensions, nil)
 			}
 		}
 
-		log.Debug("Current values: %v", currentValues)
-
-		// calculate the rate of change
-		cacheKey := fmt.Sprintf("%s/%s", plugin.Name, instance.Name)
-		_previousOutput, ok := OutputCache.Get(cacheKey)
-		defer OutputCache.Set(cacheKey, output, -1)
-		log.Debug("Previous output for %s is %v", plugin.Name, _previousOutput)
-		if !ok {
-			return
-		}
+		ep.SendHttp(&errplane.WriteOperation{Writes: output.points})
+	}
 
-		previousOutput := _previousOutput.(*PluginOutput)
-		timeDiff := output.timestamp.Sub(previousOutput.timestamp).Seconds()
-		for name, value := range previousOutput.metrics {
-			currentValue, ok := currentValues[name]
-			if !ok {
-				continue
+	// process nagios output
+	if output.metrics != nil {
+		for name, value := range output.metrics {
+			if pluginRates.ShouldCalculateRate(plugin, name) {
+				currentValues[name] = value
 			}
+			report(ep, fmt.Sprintf("plugins.%s.%s", plugin.Name, name), value, time.Now(), metricDimensions, nil)
+		}
 
-			diff := currentValue - value
-			diff = diff / timeDiff
-			report(ep, fmt.Sprintf("plugins.%s.%s.rate", plugin.Name, name), diff, time.Now(), dimensions, nil)
+		// thresholds are reported as plugins.<plugin-name>.<metric-name>.<warn|crit|min|max>
+		for name, value := range output.thresholds {
+			report(ep, fmt.Sprintf("plugins.%s.%s", plugin.Name, name), value, time.Now(), metricDimensions, nil)
 		}
 	}
+
+	log.Debug("Current values: %v", currentValues)
+
+	// calculate the rate of change
+	rates := pluginRates.Update(fmt.Sprintf("%s/%s", plugin.Name, instance.Name), output.timestamp, currentValues)
+	for name, rate := range rates {
+		report(ep, fmt.Sprintf("plugins.%s.%s.rate", plugin.Name, name), rate, time.Now(), metricDimensions, nil)
+	}
 }
 
-func parsePluginOutput(plugin *PluginMetadata, cmdState ProcessState, firstLine string) (*PluginOutput, error) {
+func parsePluginOutput(plugin *PluginMetadata, cmdState ProcessState, output string) (*PluginOutput, error) {
 	outputType := plugin.Output
 	switch outputType {
 	case "nagios":
-		return parseNagiosOutput(cmdState, firstLine)
+		return parseNagiosOutput(cmdState, output)
 	case "errplane":
-		return parseErrplaneOutput(cmdState, firstLine)
+		return parseErrplaneOutput(cmdState, strings.Split(output, "\n")[0])
+	case "json":
+		return parseJsonOutput(cmdState, output)
+	case "graphite":
+		return parseGraphiteOutput(cmdState, output)
+	case "influxdb":
+		return parseInfluxOutput(cmdState, output)
 	default:
-		return nil, fmt.Errorf("Unknown plugin output type '%s', supported types are 'errplane' and 'nagios'", outputType)
+		return nil, fmt.Errorf("Unknown plugin output type '%s', supported types are 'errplane', 'nagios', 'json', 'graphite' and 'influxdb'", outputType)
 	}
 }
 
-func parseErrplaneOutput(cmdState ProcessState, firstLine string) (*PluginOutput, error) {
+// the state of the plugin given by its exit status, any exit status
+// other than ok, warning, critical or unknown is treated as unknown like
+// nagios does
+func pluginState(cmdState ProcessState) PluginStateOutput {
 	exitStatus := cmdState.ExitStatus()
+	if exitStatus < int(OK) || exitStatus > int(UNKNOWN) {
+		return UNKNOWN
+	}
+	return PluginStateOutput(exitStatus)
+}
+
+func parseErrplaneOutput(cmdState ProcessState, firstLine string) (*PluginOutput, error) {
+	state := pluginState(cmdState)
 	firstLine = strings.TrimSpace(firstLine)
-	statusAndMetrics := strings.Split(firstLine, "|")
+	statusAndMetrics := strings.SplitN(firstLine, "|", 2)
 	status := strings.TrimSpace(statusAndMetrics[0])
 	writes := make([]*errplane.JsonPoints, 0)
+
+	if len(statusAndMetrics) == 1 {
+		return &PluginOutput{state: state, msg: status, timestamp: time.Now()}, nil
+	}
+
 	metric := strings.TrimSpace(statusAndMetrics[1])
 
 	err := json.Unmarshal([]byte(metric), &writes)
@@ -275,11 +395,26 @@ func parseErrplaneOutput(cmdState ProcessState, firstLine string) (*PluginOutput
 		return nil, err
 	}
 
-	return &PluginOutput{PluginStateOutput(exitStatus), status, writes, nil, time.Now()}, nil
+	return &PluginOutput{state: state, msg: status, points: writes, timestamp: time.Now()}, nil
 }
 
-func parseNagiosOutput(cmdState ProcessState, firstLine string) (*PluginOutput, error) {
-	firstLine = strings.TrimSpace(firstLine)
+// parse the output of a nagios plugin, the first line has the status
+// message and optionally the performance data, the following lines are
+// the long output
+// (http://nagios.sourceforge.net/docs/3_0/pluginapi.html)
+func parseNagiosOutput(cmdState ProcessState, output string) (*PluginOutput, error) {
+	lines := strings.SplitN(strings.TrimSpace(output), "\n", 2)
+	firstLine := strings.TrimSpace(lines[0])
+	longOutput := ""
+	longPerfData := ""
+	if len(lines) == 2 {
+		// performance data can continue after a '|' in the long output
+		longOutputAndMetrics := strings.SplitN(lines[1], "|", 2)
+		longOutput = strings.TrimSpace(longOutputAndMetrics[0])
+		if len(longOutputAndMetrics) == 2 {
+			longPerfData = strings.Replace(longOutputAndMetrics[1], "\n", " ", -1)
+		}
+	}
 
 	statusAndMetrics := strings.Split(firstLine, "|")
 	switch len(statusAndMetrics) {
@@ -288,14 +423,18 @@ func parseNagiosOutput(cmdState ProcessState, firstLine string) (*PluginOutput,
 		return nil, fmt.Errorf("First line format doesn't match what the agent expects. See the docs for more details")
 	}
 
-	exitStatus := cmdState.ExitStatus()
+	exitState := pluginState(cmdState)
 	status := strings.TrimSpace(statusAndMetrics[0])
 
-	if len(statusAndMetrics) == 1 {
-		return &PluginOutput{PluginStateOutput(exitStatus), status, nil, nil, time.Now()}, nil
+	metricsLine := longPerfData
+	if len(statusAndMetrics) == 2 {
+		metricsLine = statusAndMetrics[1] + " " + metricsLine
 	}
+	metricsLine = strings.TrimSpace(metricsLine)
 
-	metricsLine := strings.TrimSpace(statusAndMetrics[1])
+	if metricsLine == "" {
+		return &PluginOutput{state: exitState, msg: status, longOutput: longOutput, timestamp: time.Now()}, nil
+	}
 
 	type ParserState int
 	const (
@@ -366,56 +505,123 @@ func parseNagiosOutput(cmdState ProcessState, firstLine string) (*PluginOutput,
 	metrics[metricName] = value + token.String()
 
 	metricsMap := make(map[string]float64)
+	thresholdsMap := make(map[string]float64)
 
 	for key, value := range metrics {
-		value = strings.Split(strings.TrimSpace(value), ";")[0]
-		if len(value) == 0 {
+		// 'label'=value[UOM];[warn];[crit];[min];[max]
+		fields := strings.Split(strings.TrimSpace(value), ";")
+		if len(fields[0]) == 0 {
 			continue // empty value, don't bother
 		}
 
-		uom := value[len(value)-1]
-		switch uom {
-		case 's':
-			switch value[len(value)-2] {
-			case 'u', 'm':
-				value = value[0 : len(value)-2]
-			default:
-				value = value[0 : len(value)-1]
+		value, uom, err := parsePerfDataValue(fields[0])
+		if err != nil {
+			log.Debug("Cannot parse the value of metric %s into a float. Error: %s", key, err)
+			continue
+		}
+		scale, ok := NAGIOS_UOM_SCALE[uom]
+		if !ok {
+			log.Debug("Unknown unit of measurement '%s' for metric %s", uom, key)
+			continue
+		}
+		metricsMap[key] = value * scale
+
+		for idx, field := range fields[1:] {
+			if idx >= len(NAGIOS_PERF_DATA_FIELDS) {
+				break
 			}
-		case 'B':
-			switch value[len(value)-2] {
-			case 'K', 'M', 'G':
-				value = value[0 : len(value)-2]
-			default:
-				value = value[0 : len(value)-1]
+			for name, value := range parsePerfDataThreshold(NAGIOS_PERF_DATA_FIELDS[idx], field) {
+				thresholdsMap[key+"."+name] = value * scale
 			}
-		case '%', 'c':
-			value = value[0 : len(value)-1]
 		}
+	}
 
-		var err error
-		metricsMap[key], err = strconv.ParseFloat(value, 64)
-		if err != nil {
-			delete(metricsMap, key)
-			log.Debug("Cannot parse the value of metric %s into a float. Error: %s", key, err)
-		}
+	return &PluginOutput{
+		state:      exitState,
+		msg:        status,
+		longOutput: longOutput,
+		metrics:    metricsMap,
+		thresholds: thresholdsMap,
+		timestamp:  time.Now(),
+	}, nil
+}
+
+var (
+	NAGIOS_PERF_DATA_FIELDS = []string{"warn", "crit", "min", "max"}
+
+	// scale the supported units of measurement to base units, i.e.
+	// seconds and bytes
+	NAGIOS_UOM_SCALE = map[string]float64{
+		"":   1,
+		"%":  1,
+		"c":  1,
+		"s":  1,
+		"ms": 1e-3,
+		"us": 1e-6,
+		"B":  1,
+		"KB": 1 << 10,
+		"MB": 1 << 20,
+		"GB": 1 << 30,
+		"TB": 1 << 40,
+	}
+
+	perfDataValueRegex = regexp.MustCompile(`^([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)(.*)$`)
+)
+
+// split a performance data value into a number and a unit of measurement
+func parsePerfDataValue(value string) (float64, string, error) {
+	matches := perfDataValueRegex.FindStringSubmatch(strings.TrimSpace(value))
+	if matches == nil {
+		return 0, "", fmt.Errorf("'%s' isn't a number", value)
+	}
+	number, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, "", err
+	}
+	return number, matches[2], nil
+}
+
+// parse a threshold, min or max field. Thresholds can be ranges of the
+// form [@][start:]end, in which case the start is returned as
+// <name>_low and the end as <name>, see
+// https://nagios-plugins.org/doc/guidelines.html#THRESHOLDFORMAT
+func parsePerfDataThreshold(name, field string) map[string]float64 {
+	values := make(map[string]float64)
+	field = strings.TrimPrefix(strings.TrimSpace(field), "@")
+	if field == "" {
+		return values
+	}
+
+	start, end := "", field
+	if idx := strings.Index(field, ":"); idx != -1 {
+		start, end = field[:idx], field[idx+1:]
 	}
 
-	return &PluginOutput{PluginStateOutput(exitStatus), status, nil, metricsMap, time.Now()}, nil
+	if start != "" && start != "~" {
+		if value, err := strconv.ParseFloat(start, 64); err == nil {
+			values[name+"_low"] = value
+		}
+	}
+	if end != "" {
+		if value, err := strconv.ParseFloat(end, 64); err == nil {
+			values[name] = value
+		}
+	}
+	return values
 }
 
-func killPlugin(cmdPath string, cmd *exec.Cmd, ch chan error) {
+func killPlugin(cmdPath string, cmd *exec.Cmd, timeout time.Duration, ch chan error) {
 	select {
 	case err := <-ch:
 		if exitErr, ok := err.(*exec.ExitError); ok && !exitErr.Exited() {
 			log.Error("plugin %s didn't die gracefully. Killing it.", cmdPath)
 			cmd.Process.Kill()
 		}
-	case <-time.After(AgentConfig.Sleep):
+	case <-time.After(timeout):
 		err := cmd.Process.Kill()
 		if err != nil {
 			log.Error("Cannot kill plugin %s. Error: %s", cmdPath, err)
 		}
-		log.Error("Plugin %s killed because it took more than %s to execute", cmdPath, AgentConfig.Sleep)
+		log.Error("Plugin %s killed because it took more than %s to execute", cmdPath, timeout)
 	}
 }
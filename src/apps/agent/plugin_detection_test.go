@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type PluginDetectionSuite struct {
+	dir     string
+	depsDir string
+}
+
+var _ = Suite(&PluginDetectionSuite{})
+
+func (self *PluginDetectionSuite) SetUpTest(c *C) {
+	self.dir = c.MkDir()
+	self.depsDir = pluginsDepsDir
+	pluginsDepsDir = c.MkDir()
+	detectionCache.Flush()
+	failedSetupsCache.Flush()
+}
+
+func (self *PluginDetectionSuite) TearDownTest(c *C) {
+	pluginsDepsDir = self.depsDir
+}
+
+func (self *PluginDetectionSuite) writeScript(c *C, name, content string) {
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, name), []byte("#!/usr/bin/env bash\n"+content), 0755), IsNil)
+}
+
+func (self *PluginDetectionSuite) TestShouldMonitorReason(c *C) {
+	plugin := &PluginMetadata{Name: "foo", Path: self.dir}
+
+	self.writeScript(c, "should_monitor", "echo x >> "+self.dir+"/runs\necho found foo at /usr/bin/foo\n")
+	c.Assert(detectPlugin(plugin), DeepEquals, &PluginDetection{Available: true, Reason: "found foo at /usr/bin/foo"})
+
+	// the result is cached
+	c.Assert(detectPlugin(plugin).Available, Equals, true)
+	runs, err := ioutil.ReadFile(path.Join(self.dir, "runs"))
+	c.Assert(err, IsNil)
+	c.Assert(string(runs), Equals, "x\n")
+
+	// until should_monitor changes
+	self.writeScript(c, "should_monitor", "exit 1\n")
+	c.Assert(os.Chtimes(path.Join(self.dir, "should_monitor"), time.Now(), time.Now().Add(time.Second)), IsNil)
+	c.Assert(detectPlugin(plugin), DeepEquals, &PluginDetection{Available: false, Reason: "exit status 1"})
+
+	// or the plugin version changes
+	self.writeScript(c, "should_monitor", "echo x >> "+self.dir+"/runs\necho found foo at /usr/bin/foo\n")
+	c.Assert(os.Chtimes(path.Join(self.dir, "should_monitor"), time.Now(), time.Now().Add(time.Second)), IsNil)
+	c.Assert(detectPlugin(plugin).Available, Equals, true)
+	self.writeScript(c, "should_monitor", "exit 1\n")
+	c.Assert(os.Chtimes(path.Join(self.dir, "should_monitor"), time.Now(), time.Now().Add(time.Second)), IsNil)
+	plugin.Verion = "1.1"
+	c.Assert(detectPlugin(plugin).Available, Equals, false)
+
+	detectionCache.Flush()
+	self.writeScript(c, "should_monitor", "echo foo is not installed\nexit 1\n")
+	c.Assert(detectPlugin(plugin), DeepEquals, &PluginDetection{Available: false, Reason: "foo is not installed"})
+}
+
+func (self *PluginDetectionSuite) TestShouldMonitorDiscoversInstances(c *C) {
+	plugin := &PluginMetadata{Name: "foo", Path: self.dir}
+
+	self.writeScript(c, "should_monitor", `echo '[{"name": "3306", "args": {"port": "3306"}}, {"name": "3307", "args": {"port": "3307"}}]'`)
+	c.Assert(detectPlugin(plugin), DeepEquals, &PluginDetection{
+		Available: true,
+		Reason:    "discovered 2 instances",
+		Instances: []*Instance{
+			&Instance{Name: "3306", Args: map[string]string{"port": "3306"}},
+			&Instance{Name: "3307", Args: map[string]string{"port": "3307"}},
+		},
+	})
+
+	detectionCache.Flush()
+	self.writeScript(c, "should_monitor", `echo '{"reason": "found mysqld", "instances": [{"name": "default"}]}'`)
+	c.Assert(detectPlugin(plugin), DeepEquals, &PluginDetection{
+		Available: true,
+		Reason:    "found mysqld",
+		Instances: []*Instance{&Instance{Name: "default"}},
+	})
+}
+
+func (self *PluginDetectionSuite) TestShouldMonitorInvalidInstances(c *C) {
+	plugin := &PluginMetadata{Name: "foo", Path: self.dir}
+
+	for _, output := range []string{`[{"args": {"port": "3306"}}]`, `[{"name": "a"}, {"name": "a"}]`, `{"instances": `} {
+		detectionCache.Flush()
+		self.writeScript(c, "should_monitor", "echo '"+output+"'")
+		c.Assert(detectPlugin(plugin).Available, Equals, false)
+	}
+}
+
+func (self *PluginDetectionSuite) TestAutoDiscoverPlugins(c *C) {
+	enabled := &PluginMetadata{Name: "enabled", Path: self.dir}
+	discovered := &PluginMetadata{Name: "foo", Path: self.dir}
+	plugins := map[string]*PluginMetadata{"enabled": enabled, "foo": discovered}
+	config := &AgentConfiguration{Plugins: map[string][]*Instance{"enabled": nil}}
+	self.writeScript(c, "should_monitor", `echo '[{"name": "3306", "args": {"port": "3306"}}]'`)
+
+	defer func(autoDiscover bool) { AgentConfig.AutoDiscoverPlugins = autoDiscover }(AgentConfig.AutoDiscoverPlugins)
+
+	AgentConfig.AutoDiscoverPlugins = false
+	scheduled, streaming := pluginInstancesToRun(config, plugins)
+	c.Assert(scheduled, DeepEquals, map[*PluginMetadata][]*Instance{enabled: DEFAULT_INSTANCES})
+	c.Assert(streaming, HasLen, 0)
+
+	AgentConfig.AutoDiscoverPlugins = true
+	scheduled, _ = pluginInstancesToRun(config, plugins)
+	c.Assert(scheduled, DeepEquals, map[*PluginMetadata][]*Instance{
+		enabled:    DEFAULT_INSTANCES,
+		discovered: []*Instance{&Instance{Name: "3306", Args: map[string]string{"port": "3306"}}},
+	})
+}
+
+func (self *PluginDetectionSuite) TestBuiltinDetection(c *C) {
+	detection := detectPlugin(&PluginMetadata{Name: "fake", IsBuiltin: true})
+	c.Assert(detection.Available, Equals, false)
+}
+
+func (self *PluginDetectionSuite) TestDependenciesSetup(c *C) {
+	plugin := &PluginMetadata{Name: "foo", Verion: "1.0", Path: self.dir, HasDependencies: true}
+	self.writeScript(c, "setup", "mkdir $1/bin && echo 'echo bar' > $1/bin/foo-dep && chmod +x $1/bin/foo-dep && echo x >> "+self.dir+"/setup-runs\n")
+	self.writeScript(c, "status", "echo \"OK: $(foo-dep) $ERRPLANE_PLUGIN_DEPENDENCIES\"\n")
+
+	for i := 0; i < 2; i++ {
+		cmd, err := pluginCommand(plugin, DEFAULT_INSTANCE)
+		c.Assert(err, IsNil)
+		output, err := cmd.Output()
+		c.Assert(err, IsNil)
+		dir, _ := pluginDependenciesDir(plugin)
+		c.Assert(strings.TrimSpace(string(output)), Equals, "OK: bar "+dir)
+	}
+
+	// setup runs once per version
+	runs, err := ioutil.ReadFile(path.Join(self.dir, "setup-runs"))
+	c.Assert(err, IsNil)
+	c.Assert(string(runs), Equals, "x\n")
+
+	// a new version is set up again and the old dependencies are removed
+	oldDir, _ := pluginDependenciesDir(plugin)
+	plugin.Verion = "1.1"
+	_, err = pluginCommand(plugin, DEFAULT_INSTANCE)
+	c.Assert(err, IsNil)
+	runs, _ = ioutil.ReadFile(path.Join(self.dir, "setup-runs"))
+	c.Assert(string(runs), Equals, "x\nx\n")
+	_, err = os.Stat(oldDir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (self *PluginDetectionSuite) TestFailedDependenciesSetup(c *C) {
+	plugin := &PluginMetadata{Name: "foo", Path: self.dir, HasDependencies: true}
+	self.writeScript(c, "setup", "echo x >> "+self.dir+"/setup-runs\necho cannot download foo-dep\nexit 1\n")
+
+	_, err := pluginCommand(plugin, DEFAULT_INSTANCE)
+	c.Assert(err, ErrorMatches, ".*cannot download foo-dep")
+
+	// failures aren't retried right away
+	_, err = pluginCommand(plugin, DEFAULT_INSTANCE)
+	c.Assert(err, ErrorMatches, ".*cannot download foo-dep")
+	runs, _ := ioutil.ReadFile(path.Join(self.dir, "setup-runs"))
+	c.Assert(string(runs), Equals, "x\n")
+
+	// unless the setup script changes
+	self.writeScript(c, "setup", "exit 0\n")
+	_, err = pluginCommand(plugin, DEFAULT_INSTANCE)
+	c.Assert(err, IsNil)
+}
+
+func (self *PluginDetectionSuite) TestDependenciesSetupInTheBackground(c *C) {
+	plugin := &PluginMetadata{Name: "foo", Output: "nagios", Path: self.dir, HasDependencies: true}
+	self.writeScript(c, "setup", "echo x >> "+self.dir+"/setup-runs\nsleep 0.5\n")
+	self.writeScript(c, "status", "echo \"OK: $ERRPLANE_PLUGIN_DEPENDENCIES\"\n")
+
+	// the default timeout depends on the agent sleep
+	instance := &Instance{Name: "default", Timeout: "1s"}
+
+	// the plugin isn't run until the setup is done
+	run, output := executePlugin(plugin, instance)
+	c.Assert(run.Error, Equals, "The dependencies of plugin foo are being installed")
+	c.Assert(output, IsNil)
+	run, _ = executePlugin(plugin, instance)
+	c.Assert(run.Error, Equals, "The dependencies of plugin foo are being installed")
+
+	dir, _ := pluginDependenciesDir(plugin)
+	for i := 0; i < 50 && !dependenciesInstalled(dir); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	run, output = executePlugin(plugin, instance)
+	c.Assert(run.Error, Equals, "")
+	c.Assert(output.msg, Equals, "OK: "+dir)
+
+	// the setup ran once
+	runs, _ := ioutil.ReadFile(path.Join(self.dir, "setup-runs"))
+	c.Assert(string(runs), Equals, "x\n")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"path"
+	"time"
+	. "utils"
+)
+
+type PluginRatesSuite struct{}
+
+var _ = Suite(&PluginRatesSuite{})
+
+func (self *PluginRatesSuite) TestRates(c *C) {
+	rates := NewPluginRates("")
+	now := time.Now()
+
+	c.Assert(rates.Update("foo/", now, map[string]float64{"requests": 100}), HasLen, 0)
+	c.Assert(rates.Update("foo/", now.Add(10*time.Second), map[string]float64{"requests": 150}), DeepEquals, map[string]float64{"requests": 5})
+
+	// the counter was reset
+	c.Assert(rates.Update("foo/", now.Add(20*time.Second), map[string]float64{"requests": 20}), DeepEquals, map[string]float64{"requests": 2})
+
+	// the previous sample is too old
+	c.Assert(rates.Update("foo/", now.Add(2*time.Hour), map[string]float64{"requests": 30}), HasLen, 0)
+
+	// instances don't share their samples
+	c.Assert(rates.Update("foo/bar", now.Add(2*time.Hour+time.Second), map[string]float64{"requests": 40}), HasLen, 0)
+}
+
+func (self *PluginRatesSuite) TestPersistingRates(c *C) {
+	file := path.Join(c.MkDir(), "state", PLUGIN_RATES_FILE)
+	now := time.Now()
+
+	rates := NewPluginRates(file)
+	rates.Update("foo/", now.Add(-10*time.Second), map[string]float64{"requests": 100})
+	_, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+
+	// the agent restarted
+	rates = NewPluginRates(file)
+	c.Assert(rates.Update("foo/", now, map[string]float64{"requests": 200}), DeepEquals, map[string]float64{"requests": 10})
+}
+
+func (self *PluginRatesSuite) TestCalculateRatesRegexes(c *C) {
+	rates := NewPluginRates("")
+	plugin := &PluginMetadata{Name: "foo", Verion: "1", CalculateRates: []string{"^requests$", "(", "errors"}}
+
+	c.Assert(rates.ShouldCalculateRate(plugin, "requests"), Equals, true)
+	c.Assert(rates.ShouldCalculateRate(plugin, "http.errors"), Equals, true)
+	c.Assert(rates.ShouldCalculateRate(plugin, "requests.total"), Equals, false)
+	c.Assert(rates.regexes, HasLen, 1)
+	c.Assert(rates.regexes["foo/1/"], HasLen, 2)
+
+	// a new version of the plugin
+	plugin = &PluginMetadata{Name: "foo", Verion: "2", CalculateRates: []string{"total"}}
+	c.Assert(rates.ShouldCalculateRate(plugin, "requests.total"), Equals, true)
+	c.Assert(rates.regexes, HasLen, 2)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+	. "utils"
+)
+
+type PluginSandboxSuite struct {
+	dir     string
+	sandbox PluginSandbox
+}
+
+var _ = Suite(&PluginSandboxSuite{})
+
+func (self *PluginSandboxSuite) SetUpTest(c *C) {
+	self.sandbox = AgentConfig.PluginsSandbox
+	// the plugin must be accessible by the nobody user
+	var err error
+	self.dir, err = ioutil.TempDir("", "plugin-sandbox")
+	c.Assert(err, IsNil)
+	c.Assert(os.Chmod(self.dir, 0755), IsNil)
+	script := "#!/usr/bin/env bash\necho \"$(id -u) $(pwd) $(ulimit -n) $(ulimit -t) $FOO $SECRET\"\n"
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "status"), []byte(script), 0755), IsNil)
+}
+
+func (self *PluginSandboxSuite) TearDownTest(c *C) {
+	AgentConfig.PluginsSandbox = self.sandbox
+	os.RemoveAll(self.dir)
+}
+
+func (self *PluginSandboxSuite) run(c *C, name string) []string {
+	cmd, err := pluginCommand(&PluginMetadata{Name: name, Path: self.dir}, DEFAULT_INSTANCE)
+	c.Assert(err, IsNil)
+	output, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("output: %s", output))
+	return strings.Fields(string(output))
+}
+
+func (self *PluginSandboxSuite) TestSanitizedEnvironment(c *C) {
+	os.Setenv("SECRET", "password")
+	defer os.Unsetenv("SECRET")
+
+	AgentConfig.PluginsSandbox = PluginSandbox{Environment: map[string]string{"FOO": "bar"}}
+	fields := self.run(c, "foo")
+	c.Assert(fields, HasLen, 5)
+	c.Assert(fields[1], Equals, self.dir)
+	c.Assert(fields[4], Equals, "bar")
+}
+
+func (self *PluginSandboxSuite) TestResourceLimits(c *C) {
+	AgentConfig.PluginsSandbox = PluginSandbox{
+		MaxOpenFiles: 64,
+		Plugins: map[string]*PluginSandbox{
+			"foo": &PluginSandbox{MaxCpuTime: 1500 * time.Millisecond, WorkingDirectory: "/"},
+		},
+	}
+
+	fields := self.run(c, "foo")
+	c.Assert(fields, HasLen, 4)
+	c.Assert(fields[1], Equals, "/")
+	c.Assert(fields[2], Equals, "64")
+	c.Assert(fields[3], Equals, "2")
+
+	fields = self.run(c, "bar")
+	c.Assert(fields[1], Equals, self.dir)
+	c.Assert(fields[2], Equals, "64")
+	c.Assert(fields[3], Equals, "unlimited")
+}
+
+func (self *PluginSandboxSuite) TestRunAsUser(c *C) {
+	nobody, err := user.Lookup("nobody")
+	if os.Getuid() != 0 || err != nil {
+		c.Skip("running plugins as another user requires root and the nobody user")
+	}
+
+	AgentConfig.PluginsSandbox = PluginSandbox{User: "nobody", MaxOpenFiles: 32}
+	fields := self.run(c, "foo")
+	c.Assert(fields[0], Equals, nobody.Uid)
+	c.Assert(fields[2], Equals, "32")
+
+	AgentConfig.PluginsSandbox = PluginSandbox{User: "nobody"}
+	fields = self.run(c, "foo")
+	c.Assert(fields[0], Equals, nobody.Uid)
+}
+
+func (self *PluginSandboxSuite) TestMaxOutput(c *C) {
+	AgentConfig.PluginsSandbox = PluginSandbox{Plugins: map[string]*PluginSandbox{"foo": &PluginSandbox{MaxOutput: 10}}}
+	c.Assert(pluginMaxOutput(&PluginMetadata{Name: "foo"}), Equals, 10)
+	c.Assert(pluginMaxOutput(&PluginMetadata{Name: "bar"}), Equals, PLUGIN_MAX_STDOUT)
+}
+
+func (self *PluginSandboxSuite) TestUnknownUser(c *C) {
+	AgentConfig.PluginsSandbox = PluginSandbox{User: "no-such-user-errplane"}
+	_, err := pluginCommand(&PluginMetadata{Name: "foo", Path: self.dir}, DEFAULT_INSTANCE)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/errplane/errplane-go"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	. "utils"
+)
+
+type StreamingPluginSuite struct {
+	reporter *pluginReporterMock
+	plugin   *PluginMetadata
+}
+
+var _ = Suite(&StreamingPluginSuite{})
+
+type pluginReporterMock struct {
+	ReporterMock
+}
+
+func (self *pluginReporterMock) SendHttp(data *errplane.WriteOperation) error {
+	return nil
+}
+
+func (self *pluginReporterMock) statuses() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	statuses := make([]string, 0)
+	for _, event := range self.events {
+		if event.metric == "plugins.streaming.status" {
+			statuses = append(statuses, event.dimensions["status"]+" "+event.dimensions["status_msg"])
+		}
+	}
+	return statuses
+}
+
+func (self *StreamingPluginSuite) SetUpTest(c *C) {
+	self.reporter = &pluginReporterMock{}
+	self.plugin = &PluginMetadata{Name: "streaming", Output: "nagios", Mode: PLUGIN_MODE_STREAMING, Path: c.MkDir()}
+}
+
+// the plugin appends its pid to the starts file every time it starts and
+// prints the given lines
+func (self *StreamingPluginSuite) writePlugin(c *C, script string) {
+	content := "#!/bin/sh\necho $$ >> starts\n" + script
+	c.Assert(ioutil.WriteFile(path.Join(self.plugin.Path, "status"), []byte(content), 0755), IsNil)
+}
+
+func (self *StreamingPluginSuite) starts(c *C) []int {
+	content, err := ioutil.ReadFile(path.Join(self.plugin.Path, "starts"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	c.Assert(err, IsNil)
+	pids := make([]int, 0)
+	for _, line := range strings.Fields(string(content)) {
+		pid, err := strconv.Atoi(line)
+		c.Assert(err, IsNil)
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+func (self *StreamingPluginSuite) waitForStarts(c *C, count int) []int {
+	for i := 0; i < 50 && len(self.starts(c)) < count; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	starts := self.starts(c)
+	c.Assert(starts, HasLen, count)
+	return starts
+}
+
+func isRunning(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+func (self *StreamingPluginSuite) TestStatePerLine(c *C) {
+	output, err := parseStreamingLine(self.plugin, "critical\tdisk is full|usage=99")
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, CRITICAL)
+	c.Assert(output.msg, Equals, "disk is full")
+	c.Assert(output.metrics, DeepEquals, map[string]float64{"usage": 99})
+
+	output, err = parseStreamingLine(self.plugin, "WARNING\tdisk is almost full")
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, WARNING)
+
+	output, err = parseStreamingLine(self.plugin, "disk is fine\tthanks")
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, OK)
+	c.Assert(output.msg, Equals, "disk is fine\tthanks")
+}
+
+func (self *StreamingPluginSuite) TestRestartOnExit(c *C) {
+	self.writePlugin(c, "printf 'ok\\tstarted\\n'\nprintf 'critical\\tfailed\\n'\n")
+	supervisor := NewStreamingPluginSupervisor(self.reporter)
+	defer supervisor.Update(nil)
+
+	supervisor.Update(map[*PluginMetadata][]*Instance{self.plugin: []*Instance{DEFAULT_INSTANCE}})
+	self.waitForStarts(c, 2)
+
+	statuses := self.reporter.statuses()
+	c.Assert(len(statuses) >= 3, Equals, true)
+	c.Assert(statuses[0], Equals, "ok started")
+	c.Assert(statuses[1], Equals, "critical failed")
+	c.Assert(statuses[2], Matches, "unknown Plugin exited.*")
+}
+
+func (self *StreamingPluginSuite) TestStopAndUpdate(c *C) {
+	self.writePlugin(c, "printf 'ok\\tstarted %s\\n' \"$2\"\nexec sleep 100\n")
+	supervisor := NewStreamingPluginSupervisor(self.reporter)
+	defer supervisor.Update(nil)
+
+	instance := &Instance{Name: "default", Args: map[string]string{"port": "6379"}}
+	supervisor.Update(map[*PluginMetadata][]*Instance{self.plugin: []*Instance{instance}})
+	first := self.waitForStarts(c, 1)[0]
+	c.Assert(isRunning(first), Equals, true)
+
+	// an equal configuration leaves the plugin running
+	unchanged := &Instance{Name: "default", Args: map[string]string{"port": "6379"}}
+	supervisor.Update(map[*PluginMetadata][]*Instance{self.plugin: []*Instance{unchanged}})
+	time.Sleep(200 * time.Millisecond)
+	c.Assert(self.starts(c), HasLen, 1)
+
+	// changing the arguments restarts the plugin
+	changed := &Instance{Name: "default", Args: map[string]string{"port": "6380"}}
+	supervisor.Update(map[*PluginMetadata][]*Instance{self.plugin: []*Instance{changed}})
+	second := self.waitForStarts(c, 2)[1]
+	c.Assert(isRunning(second), Equals, true)
+	for i := 0; i < 50 && isRunning(first); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(isRunning(first), Equals, false)
+
+	// removing the instance stops the plugin
+	supervisor.Update(nil)
+	for i := 0; i < 50 && isRunning(second); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(isRunning(second), Equals, false)
+	c.Assert(self.reporter.statuses(), DeepEquals, []string{"ok started 6379", "ok started 6380"})
+}
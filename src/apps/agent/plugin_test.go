@@ -1,11 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"math"
 	"os"
 	"path"
 	"testing"
+	"time"
+	. "utils"
 )
 
 // Hook up gocheck into the gotest runner.
@@ -44,6 +48,53 @@ calculate-rates:
 	c.Assert(plugin.CalculateRates, HasLen, 5)
 }
 
+func (self *AgentSuite) TestPluginIntervalAndTimeout(c *C) {
+	content := `version: 1.0
+output: nagios
+interval: 5m
+timeout: 30s
+`
+	dir := path.Join(os.TempDir(), "foobar")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte(content), 0644), IsNil)
+	plugin, err := parsePluginInfo(dir)
+	c.Assert(err, IsNil)
+	c.Assert(plugin.Verion, Equals, "1.0")
+	c.Assert(pluginInterval(plugin, &Instance{}), Equals, 5*time.Minute)
+	c.Assert(pluginTimeout(plugin, &Instance{}), Equals, 30*time.Second)
+
+	instance := &Instance{Interval: "10s", Timeout: "5s"}
+	c.Assert(pluginInterval(plugin, instance), Equals, 10*time.Second)
+	c.Assert(pluginTimeout(plugin, instance), Equals, 5*time.Second)
+
+	plugin.Interval, plugin.Timeout = 0, 0
+	c.Assert(pluginInterval(plugin, &Instance{}), Equals, AgentConfig.Sleep)
+	c.Assert(pluginTimeout(plugin, &Instance{}), Equals, AgentConfig.Sleep)
+
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: nagios\ninterval: 0s\n"), 0644), IsNil)
+	_, err = parsePluginInfo(dir)
+	c.Assert(err, ErrorMatches, "Invalid interval '0s'. Error: The duration must be positive")
+}
+
+func (self *AgentSuite) TestPluginModeParsing(c *C) {
+	dir := path.Join(os.TempDir(), "foobar")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: graphite\n"), 0644), IsNil)
+	plugin, err := parsePluginInfo(dir)
+	c.Assert(err, IsNil)
+	c.Assert(plugin.Mode, Equals, PLUGIN_MODE_ONESHOT)
+
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: graphite\nmode: streaming\n"), 0644), IsNil)
+	plugin, err = parsePluginInfo(dir)
+	c.Assert(err, IsNil)
+	c.Assert(plugin.Mode, Equals, PLUGIN_MODE_STREAMING)
+
+	c.Assert(ioutil.WriteFile(path.Join(dir, "info.yml"), []byte("output: graphite\nmode: daemon\n"), 0644), IsNil)
+	_, err = parsePluginInfo(dir)
+	c.Assert(err, NotNil)
+}
+
 func (self *AgentSuite) TestNagiosOutputParsing(c *C) {
 	msg := "Warning: process not responding"
 	output, err := parseNagiosOutput(&FakeProcessState{1}, msg)
@@ -90,3 +141,368 @@ func (self *AgentSuite) TestNagiosOutputParsing(c *C) {
 	c.Assert(output.metrics["total_connections_received"], Equals, 1728.0)
 	c.Assert(output.metrics["lru_clock"], Equals, 1231438.0)
 }
+
+func (self *AgentSuite) TestNagiosLongOutputParsing(c *C) {
+	msg := `Warning: 2 of 3 disks are almost full|'sda'=90%
+/dev/sda is 90% full
+/dev/sdb is 95% full
+`
+	output, err := parseNagiosOutput(&FakeProcessState{1}, msg)
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, WARNING)
+	c.Assert(output.msg, Equals, "Warning: 2 of 3 disks are almost full")
+	c.Assert(output.longOutput, Equals, "/dev/sda is 90% full\n/dev/sdb is 95% full")
+	c.Assert(output.metrics["sda"], Equals, 90.0)
+}
+
+func (self *AgentSuite) TestPluginRunContext(c *C) {
+	stderr := NewBoundedBuffer(10)
+	stderr.Write([]byte("warning: "))
+	stderr.Write([]byte("deprecated option"))
+
+	run := &PluginRun{
+		Stdout: "Ok: all good\nsome details",
+		Stderr: stderr.String(),
+	}
+	c.Assert(run.Context(), Equals, "some details\nstderr:\nwarning: d\n[truncated]")
+}
+
+func (self *AgentSuite) TestNagiosPerfDataParsing(c *C) {
+	type testCase struct {
+		exitCode   int
+		output     string
+		state      PluginStateOutput
+		msg        string
+		longOutput string
+		metrics    map[string]float64
+		thresholds map[string]float64
+	}
+
+	for _, test := range []testCase{
+		{
+			// check_load -w 15,10,5 -c 30,25,20
+			0,
+			"OK - load average: 0.08, 0.12, 0.09|load1=0.080;15.000;30.000;0; load5=0.120;10.000;25.000;0; load15=0.090;5.000;20.000;0;",
+			OK,
+			"OK - load average: 0.08, 0.12, 0.09",
+			"",
+			map[string]float64{"load1": 0.08, "load5": 0.12, "load15": 0.09},
+			map[string]float64{
+				"load1.warn": 15, "load1.crit": 30, "load1.min": 0,
+				"load5.warn": 10, "load5.crit": 25, "load5.min": 0,
+				"load15.warn": 5, "load15.crit": 20, "load15.min": 0,
+			},
+		},
+		{
+			// check_disk -w 20% -c 10% -p /
+			1,
+			"DISK WARNING - free space: / 3326 MB (18% inode=86%);| /=14807MB;15127;17018;0;18909",
+			WARNING,
+			"DISK WARNING - free space: / 3326 MB (18% inode=86%);",
+			"",
+			map[string]float64{"/": 14807 * 1024 * 1024},
+			map[string]float64{
+				"/.warn": 15127 * 1024 * 1024,
+				"/.crit": 17018 * 1024 * 1024,
+				"/.min":  0,
+				"/.max":  18909 * 1024 * 1024,
+			},
+		},
+		{
+			// check_http -H localhost
+			0,
+			"HTTP OK: HTTP/1.1 200 OK - 2167 bytes in 0.002 second response time |time=0.002081s;;;0.000000 size=2167B;;;0",
+			OK,
+			"HTTP OK: HTTP/1.1 200 OK - 2167 bytes in 0.002 second response time",
+			"",
+			map[string]float64{"time": 0.002081, "size": 2167},
+			map[string]float64{"time.min": 0, "size.min": 0},
+		},
+		{
+			// check_ping -H localhost -w 100,20% -c 500,60%
+			0,
+			"PING OK - Packet loss = 0%, RTA = 0.05 ms|rta=0.049000ms;100.000000;500.000000;0.000000 pl=0%;20;60;0",
+			OK,
+			"PING OK - Packet loss = 0%, RTA = 0.05 ms",
+			"",
+			map[string]float64{"rta": 0.000049, "pl": 0},
+			map[string]float64{
+				"rta.warn": 0.1, "rta.crit": 0.5, "rta.min": 0,
+				"pl.warn": 20, "pl.crit": 60, "pl.min": 0,
+			},
+		},
+		{
+			// check_swap -w 50% -c 20%
+			2,
+			"SWAP CRITICAL - 10% free (102 MB out of 1023 MB) |swap=102MB;511;204;0;1023",
+			CRITICAL,
+			"SWAP CRITICAL - 10% free (102 MB out of 1023 MB)",
+			"",
+			map[string]float64{"swap": 102 * 1024 * 1024},
+			map[string]float64{
+				"swap.warn": 511 * 1024 * 1024,
+				"swap.crit": 204 * 1024 * 1024,
+				"swap.min":  0,
+				"swap.max":  1023 * 1024 * 1024,
+			},
+		},
+		{
+			// check_procs with a range threshold
+			0,
+			"PROCS OK: 3 processes with command name 'nginx' | procs=3;1:5;@0:0;0;",
+			OK,
+			"PROCS OK: 3 processes with command name 'nginx'",
+			"",
+			map[string]float64{"procs": 3},
+			map[string]float64{
+				"procs.warn_low": 1, "procs.warn": 5,
+				"procs.crit_low": 0, "procs.crit": 0,
+				"procs.min": 0,
+			},
+		},
+		{
+			// multi-line output from the nagios plugin api documentation
+			0,
+			`DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968
+/ 15272 MB (77%);
+/boot 68 MB (69%);
+/home 69357 MB (27%);
+/var/log 819 MB (84%); | /boot=68MB;88;93;0;98
+/home=69357MB;253404;253409;0;253414
+/var/log=818MB;970;975;0;980`,
+			OK,
+			"DISK OK - free space: / 3326 MB (56%);",
+			"/ 15272 MB (77%);\n/boot 68 MB (69%);\n/home 69357 MB (27%);\n/var/log 819 MB (84%);",
+			map[string]float64{
+				"/":        2643 * 1024 * 1024,
+				"/boot":    68 * 1024 * 1024,
+				"/home":    69357 * 1024 * 1024,
+				"/var/log": 818 * 1024 * 1024,
+			},
+			nil,
+		},
+		{
+			// check_mysql with counters and unknown units
+			0,
+			"Uptime: 1880  Threads: 1  Questions: 17  Slow queries: 0 | Connections=12c;;; Open_files=38 Version=5.5.31-0ubuntu0.12.04.1 buffer=16KB uptime=1880s latency=300us",
+			OK,
+			"Uptime: 1880  Threads: 1  Questions: 17  Slow queries: 0",
+			"",
+			map[string]float64{"Connections": 12, "Open_files": 38, "buffer": 16 * 1024, "uptime": 1880, "latency": 0.0003},
+			map[string]float64{},
+		},
+		{
+			// exit codes other than 0-3 are unknown
+			127,
+			"/usr/lib/nagios/plugins/check_foo: not found",
+			UNKNOWN,
+			"/usr/lib/nagios/plugins/check_foo: not found",
+			"",
+			nil,
+			nil,
+		},
+	} {
+		output, err := parseNagiosOutput(&FakeProcessState{test.exitCode}, test.output)
+		c.Assert(err, IsNil)
+		c.Assert(output.state, Equals, test.state)
+		c.Assert(output.msg, Equals, test.msg)
+		c.Assert(output.longOutput, Equals, test.longOutput)
+		c.Assert(output.metrics, HasLen, len(test.metrics))
+		for name, value := range test.metrics {
+			c.Assert(math.Abs(output.metrics[name]-value) <= 1e-9*math.Abs(value), Equals, true, Commentf("%s in %s", name, test.output))
+		}
+		if test.thresholds != nil {
+			c.Assert(output.thresholds, HasLen, len(test.thresholds))
+			for name, value := range test.thresholds {
+				threshold, ok := output.thresholds[name]
+				c.Assert(ok, Equals, true, Commentf("%s in %s", name, test.output))
+				c.Assert(math.Abs(threshold-value) <= 1e-9*math.Abs(value), Equals, true, Commentf("%s in %s", name, test.output))
+			}
+		}
+	}
+}
+
+func (self *AgentSuite) TestErrplaneOutputWithoutMetrics(c *C) {
+	output, err := parseErrplaneOutput(&FakeProcessState{2}, "Critical: cannot connect")
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, CRITICAL)
+	c.Assert(output.msg, Equals, "Critical: cannot connect")
+	c.Assert(output.points, HasLen, 0)
+}
+
+func (self *AgentSuite) TestJsonOutputParsing(c *C) {
+	output, err := parseJsonOutput(&FakeProcessState{0}, `{"connections": 10, "version": "1.2", "up": true, "memory": {"used": 100, "free": 2.5}}`)
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, OK)
+	c.Assert(output.metrics, DeepEquals, map[string]float64{
+		"connections": 10,
+		"up":          1,
+		"memory.used": 100,
+		"memory.free": 2.5,
+	})
+
+	_, err = parseJsonOutput(&FakeProcessState{0}, `connections=10`)
+	c.Assert(err, NotNil)
+}
+
+func (self *AgentSuite) TestGraphiteOutputParsing(c *C) {
+	output, err := parseGraphiteOutput(&FakeProcessState{0}, `servers.web1.requests 120 1375122876
+servers.web1.latency 0.25 1375122876
+servers.web1.requests 130 1375122886
+`)
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, OK)
+	c.Assert(output.points, HasLen, 2)
+	c.Assert(output.points[0].Name, Equals, "servers.web1.requests")
+	c.Assert(output.points[0].Points, HasLen, 2)
+	c.Assert(output.points[0].Points[1].Value, Equals, 130.0)
+	c.Assert(output.points[0].Points[1].Time, Equals, int64(1375122886))
+	c.Assert(output.points[1].Name, Equals, "servers.web1.latency")
+	c.Assert(output.points[1].Points[0].Value, Equals, 0.25)
+
+	_, err = parseGraphiteOutput(&FakeProcessState{0}, "servers.web1.requests lots")
+	c.Assert(err, NotNil)
+}
+
+func (self *AgentSuite) TestInfluxOutputParsing(c *C) {
+	output, err := parseInfluxOutput(&FakeProcessState{1}, `# comments are ignored
+cpu,host=server\ 01,region=us-west usage_idle=98.5,usage_user=1i,name="cpu0" 1375122876000000000
+disk_free value=442221834240i
+`)
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, WARNING)
+	c.Assert(output.points, HasLen, 3)
+	c.Assert(output.points[0].Name, Equals, "cpu.usage_idle")
+	c.Assert(output.points[0].Points[0].Value, Equals, 98.5)
+	c.Assert(output.points[0].Points[0].Time, Equals, int64(1375122876))
+	c.Assert(output.points[0].Points[0].Dimensions["host"], Equals, "server 01")
+	c.Assert(output.points[0].Points[0].Dimensions["region"], Equals, "us-west")
+	c.Assert(output.points[1].Name, Equals, "cpu.usage_user")
+	c.Assert(output.points[1].Points[0].Value, Equals, 1.0)
+	c.Assert(output.points[2].Name, Equals, "disk_free")
+	c.Assert(output.points[2].Points[0].Value, Equals, 442221834240.0)
+
+	_, err = parseInfluxOutput(&FakeProcessState{0}, "cpu")
+	c.Assert(err, NotNil)
+}
+
+// exit statuses other than 0 to 3, e.g. 127 for a missing interpreter,
+// are unknown
+func (self *AgentSuite) TestUnexpectedExitStatus(c *C) {
+	outputs := map[string]string{
+		"errplane": "all good",
+		"nagios":   "OK - all good",
+		"json":     `{"connections": 10}`,
+		"graphite": "servers.web1.requests 120 1375122876",
+		"influxdb": "disk_free value=442221834240i",
+	}
+	for format, output := range outputs {
+		parsed, err := parsePluginOutput(&PluginMetadata{Output: format}, &FakeProcessState{5}, output)
+		c.Assert(err, IsNil, Commentf("%s", format))
+		c.Assert(parsed.state, Equals, UNKNOWN, Commentf("%s", format))
+		c.Assert(parsed.state.String(), Equals, "unknown")
+	}
+}
+
+type FakeBuiltinPlugin struct {
+	args   map[string]string
+	delay  time.Duration
+	closed chan bool
+}
+
+func (self *FakeBuiltinPlugin) Name() string { return "fake" }
+
+func (self *FakeBuiltinPlugin) Configure(args map[string]string) error {
+	if args["fail"] != "" {
+		return fmt.Errorf("bad configuration")
+	}
+	self.args = args
+	if delay := args["delay"]; delay != "" {
+		self.delay, _ = time.ParseDuration(delay)
+	}
+	return nil
+}
+
+func (self *FakeBuiltinPlugin) Close() {
+	if self.closed != nil {
+		close(self.closed)
+	}
+}
+
+func (self *FakeBuiltinPlugin) Collect() (*PluginOutput, error) {
+	time.Sleep(self.delay)
+	return &PluginOutput{state: OK, msg: "port " + self.args["port"], metrics: map[string]float64{"foo": 1}}, nil
+}
+
+func (self *AgentSuite) TestBuiltinPlugins(c *C) {
+	RegisterBuiltinPlugin(func() BuiltinPlugin { return &FakeBuiltinPlugin{} }, "foo")
+	defer unregisterBuiltinPlugin("fake")
+	plugin := getBuiltinPlugins()["fake"]
+	c.Assert(plugin, NotNil)
+	c.Assert(plugin.IsBuiltin, Equals, true)
+	c.Assert(plugin.CalculateRates, DeepEquals, []string{"foo"})
+
+	// the default timeout depends on the agent sleep
+	instance := &Instance{Name: "default", Args: map[string]string{"port": "6379"}, Timeout: "1s"}
+	output, err := collectBuiltinPlugin(plugin, instance)
+	c.Assert(err, IsNil)
+	c.Assert(output.msg, Equals, "port 6379")
+
+	// changing the arguments reconfigures the plugin
+	instance.Args = map[string]string{"port": "6380"}
+	output, err = collectBuiltinPlugin(plugin, instance)
+	c.Assert(err, IsNil)
+	c.Assert(output.msg, Equals, "port 6380")
+
+	instance.Args = map[string]string{"fail": "true"}
+	_, err = collectBuiltinPlugin(plugin, instance)
+	c.Assert(err, NotNil)
+
+	instance.Args = map[string]string{"delay": "1s"}
+	instance.Timeout = "10ms"
+	_, err = collectBuiltinPlugin(plugin, instance)
+	c.Assert(err, ErrorMatches, "Plugin took more than 10ms to collect")
+
+	// the collect that timed out is still running
+	_, err = collectBuiltinPlugin(plugin, instance)
+	c.Assert(err, ErrorMatches, "Plugin is still collecting")
+}
+
+func (self *AgentSuite) TestBuiltinPluginsWithoutBundle(c *C) {
+	if _, err := os.Stat(PLUGINS_DIR); err == nil {
+		c.Skip("a plugins bundle is installed")
+	}
+	defer func(service string) { AgentConfig.ConfigService = service }(AgentConfig.ConfigService)
+	// the config service is unreachable and no bundle is installed
+	AgentConfig.ConfigService = "127.0.0.1:1"
+
+	plugins := getAvailablePlugins()
+	c.Assert(plugins["port"], NotNil)
+	c.Assert(plugins["port"].IsBuiltin, Equals, true)
+	c.Assert(plugins["http"], NotNil)
+}
+
+func (self *AgentSuite) TestReplacedBuiltinPluginsAreClosed(c *C) {
+	RegisterBuiltinPlugin(func() BuiltinPlugin { return &FakeBuiltinPlugin{closed: make(chan bool)} })
+	defer unregisterBuiltinPlugin("fake")
+	plugin := getBuiltinPlugins()["fake"]
+
+	instance := &Instance{Name: "default", Args: map[string]string{"port": "6379", "delay": "100ms"}, Timeout: "1s"}
+	configured, err := getBuiltinInstance(plugin, instance)
+	c.Assert(err, IsNil)
+	previous := configured.plugin.(*FakeBuiltinPlugin)
+	started := time.Now()
+	go collectBuiltinPlugin(plugin, instance)
+	time.Sleep(10 * time.Millisecond)
+
+	// the previous plugin is closed once it's done collecting
+	reconfigured := &Instance{Name: "default", Args: map[string]string{"port": "6380"}, Timeout: "1s"}
+	_, err = collectBuiltinPlugin(plugin, reconfigured)
+	c.Assert(err, IsNil)
+	select {
+	case <-previous.closed:
+		c.Assert(time.Now().Sub(started) >= 100*time.Millisecond, Equals, true)
+	case <-time.After(time.Second):
+		c.Fatalf("the plugin wasn't closed")
+	}
+}
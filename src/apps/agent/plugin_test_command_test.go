@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"time"
+	. "utils"
+)
+
+type PluginTestCommandSuite struct {
+	dir     string
+	config  Config
+	depsDir string
+}
+
+var _ = Suite(&PluginTestCommandSuite{})
+
+const TEST_PLUGIN_INFO = `output: nagios
+calculate-rates:
+  - connections
+basic-stats:
+  - name: Connections
+    metric: connections
+    units: count
+  - name: Memory
+    metric: memory
+    units: bytes
+arguments:
+  - name: port
+    description: the port of the server
+    default_value: 1234
+`
+
+func (self *PluginTestCommandSuite) SetUpTest(c *C) {
+	self.config = AgentConfig
+	self.depsDir = pluginsDepsDir
+	pluginsDepsDir = c.MkDir()
+	// InitConfig fails, the plugins timeout defaults to the agent sleep
+	AgentConfig.Sleep = 10 * time.Second
+	self.dir = path.Join(c.MkDir(), "foo")
+	c.Assert(os.Mkdir(self.dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "info.yml"), []byte(TEST_PLUGIN_INFO), 0644), IsNil)
+	status := "#!/usr/bin/env bash\necho \"OK: listening on $2 | connections=5 memory=10B\"\n"
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "status"), []byte(status), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "should_monitor"), []byte("#!/usr/bin/env bash\n"), 0755), IsNil)
+}
+
+func (self *PluginTestCommandSuite) TearDownTest(c *C) {
+	AgentConfig = self.config
+	pluginsDepsDir = self.depsDir
+}
+
+func (self *PluginTestCommandSuite) TestRunningPlugin(c *C) {
+	out := bytes.NewBufferString("")
+	status := pluginSubcommand([]string{"test", "-config", "/non/existent", "-arg", "port=6379", "-runs", "2", "-interval", "10ms", self.dir}, out)
+	c.Assert(status, Equals, 0, Commentf("output: %s", out.String()))
+	c.Assert(out.String(), Matches, `(?s).*message:     OK: listening on 6379\n.*`)
+	c.Assert(out.String(), Matches, `(?s).*plugins.foo.status 1 \{host=".*", status="ok", status_msg="OK: listening on 6379"\}.*`)
+	c.Assert(out.String(), Matches, `(?s).*plugins.foo.connections 5 \{host=".*"\}.*`)
+	c.Assert(out.String(), Matches, `(?s).*plugins.foo.memory 10 \{host=".*"\}.*`)
+	c.Assert(out.String(), Matches, `(?s).*Run 2:.*plugins.foo.connections.rate 0 .*`)
+	c.Assert(out.String(), Matches, `(?s).*No problems found\n`)
+}
+
+func (self *PluginTestCommandSuite) TestPluginWithDependencies(c *C) {
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "info.yml"), []byte(TEST_PLUGIN_INFO+"needs-dependencies: true\n"), 0644), IsNil)
+	setup := "#!/usr/bin/env bash\nsleep 0.2\nmkdir $1/bin && printf '#!/bin/sh\\necho 6379\\n' > $1/bin/foo-port && chmod +x $1/bin/foo-port\n"
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "setup"), []byte(setup), 0755), IsNil)
+	status := "#!/usr/bin/env bash\necho \"OK: listening on $(foo-port) | connections=5 memory=10B\"\n"
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "status"), []byte(status), 0755), IsNil)
+
+	// the test waits for the dependencies instead of skipping the run
+	out := bytes.NewBufferString("")
+	exitStatus := pluginSubcommand([]string{"test", "-config", "/non/existent", self.dir}, out)
+	c.Assert(exitStatus, Equals, 0, Commentf("output: %s", out.String()))
+	c.Assert(out.String(), Matches, `(?s).*Dependencies: .*message:     OK: listening on 6379\n.*`)
+}
+
+func (self *PluginTestCommandSuite) TestReportingProblems(c *C) {
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "info.yml"), []byte(TEST_PLUGIN_INFO+"calculate-rates:\n  - (\n"), 0644), IsNil)
+	c.Assert(os.Chmod(path.Join(self.dir, "should_monitor"), 0644), IsNil)
+	status := "#!/usr/bin/env bash\necho 'OK: fine | connections=5'\n"
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, "status"), []byte(status), 0755), IsNil)
+
+	out := bytes.NewBufferString("")
+	c.Assert(pluginSubcommand([]string{"test", "-config", "/non/existent", "-arg", "host=localhost", self.dir}, out), Equals, 1)
+	c.Assert(out.String(), Matches, `(?s).*calculate-rates regex '\(' is invalid.*`)
+	c.Assert(out.String(), Matches, `(?s).*should_monitor isn't executable.*`)
+	c.Assert(out.String(), Matches, `(?s).*argument 'host' isn't declared in info.yml.*`)
+	c.Assert(out.String(), Matches, `(?s).*basic stat 'Memory' uses metric memory which wasn't reported.*`)
+}
+
+func (self *PluginTestCommandSuite) TestBuiltinPlugin(c *C) {
+	out := bytes.NewBufferString("")
+	pluginSubcommand([]string{"test", "-config", "/non/existent", "-arg", "port=1", "-arg", "timeout=100ms", "port"}, out)
+	c.Assert(out.String(), Matches, `(?s).*state:       critical.*plugins.port.status 1 .*`)
+}
+
+func (self *PluginTestCommandSuite) TestUsage(c *C) {
+	out := bytes.NewBufferString("")
+	c.Assert(pluginSubcommand([]string{}, out), Equals, 2)
+	c.Assert(pluginSubcommand([]string{"test"}, out), Equals, 2)
+	c.Assert(pluginSubcommand([]string{"test", "-config", "/non/existent", "/non/existent/plugin"}, out), Equals, 1)
+}
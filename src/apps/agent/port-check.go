@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// builtin port check, it connects to the given port and optionally
+// sends a payload and waits for a banner. It reports
+// plugins.port.<connect_time|response_time>
+//
+// Arguments:
+//   host:                  the host to connect to (default localhost)
+//   port:                  the port to connect to (required)
+//   protocol:              tcp or udp (default tcp)
+//   send:                  the payload sent after connecting, \r \n and \t are unescaped
+//   expect:                critical if the response doesn't contain this string
+//   timeout:               connection and read timeout (default 5s)
+//   connect-time-warning:  warning if connecting takes longer than this duration
+//   connect-time-critical: critical if connecting takes longer than this duration
+//
+// Connecting to a udp port doesn't send anything, udp checks require a
+// send payload. Udp services usually don't answer unknown payloads, a udp
+// check without expect is only critical if the port is unreachable.
+
+const (
+	PORT_DEFAULT_HOST     = "localhost"
+	PORT_DEFAULT_TIMEOUT  = 5 * time.Second
+	PORT_MAX_RESPONSE_LEN = 4096
+)
+
+var payloadUnescaper = strings.NewReplacer(`\r`, "\r", `\n`, "\n", `\t`, "\t", `\\`, `\`)
+
+func init() {
+	RegisterBuiltinPlugin(func() BuiltinPlugin { return &PortCheck{} })
+}
+
+type PortCheck struct {
+	protocol            string
+	address             string
+	send                string
+	expect              string
+	timeout             time.Duration
+	connectTimeWarning  time.Duration
+	connectTimeCritical time.Duration
+}
+
+func (self *PortCheck) Name() string {
+	return "port"
+}
+
+func (self *PortCheck) Configure(args map[string]string) error {
+	port := args["port"]
+	if port == "" {
+		return fmt.Errorf("The port check requires a port")
+	}
+	host := args["host"]
+	if host == "" {
+		host = PORT_DEFAULT_HOST
+	}
+	self.address = net.JoinHostPort(host, port)
+
+	self.protocol = strings.ToLower(args["protocol"])
+	switch self.protocol {
+	case "":
+		self.protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("Unsupported protocol '%s'", self.protocol)
+	}
+
+	self.send = payloadUnescaper.Replace(args["send"])
+	self.expect = payloadUnescaper.Replace(args["expect"])
+	if self.protocol == "udp" && self.send == "" {
+		// nothing would reach the port, the check would always be ok
+		return fmt.Errorf("The udp port check requires a send payload")
+	}
+
+	var err error
+	if self.timeout, err = parseDurationArg(args, "timeout", PORT_DEFAULT_TIMEOUT); err != nil {
+		return err
+	}
+	if self.connectTimeWarning, err = parseDurationArg(args, "connect-time-warning", 0); err != nil {
+		return err
+	}
+	if self.connectTimeCritical, err = parseDurationArg(args, "connect-time-critical", 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (self *PortCheck) Collect() (*PluginOutput, error) {
+	target := fmt.Sprintf("%s/%s", self.address, self.protocol)
+
+	started := time.Now()
+	conn, err := net.DialTimeout(self.protocol, self.address, self.timeout)
+	connectTime := time.Now().Sub(started)
+	if err != nil {
+		return &PluginOutput{
+			state:     CRITICAL,
+			msg:       fmt.Sprintf("Critical: cannot connect to %s. Error: %s", target, err),
+			timestamp: time.Now(),
+		}, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(self.timeout))
+
+	metrics := map[string]float64{"connect_time": connectTime.Seconds()}
+
+	if self.send != "" || self.expect != "" {
+		response, err := self.exchange(conn)
+		metrics["response_time"] = time.Now().Sub(started).Seconds()
+		if err != nil {
+			return &PluginOutput{
+				state:     CRITICAL,
+				msg:       fmt.Sprintf("Critical: no valid response from %s. Error: %s", target, err),
+				metrics:   metrics,
+				timestamp: time.Now(),
+			}, nil
+		}
+		if !strings.Contains(response, self.expect) {
+			return &PluginOutput{
+				state:      CRITICAL,
+				msg:        fmt.Sprintf("Critical: response from %s doesn't contain '%s'", target, self.expect),
+				longOutput: response,
+				metrics:    metrics,
+				timestamp:  time.Now(),
+			}, nil
+		}
+	}
+
+	state := OK
+	switch {
+	case self.connectTimeCritical > 0 && connectTime > self.connectTimeCritical:
+		state = CRITICAL
+	case self.connectTimeWarning > 0 && connectTime > self.connectTimeWarning:
+		state = WARNING
+	}
+
+	msg := fmt.Sprintf("%s: connected to %s in %s", stateLabel(state), target, connectTime)
+	return &PluginOutput{state: state, msg: msg, metrics: metrics, timestamp: time.Now()}, nil
+}
+
+// send the payload and read until the expected string is received, the
+// remote end closes the connection or the deadline is reached
+func (self *PortCheck) exchange(conn net.Conn) (string, error) {
+	if self.send != "" {
+		if _, err := conn.Write([]byte(self.send)); err != nil {
+			return "", err
+		}
+	}
+
+	if self.protocol == "udp" {
+		return self.readDatagram(conn)
+	}
+	if self.expect == "" {
+		return "", nil
+	}
+
+	response := make([]byte, 0, PORT_MAX_RESPONSE_LEN)
+	buffer := make([]byte, PORT_MAX_RESPONSE_LEN)
+	for len(response) < PORT_MAX_RESPONSE_LEN && !strings.Contains(string(response), self.expect) {
+		n, err := conn.Read(buffer[:PORT_MAX_RESPONSE_LEN-len(response)])
+		response = append(response, buffer[:n]...)
+		if err != nil {
+			return string(response), err
+		}
+	}
+	return string(response), nil
+}
+
+func (self *PortCheck) readDatagram(conn net.Conn) (string, error) {
+	buffer := make([]byte, PORT_MAX_RESPONSE_LEN)
+	n, err := conn.Read(buffer)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && self.expect == "" {
+		// an unanswered datagram isn't an error, an unreachable port is
+		err = nil
+	}
+	return string(buffer[:n]), err
+}
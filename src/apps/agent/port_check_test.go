@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	. "launchpad.net/gocheck"
+	"net"
+	"strings"
+)
+
+type PortCheckSuite struct{}
+
+var _ = Suite(&PortCheckSuite{})
+
+// a tcp server that sends a banner and answers PING with PONG
+func startBannerServer(c *C) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("220 ready\r\n"))
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.TrimSpace(line) == "PING" {
+						conn.Write([]byte("PONG\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func (self *PortCheckSuite) collect(c *C, args map[string]string) *PluginOutput {
+	check := &PortCheck{}
+	c.Assert(check.Configure(args), IsNil)
+	output, err := check.Collect()
+	c.Assert(err, IsNil)
+	return output
+}
+
+func (self *PortCheckSuite) TestTcpConnect(c *C) {
+	listener := startBannerServer(c)
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	output := self.collect(c, map[string]string{"host": host, "port": port})
+	c.Assert(output.state, Equals, OK)
+	_, ok := output.metrics["connect_time"]
+	c.Assert(ok, Equals, true)
+	_, ok = output.metrics["response_time"]
+	c.Assert(ok, Equals, false)
+
+	output = self.collect(c, map[string]string{"host": host, "port": port, "expect": "220 ready"})
+	c.Assert(output.state, Equals, OK)
+
+	output = self.collect(c, map[string]string{"host": host, "port": port, "send": `PING\r\n`, "expect": "PONG"})
+	c.Assert(output.state, Equals, OK)
+	_, ok = output.metrics["response_time"]
+	c.Assert(ok, Equals, true)
+
+	output = self.collect(c, map[string]string{"host": host, "port": port, "send": `QUIT\r\n`, "expect": "PONG", "timeout": "100ms"})
+	c.Assert(output.state, Equals, CRITICAL)
+}
+
+func (self *PortCheckSuite) TestClosedTcpPort(c *C) {
+	listener := startBannerServer(c)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	output := self.collect(c, map[string]string{"host": host, "port": port})
+	c.Assert(output.state, Equals, CRITICAL)
+	c.Assert(output.metrics, IsNil)
+}
+
+func (self *PortCheckSuite) TestUdp(c *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte("echo: "), buffer[:n]...), addr)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	output := self.collect(c, map[string]string{"host": host, "port": port, "protocol": "udp", "send": "hello", "expect": "echo: hello"})
+	c.Assert(output.state, Equals, OK)
+
+	output = self.collect(c, map[string]string{"host": host, "port": port, "protocol": "udp", "send": "hello", "expect": "bye"})
+	c.Assert(output.state, Equals, CRITICAL)
+}
+
+func (self *PortCheckSuite) TestInvalidArguments(c *C) {
+	check := &PortCheck{}
+	c.Assert(check.Configure(map[string]string{}), NotNil)
+	c.Assert(check.Configure(map[string]string{"port": "80", "protocol": "icmp"}), NotNil)
+	c.Assert(check.Configure(map[string]string{"port": "53", "protocol": "udp"}), NotNil)
+	c.Assert(check.Configure(map[string]string{"port": "53", "protocol": "udp", "expect": "pong"}), NotNil)
+	c.Assert(check.Configure(map[string]string{"port": "80", "connect-time-warning": "1"}), NotNil)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+	. "utils"
+)
+
+// The Linux proc connector sends an event over netlink every time a
+// process execs or exits, which lets the agent check the monitored
+// processes as soon as one of them dies or starts instead of waiting for
+// the next poll. Listening requires CAP_NET_ADMIN, the agent polls every
+// monitored-sleep without it.
+// See Documentation/connector/connector.txt in the kernel source tree.
+
+const (
+	// from <linux/connector.h>
+	CN_IDX_PROC = 0x1
+	CN_VAL_PROC = 0x1
+
+	// from <linux/cn_proc.h>
+	PROC_CN_MCAST_LISTEN = 1
+	PROC_EVENT_EXEC      = 0x00000002
+	PROC_EVENT_EXIT      = 0x80000000
+
+	PROC_CONNECTOR_DELAY         = 500 * time.Millisecond
+	PROC_CONNECTOR_MIN_INTERVAL  = 2 * time.Second
+	PROC_CONNECTOR_POLL_INTERVAL = time.Minute
+)
+
+// netlink messages use the host byte order
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// how long to wait after a wakeup before checking the processes, gives
+// the process some time to finish exiting or starting and limits the
+// checks to one every PROC_CONNECTOR_MIN_INTERVAL, e.g. when the workers
+// of a prefork server are recycled
+func procConnectorDelay(lastCheck, now time.Time) time.Duration {
+	delay := lastCheck.Add(PROC_CONNECTOR_MIN_INTERVAL).Sub(now)
+	if delay < PROC_CONNECTOR_DELAY {
+		return PROC_CONNECTOR_DELAY
+	}
+	return delay
+}
+
+// with the proc connector the processes are polled, and their metrics
+// reported, every PROC_CONNECTOR_POLL_INTERVAL. The status of the
+// processes that aren't up is checked every monitored-sleep in between
+// since restarting them doesn't necessarily trigger an event
+func procConnectorNextCheck(now, nextPoll time.Time, allUp bool) time.Time {
+	if next := now.Add(AgentConfig.MonitoredSleep); !allUp && next.Before(nextPoll) {
+		return next
+	}
+	return nextPoll
+}
+
+// struct cn_msg
+type cnMsg struct {
+	Idx   uint32
+	Val   uint32
+	Seq   uint32
+	Ack   uint32
+	Len   uint16
+	Flags uint16
+}
+
+// struct proc_event without the event data
+type procEventHeader struct {
+	What      uint32
+	Cpu       uint32
+	Timestamp uint64
+}
+
+// the first fields of the exec and exit events
+type procEventIds struct {
+	ProcessPid  uint32
+	ProcessTgid uint32
+}
+
+type ProcConnector struct {
+	sock   int
+	lock   sync.Mutex
+	pids   map[int]bool
+	names  map[string]bool
+	Wakeup chan bool
+}
+
+// start listening to the proc connector, returns an error if the agent
+// isn't allowed to
+func NewProcConnector() (*ProcConnector, error) {
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM, syscall.NETLINK_CONNECTOR)
+	if err != nil {
+		return nil, err
+	}
+
+	connector := &ProcConnector{
+		sock:   sock,
+		pids:   make(map[int]bool),
+		names:  make(map[string]bool),
+		Wakeup: make(chan bool, 1),
+	}
+	if err := connector.listen(); err != nil {
+		syscall.Close(sock)
+		return nil, err
+	}
+	go connector.readEvents()
+	return connector, nil
+}
+
+func (self *ProcConnector) listen() error {
+	if err := syscall.Bind(self.sock, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: CN_IDX_PROC}); err != nil {
+		return err
+	}
+
+	op := uint32(PROC_CN_MCAST_LISTEN)
+	header := syscall.NlMsghdr{
+		Len:  uint32(syscall.NLMSG_HDRLEN + binary.Size(cnMsg{}) + binary.Size(op)),
+		Type: uint16(syscall.NLMSG_DONE),
+		Pid:  uint32(os.Getpid()),
+	}
+	msg := cnMsg{Idx: CN_IDX_PROC, Val: CN_VAL_PROC, Len: uint16(binary.Size(op))}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, header.Len))
+	binary.Write(buffer, nativeEndian, header)
+	binary.Write(buffer, nativeEndian, msg)
+	binary.Write(buffer, nativeEndian, op)
+	return syscall.Sendto(self.sock, buffer.Bytes(), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+// the pids and names of the monitored processes, an exit of one of the
+// pids or an exec of one of the names wakes up the processes monitoring
+func (self *ProcConnector) Watch(pids map[int]bool, names map[string]bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.pids = pids
+	self.names = names
+}
+
+func (self *ProcConnector) readEvents() {
+	buffer := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(self.sock, buffer, 0)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			// ENOBUFS means events were dropped, check everything
+			log.Warn("Error while reading from the proc connector. Error: %s", err)
+			self.wakeup()
+			continue
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		for _, message := range messages {
+			if message.Header.Type != syscall.NLMSG_DONE {
+				continue
+			}
+			if what, pid, ok := parseProcEvent(message.Data); ok && self.isWatched(what, pid) {
+				self.wakeup()
+			}
+		}
+	}
+}
+
+func (self *ProcConnector) isWatched(what uint32, pid int) bool {
+	name := ""
+	if what == PROC_EVENT_EXEC {
+		name = processName(pid)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	switch what {
+	case PROC_EVENT_EXIT:
+		return self.pids[pid]
+	case PROC_EVENT_EXEC:
+		return name != "" && self.names[name]
+	}
+	return false
+}
+
+func (self *ProcConnector) wakeup() {
+	select {
+	case self.Wakeup <- true:
+	default:
+	}
+}
+
+// returns the type of the event and the pid of the process, thread exits
+// are ignored
+func parseProcEvent(data []byte) (uint32, int, bool) {
+	buffer := bytes.NewBuffer(data)
+	msg := cnMsg{}
+	header := procEventHeader{}
+	ids := procEventIds{}
+	if binary.Read(buffer, nativeEndian, &msg) != nil ||
+		binary.Read(buffer, nativeEndian, &header) != nil {
+		return 0, 0, false
+	}
+	if header.What != PROC_EVENT_EXEC && header.What != PROC_EVENT_EXIT {
+		return 0, 0, false
+	}
+	if binary.Read(buffer, nativeEndian, &ids) != nil || ids.ProcessPid != ids.ProcessTgid {
+		return 0, 0, false
+	}
+	return header.What, int(ids.ProcessTgid), true
+}
+
+func processName(pid int) string {
+	comm, err := ioutil.ReadFile(path.Join(procDir, strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
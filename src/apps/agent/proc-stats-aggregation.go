@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Reporting the top processes with their pid and command line creates a
+// new series for every process, the processes can instead be grouped by
+// name, user or process tree. The number of groups reported for each
+// aggregation is capped, new groups beyond the cap are added to the
+// "other" group. The groups that weren't seen for PROC_STATS_GROUP_EXPIRY
+// don't count towards the cap anymore.
+
+const (
+	OTHER_PROCESSES         = "other"
+	PROC_STATS_GROUP_EXPIRY = 1 * time.Hour
+)
+
+type ProcStatsAggregator struct {
+	maxSeries int
+	// when the groups of each aggregation were last reported
+	seen      map[string]map[string]time.Time
+	usernames map[uint32]string
+}
+
+func NewProcStatsAggregator(maxSeries int) *ProcStatsAggregator {
+	return &ProcStatsAggregator{
+		maxSeries: maxSeries,
+		seen:      make(map[string]map[string]time.Time),
+		usernames: make(map[uint32]string),
+	}
+}
+
+// the cpu and memory usage of the processes grouped by name, user or
+// tree, the name of the returned stats is the group
+func (self *ProcStatsAggregator) Aggregate(by string, stats []MergedProcStat, processes ProcsByPid, now time.Time) []MergedProcStat {
+	seen, ok := self.seen[by]
+	if !ok {
+		seen = make(map[string]time.Time)
+		self.seen[by] = seen
+	}
+	for group, lastSeen := range seen {
+		if now.Sub(lastSeen) > PROC_STATS_GROUP_EXPIRY {
+			delete(seen, group)
+		}
+	}
+
+	groups := make(map[string]*MergedProcStat)
+	for _, stat := range stats {
+		group := self.group(by, stat, processes)
+		if _, ok := seen[group]; ok || len(seen) < self.maxSeries {
+			seen[group] = now
+		} else {
+			group = OTHER_PROCESSES
+		}
+
+		aggregated, ok := groups[group]
+		if !ok {
+			aggregated = &MergedProcStat{name: group}
+			groups[group] = aggregated
+		}
+		aggregated.cpuUsage += stat.cpuUsage
+		aggregated.memUsage += stat.memUsage
+	}
+
+	aggregated := make([]MergedProcStat, 0, len(groups))
+	for _, stat := range groups {
+		aggregated = append(aggregated, *stat)
+	}
+	return aggregated
+}
+
+func (self *ProcStatsAggregator) group(by string, stat MergedProcStat, processes ProcsByPid) string {
+	switch by {
+	case "user":
+		return self.username(stat.pid)
+	case "tree":
+		return processTree(stat.pid, processes)
+	}
+	return stat.name
+}
+
+func (self *ProcStatsAggregator) username(pid int) string {
+	info, err := os.Stat(path.Join(procDir, strconv.Itoa(pid)))
+	if err != nil {
+		return OTHER_PROCESSES
+	}
+	uid := info.Sys().(*syscall.Stat_t).Uid
+
+	if username, ok := self.usernames[uid]; ok {
+		return username
+	}
+	username := strconv.FormatUint(uint64(uid), 10)
+	if owner, err := user.LookupId(username); err == nil {
+		username = owner.Username
+	}
+	self.usernames[uid] = username
+	return username
+}
+
+// the name of the oldest ancestor of the process that isn't init or
+// kthreadd, i.e. the service that started the process
+func processTree(pid int, processes ProcsByPid) string {
+	process, ok := processes[pid]
+	if !ok {
+		return OTHER_PROCESSES
+	}
+	// guard against loops in case the pids were reused between snapshots
+	for i := 0; i < len(processes); i++ {
+		parent, ok := processes[process.state.Ppid]
+		if !ok || parent.pid <= 2 {
+			break
+		}
+		process = parent
+	}
+	return process.state.Name
+}
+
+// the n groups using the most cpu, or memory, and the sum of the others
+func topGroups(groups []MergedProcStat, n int, byCpu bool) []MergedProcStat {
+	sorted := make([]MergedProcStat, len(groups))
+	copy(sorted, groups)
+	if byCpu {
+		sort.Sort(ProcStatsSortableByCpu(sorted))
+	} else {
+		sort.Sort(ProcStatsSortableByMem(sorted))
+	}
+	if len(sorted) <= n {
+		return sorted
+	}
+
+	other := MergedProcStat{name: OTHER_PROCESSES}
+	top := make([]MergedProcStat, 0, n+1)
+	for _, stat := range sorted {
+		if len(top) < n && stat.name != OTHER_PROCESSES {
+			top = append(top, stat)
+			continue
+		}
+		other.cpuUsage += stat.cpuUsage
+		other.memUsage += stat.memUsage
+	}
+	return append(top, other)
+}
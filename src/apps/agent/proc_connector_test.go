@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"time"
+	. "utils"
+)
+
+type ProcConnectorSuite struct {
+	procDir string
+}
+
+var _ = Suite(&ProcConnectorSuite{})
+
+func (self *ProcConnectorSuite) SetUpTest(c *C) {
+	self.procDir = procDir
+	procDir = c.MkDir()
+}
+
+func (self *ProcConnectorSuite) TearDownTest(c *C) {
+	procDir = self.procDir
+}
+
+func procEvent(what uint32, pid, tgid uint32) []byte {
+	buffer := bytes.NewBuffer(nil)
+	binary.Write(buffer, nativeEndian, cnMsg{Idx: CN_IDX_PROC, Val: CN_VAL_PROC})
+	binary.Write(buffer, nativeEndian, procEventHeader{What: what})
+	binary.Write(buffer, nativeEndian, procEventIds{ProcessPid: pid, ProcessTgid: tgid})
+	return buffer.Bytes()
+}
+
+func (self *ProcConnectorSuite) TestParseProcEvent(c *C) {
+	what, pid, ok := parseProcEvent(procEvent(PROC_EVENT_EXIT, 123, 123))
+	c.Assert(ok, Equals, true)
+	c.Assert(what, Equals, uint32(PROC_EVENT_EXIT))
+	c.Assert(pid, Equals, 123)
+
+	what, pid, ok = parseProcEvent(procEvent(PROC_EVENT_EXEC, 456, 456))
+	c.Assert(ok, Equals, true)
+	c.Assert(what, Equals, uint32(PROC_EVENT_EXEC))
+	c.Assert(pid, Equals, 456)
+
+	// thread exits, forks and truncated messages are ignored
+	_, _, ok = parseProcEvent(procEvent(PROC_EVENT_EXIT, 124, 123))
+	c.Assert(ok, Equals, false)
+	_, _, ok = parseProcEvent(procEvent(0x1, 123, 123))
+	c.Assert(ok, Equals, false)
+	_, _, ok = parseProcEvent(procEvent(PROC_EVENT_EXIT, 123, 123)[:20])
+	c.Assert(ok, Equals, false)
+}
+
+func (self *ProcConnectorSuite) TestIsWatched(c *C) {
+	c.Assert(os.MkdirAll(path.Join(procDir, "456"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(procDir, "456", "comm"), []byte("nginx\n"), 0644), IsNil)
+
+	connector := &ProcConnector{Wakeup: make(chan bool, 1)}
+	connector.Watch(map[int]bool{123: true}, map[string]bool{"nginx": true})
+
+	c.Assert(connector.isWatched(PROC_EVENT_EXIT, 123), Equals, true)
+	c.Assert(connector.isWatched(PROC_EVENT_EXIT, 124), Equals, false)
+	c.Assert(connector.isWatched(PROC_EVENT_EXEC, 456), Equals, true)
+	c.Assert(connector.isWatched(PROC_EVENT_EXEC, 457), Equals, false)
+	c.Assert(connector.isWatched(PROC_EVENT_EXEC, 123), Equals, false)
+}
+
+func (self *ProcConnectorSuite) TestWakeupDoesntBlock(c *C) {
+	connector := &ProcConnector{Wakeup: make(chan bool, 1)}
+	connector.wakeup()
+	connector.wakeup()
+	c.Assert(<-connector.Wakeup, Equals, true)
+	select {
+	case <-connector.Wakeup:
+		c.Fatal("Expected a single wakeup")
+	default:
+	}
+}
+
+func (self *ProcConnectorSuite) TestDelay(c *C) {
+	now := time.Now()
+	c.Assert(procConnectorDelay(now.Add(-time.Minute), now), Equals, PROC_CONNECTOR_DELAY)
+	c.Assert(procConnectorDelay(now.Add(-500*time.Millisecond), now), Equals, 1500*time.Millisecond)
+}
+
+func (self *ProcConnectorSuite) TestNextCheck(c *C) {
+	previousSleep := AgentConfig.MonitoredSleep
+	defer func() { AgentConfig.MonitoredSleep = previousSleep }()
+	AgentConfig.MonitoredSleep = 10 * time.Second
+
+	now := time.Now()
+	nextPoll := now.Add(PROC_CONNECTOR_POLL_INTERVAL)
+	c.Assert(procConnectorNextCheck(now, nextPoll, true), Equals, nextPoll)
+	c.Assert(procConnectorNextCheck(now, nextPoll, false), Equals, now.Add(10*time.Second))
+	c.Assert(procConnectorNextCheck(now, now.Add(5*time.Second), false), Equals, now.Add(5*time.Second))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"os"
+	"os/user"
+	"sort"
+	"time"
+)
+
+type ProcStatsAggregationSuite struct{}
+
+var _ = Suite(&ProcStatsAggregationSuite{})
+
+func groupsByName(groups []MergedProcStat) map[string]MergedProcStat {
+	byName := make(map[string]MergedProcStat)
+	for _, group := range groups {
+		byName[group.name] = group
+	}
+	return byName
+}
+
+func (self *ProcStatsAggregationSuite) TestAggregateByName(c *C) {
+	stats := []MergedProcStat{
+		MergedProcStat{pid: 10, name: "worker", cpuUsage: 10, memUsage: 100},
+		MergedProcStat{pid: 11, name: "worker", cpuUsage: 5, memUsage: 200},
+		MergedProcStat{pid: 12, name: "nginx", cpuUsage: 1, memUsage: 50},
+	}
+
+	groups := groupsByName(NewProcStatsAggregator(10).Aggregate("name", stats, nil, time.Now()))
+	c.Assert(groups, HasLen, 2)
+	c.Assert(groups["worker"].cpuUsage, Equals, 15.0)
+	c.Assert(groups["worker"].memUsage, Equals, 300.0)
+	c.Assert(groups["nginx"].cpuUsage, Equals, 1.0)
+}
+
+func (self *ProcStatsAggregationSuite) TestMaxSeries(c *C) {
+	aggregator := NewProcStatsAggregator(2)
+	stats := []MergedProcStat{
+		MergedProcStat{pid: 10, name: "worker", cpuUsage: 10},
+		MergedProcStat{pid: 11, name: "nginx", cpuUsage: 5},
+	}
+	c.Assert(groupsByName(aggregator.Aggregate("name", stats, nil, time.Now())), HasLen, 2)
+
+	// new groups go to other once the cap is reached
+	stats = append(stats, MergedProcStat{pid: 12, name: "cron", cpuUsage: 1}, MergedProcStat{pid: 13, name: "sshd", cpuUsage: 2})
+	groups := groupsByName(aggregator.Aggregate("name", stats, nil, time.Now()))
+	c.Assert(groups, HasLen, 3)
+	c.Assert(groups[OTHER_PROCESSES].cpuUsage, Equals, 3.0)
+}
+
+func (self *ProcStatsAggregationSuite) TestExpiredGroups(c *C) {
+	aggregator := NewProcStatsAggregator(2)
+	now := time.Now()
+	stats := []MergedProcStat{
+		MergedProcStat{pid: 10, name: "worker", cpuUsage: 10},
+		MergedProcStat{pid: 11, name: "nginx", cpuUsage: 5},
+	}
+	aggregator.Aggregate("name", stats, nil, now)
+
+	// the worker exited, its slot is freed once it expires
+	stats = []MergedProcStat{
+		MergedProcStat{pid: 11, name: "nginx", cpuUsage: 5},
+		MergedProcStat{pid: 12, name: "cron", cpuUsage: 1},
+	}
+	groups := groupsByName(aggregator.Aggregate("name", stats, nil, now.Add(PROC_STATS_GROUP_EXPIRY)))
+	c.Assert(groups, HasLen, 2)
+	c.Assert(groups[OTHER_PROCESSES].cpuUsage, Equals, 1.0)
+
+	groups = groupsByName(aggregator.Aggregate("name", stats, nil, now.Add(PROC_STATS_GROUP_EXPIRY+time.Minute)))
+	c.Assert(groups, HasLen, 2)
+	c.Assert(groups["cron"].cpuUsage, Equals, 1.0)
+	c.Assert(groups["nginx"].cpuUsage, Equals, 5.0)
+}
+
+func (self *ProcStatsAggregationSuite) TestAggregateByTree(c *C) {
+	initProcess := fakeProcStat(1, "init")
+	master := fakeProcStat(100, "nginx")
+	master.state.Ppid = 1
+	worker := fakeProcStat(101, "nginx-worker")
+	worker.state.Ppid = 100
+	script := fakeProcStat(102, "sh")
+	script.state.Ppid = 101
+	processes := ProcsByPid{1: initProcess, 100: master, 101: worker, 102: script}
+
+	c.Assert(processTree(102, processes), Equals, "nginx")
+	c.Assert(processTree(100, processes), Equals, "nginx")
+	c.Assert(processTree(1, processes), Equals, "init")
+
+	stats := []MergedProcStat{
+		MergedProcStat{pid: 100, name: "nginx", cpuUsage: 1},
+		MergedProcStat{pid: 101, name: "nginx-worker", cpuUsage: 2},
+		MergedProcStat{pid: 102, name: "sh", cpuUsage: 3},
+	}
+	groups := groupsByName(NewProcStatsAggregator(10).Aggregate("tree", stats, processes, time.Now()))
+	c.Assert(groups, HasLen, 1)
+	c.Assert(groups["nginx"].cpuUsage, Equals, 6.0)
+}
+
+func (self *ProcStatsAggregationSuite) TestAggregateByUser(c *C) {
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+
+	stats := []MergedProcStat{MergedProcStat{pid: os.Getpid(), name: "agent.test", cpuUsage: 1}}
+	groups := groupsByName(NewProcStatsAggregator(10).Aggregate("user", stats, nil, time.Now()))
+	c.Assert(groups[current.Username].cpuUsage, Equals, 1.0)
+}
+
+func (self *ProcStatsAggregationSuite) TestTopGroups(c *C) {
+	groups := []MergedProcStat{
+		MergedProcStat{name: "a", cpuUsage: 1, memUsage: 40},
+		MergedProcStat{name: "b", cpuUsage: 2, memUsage: 30},
+		MergedProcStat{name: "c", cpuUsage: 3, memUsage: 20},
+		MergedProcStat{name: OTHER_PROCESSES, cpuUsage: 4, memUsage: 10},
+	}
+
+	top := topGroups(groups, 2, true)
+	c.Assert(top, HasLen, 3)
+	c.Assert(top[0].name, Equals, "c")
+	c.Assert(top[1].name, Equals, "b")
+	c.Assert(top[2], DeepEquals, MergedProcStat{name: OTHER_PROCESSES, cpuUsage: 5, memUsage: 50})
+
+	top = topGroups(groups, 2, false)
+	names := []string{top[0].name, top[1].name}
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, []string{"a", "b"})
+
+	c.Assert(topGroups(groups, 10, true), HasLen, 4)
+}
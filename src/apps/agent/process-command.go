@@ -0,0 +1,122 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"syscall"
+	"time"
+	. "utils"
+)
+
+// Runs the start and stop commands of the monitored processes as the
+// process user. The agent switches to the user itself when it runs as
+// root and uses sudo otherwise, see the sudoers-generator.
+
+type CommandResult struct {
+	Command  Command
+	Output   string
+	ExitCode int
+	Duration time.Duration
+	Err      error
+}
+
+func (self *CommandResult) Failed() bool {
+	return self.Err != nil
+}
+
+// a description of the result used in the logs and the event context
+func (self *CommandResult) String() string {
+	description := fmt.Sprintf("%s exited with status %d in %s", self.Command, self.ExitCode, self.Duration)
+	if self.Err != nil {
+		description = fmt.Sprintf("%s failed in %s. Error: %s", self.Command, self.Duration, self.Err)
+	}
+	if output := strings.TrimSpace(self.Output); output != "" {
+		description += ". Output: " + output
+	}
+	return description
+}
+
+// the command that runs argv as the given user
+func userCommand(argv Command, username string) (*exec.Cmd, error) {
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("Empty command")
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	if username == "" || username == current.Username {
+		return exec.Command(argv[0], argv[1:]...), nil
+	}
+
+	if os.Geteuid() != 0 {
+		args := append([]string{"-n", "-u", username, "--"}, argv...)
+		return exec.Command("sudo", args...), nil
+	}
+
+	runAs, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := userCredential(runAs)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	return cmd, nil
+}
+
+func runProcessCommand(argv Command, username string, timeout time.Duration) *CommandResult {
+	result := &CommandResult{Command: argv, ExitCode: -1}
+	started := time.Now()
+	defer func() { result.Duration = time.Now().Sub(started) }()
+
+	cmd, err := userCommand(argv, username)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	// the output goes to a file instead of a pipe, Wait would otherwise
+	// block until the daemons started by the command close their stdout
+	outputFile, err := ioutil.TempFile("", "errplane-agent-command")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer outputFile.Close()
+	os.Remove(outputFile.Name())
+	cmd.Stdout = outputFile
+	cmd.Stderr = outputFile
+
+	log.Info("Executing '%s' as %s", argv, username)
+	if err := cmd.Start(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	ch := make(chan error, 1)
+	go killPlugin(argv[0], cmd, timeout, ch)
+	err = cmd.Wait()
+	ch <- err
+
+	output := NewBoundedBuffer(PLUGIN_MAX_STDERR)
+	if _, err := outputFile.Seek(0, 0); err == nil {
+		io.Copy(output, outputFile)
+	}
+	result.Output = output.String()
+	if cmd.ProcessState.Exited() {
+		result.ExitCode = (&ProcessStateWrapper{cmd.ProcessState}).ExitStatus()
+	} else {
+		err = fmt.Errorf("Didn't finish in %s", timeout)
+	}
+	result.Err = err
+	return result
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+	. "utils"
+)
+
+// The monitored processes are sorted so that the dependencies of a process
+// come before it, see GetMonitoredProcesses. A process isn't restarted
+// while one of its dependencies is down and its dependents are stopped
+// while it is restarted through the local server.
+
+var processUpPollInterval = time.Second
+
+// the nicknames of the dependencies of the process that are down
+func dependenciesDown(process *Process, processes []*Process) []string {
+	down := make([]string, 0)
+	for _, nickname := range process.DependsOn {
+		for _, dependency := range processes {
+			if dependency.Nickname == nickname && dependency.LastStatus == DOWN {
+				down = append(down, nickname)
+			}
+		}
+	}
+	return down
+}
+
+// the processes that depend on the process directly or indirectly, in the
+// order they should be started
+func processDependents(process *Process, processes []*Process) []*Process {
+	restarted := map[string]bool{process.Nickname: true}
+	dependents := make([]*Process, 0)
+	for _, dependent := range processes {
+		if restarted[dependent.Nickname] {
+			continue
+		}
+		for _, nickname := range dependent.DependsOn {
+			if restarted[nickname] {
+				restarted[dependent.Nickname] = true
+				dependents = append(dependents, dependent)
+				break
+			}
+		}
+	}
+	return dependents
+}
+
+// wait until the process is up, returns false if it's still down after
+// the timeout
+func waitForProcessUp(process *Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, processes := getProcesses()
+		if status, _, _ := getProcessStatus(process, processes); status == UP {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(processUpPollInterval)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+	. "utils"
+)
+
+// The last process events are kept in memory and exposed by the local
+// server so that restarts can be debugged on the server itself, e.g.
+// using `errplane-agent_ctl --events`.
+
+const (
+	PROCESS_EVENTS_HISTORY    = 200
+	PROCESS_EVENTS_MAX_OUTPUT = 1024
+)
+
+type ProcessEvent struct {
+	Process   string    `json:"process"`
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	Context   string    `json:"context,omitempty"`
+	Command   string    `json:"command,omitempty"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Output    string    `json:"output,omitempty"`
+}
+
+var (
+	processEventsLock sync.Mutex
+	processEvents     = make([]*ProcessEvent, 0, PROCESS_EVENTS_HISTORY)
+	// used to report the events that don't happen in monitorProceses,
+	// e.g. restarts requested through the local server
+	processEventsReporter Reporter
+)
+
+func newProcessEvent(process *Process, status, context string, result *CommandResult) *ProcessEvent {
+	event := &ProcessEvent{
+		Process:   process.Nickname,
+		Status:    status,
+		Timestamp: time.Now(),
+		Context:   context,
+	}
+	if result != nil {
+		event.Command = result.Command.String()
+		if result.ExitCode >= 0 {
+			exitCode := result.ExitCode
+			event.ExitCode = &exitCode
+		}
+		event.Output = result.Output
+		if len(event.Output) > PROCESS_EVENTS_MAX_OUTPUT {
+			event.Output = event.Output[:PROCESS_EVENTS_MAX_OUTPUT] + "\n[truncated]"
+		}
+	}
+	return event
+}
+
+func recordProcessEvent(event *ProcessEvent) {
+	processEventsLock.Lock()
+	defer processEventsLock.Unlock()
+
+	if len(processEvents) == PROCESS_EVENTS_HISTORY {
+		copy(processEvents, processEvents[1:])
+		processEvents = processEvents[:len(processEvents)-1]
+	}
+	processEvents = append(processEvents, event)
+}
+
+// the events of the given process, or all the events if it's empty,
+// oldest first
+func getProcessEvents(nickname string) []*ProcessEvent {
+	processEventsLock.Lock()
+	defer processEventsLock.Unlock()
+
+	events := make([]*ProcessEvent, 0)
+	for _, event := range processEvents {
+		if nickname == "" || event.Process == nickname {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func processEventsOutput(w http.ResponseWriter, req *http.Request) {
+	events := getProcessEvents(req.URL.Query().Get(":process"))
+	data, err := json.Marshal(events)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
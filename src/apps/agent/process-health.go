@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/errplane/gosigar"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	. "utils"
+)
+
+// Besides matching the process name or command line, the status of a
+// monitored process can be checked using its pidfile, the state of its
+// systemd unit or a port it should be listening on. The last two catch
+// services that are hung but still running.
+
+const (
+	TCP_LISTEN_STATE = "0A"
+)
+
+var (
+	systemctlCommand = "systemctl"
+	procDir          = "/proc"
+	// the checks run one after the other in the monitoring loop, a hung
+	// systemctl or service shouldn't delay the other processes for long
+	processCheckTimeout = 2 * time.Second
+)
+
+// the instances of the process found using its pidfile
+func findProcessByPidFile(process *Process, processes ProcsByPid) ([]*ProcStat, error) {
+	content, err := ioutil.ReadFile(process.PidFile)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pidfile %s. Error: %s", process.PidFile, err)
+	}
+
+	stat, ok := processes[pid]
+	if !ok || stat.state.State == sigar.RunStateZombie {
+		return nil, fmt.Errorf("Process %d in %s isn't running", pid, process.PidFile)
+	}
+	// the pid of a stale pidfile may have been reused by another process
+	if process.Name != "" && stat.state.Name != process.Name {
+		return nil, fmt.Errorf("Process %d in %s is %s not %s", pid, process.PidFile, stat.state.Name, process.Name)
+	}
+	return []*ProcStat{stat}, nil
+}
+
+// the instances of the process found using the main pid of its systemd
+// unit, returns an error if the unit isn't active
+func findProcessBySystemdUnit(process *Process, processes ProcsByPid) ([]*ProcStat, error) {
+	output := bytes.NewBuffer(nil)
+	cmd := exec.Command(systemctlCommand, "show", "-p", "ActiveState", "-p", "MainPID", process.Unit)
+	cmd.Stdout = output
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Cannot get the state of unit %s. Error: %s", process.Unit, err)
+	}
+
+	ch := make(chan error, 1)
+	go killPlugin(systemctlCommand, cmd, processCheckTimeout, ch)
+	err := cmd.Wait()
+	ch <- err
+	if !cmd.ProcessState.Exited() {
+		return nil, fmt.Errorf("Cannot get the state of unit %s. Error: Didn't finish in %s", process.Unit, processCheckTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get the state of unit %s. Error: %s", process.Unit, err)
+	}
+
+	properties := make(map[string]string)
+	for _, line := range strings.Split(output.String(), "\n") {
+		if nameAndValue := strings.SplitN(strings.TrimSpace(line), "=", 2); len(nameAndValue) == 2 {
+			properties[nameAndValue[0]] = nameAndValue[1]
+		}
+	}
+
+	if state := properties["ActiveState"]; state != "active" && state != "reloading" {
+		return nil, fmt.Errorf("Unit %s is %s", process.Unit, state)
+	}
+
+	// oneshot units don't have a main process, they are up while they are
+	// active, see getProcessStatus
+	pid, _ := strconv.Atoi(properties["MainPID"])
+	if pid == 0 {
+		return []*ProcStat{}, nil
+	}
+	if stat, ok := processes[pid]; ok {
+		return []*ProcStat{stat}, nil
+	}
+	return nil, fmt.Errorf("The main process %d of unit %s isn't running", pid, process.Unit)
+}
+
+// the instances of the process that own the socket listening on the
+// process port, returns an error if the port doesn't accept connections
+func findProcessByPort(process *Process, processes ProcsByPid) ([]*ProcStat, error) {
+	sockets, err := listeningSockets(process.Port)
+	if err != nil {
+		return nil, err
+	}
+	if len(sockets) == 0 {
+		return nil, fmt.Errorf("Nothing is listening on port %d", process.Port)
+	}
+
+	instances := make([]*ProcStat, 0)
+	address := ""
+	for _, stat := range findMatchingProcesses(process, processes) {
+		if inode, ok := ownedSocket(stat.pid, sockets); ok {
+			instances = append(instances, stat)
+			address = sockets[inode]
+		}
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("Port %d isn't owned by %s", process.Port, process.Name)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(process.Port)), processCheckTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to port %d. Error: %s", process.Port, err)
+	}
+	conn.Close()
+	return instances, nil
+}
+
+// the address to connect to for each inode of the tcp sockets listening on
+// the given port
+func listeningSockets(port int) (map[string]string, error) {
+	sockets := make(map[string]string)
+	for _, file := range []string{"net/tcp", "net/tcp6"} {
+		content, err := ioutil.ReadFile(path.Join(procDir, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(content), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != TCP_LISTEN_STATE {
+				continue
+			}
+			addressAndPort := strings.SplitN(fields[1], ":", 2)
+			if len(addressAndPort) != 2 {
+				continue
+			}
+			localPort, err := strconv.ParseInt(addressAndPort[1], 16, 32)
+			if err != nil || int(localPort) != port {
+				continue
+			}
+			address, err := procNetAddress(addressAndPort[0])
+			if err != nil {
+				continue
+			}
+			sockets[fields[9]] = address
+		}
+	}
+	return sockets, nil
+}
+
+// parses an address of /proc/net/tcp{,6}, made of 32 bits words in host
+// byte order, the sockets listening on all the addresses are reached
+// through the loopback
+func procNetAddress(hexAddress string) (string, error) {
+	raw, err := hex.DecodeString(hexAddress)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", fmt.Errorf("Invalid address %s", hexAddress)
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		nativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	if ip.IsUnspecified() {
+		if len(ip) == net.IPv4len {
+			return "127.0.0.1", nil
+		}
+		return "::1", nil
+	}
+	return ip.String(), nil
+}
+
+// the inode of the socket owned by the process
+func ownedSocket(pid int, sockets map[string]string) (string, bool) {
+	fdDir := path.Join(procDir, strconv.Itoa(pid), "fd")
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return "", false
+	}
+	for _, fd := range fds {
+		link, err := os.Readlink(path.Join(fdDir, fd.Name()))
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+		if _, ok := sockets[inode]; ok {
+			return inode, true
+		}
+	}
+	return "", false
+}
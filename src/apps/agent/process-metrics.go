@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics of the monitored processes that gosigar doesn't collect, read
+// from /proc/<pid>. The io and context switches counters are reported
+// as rates using the previous snapshot of each pid.
+
+type procExtendedStat struct {
+	now             time.Time
+	threads         int
+	hasFds          bool
+	fds             int
+	fdsLimit        int
+	hasIo           bool
+	readBytes       uint64
+	writeBytes      uint64
+	contextSwitches uint64
+}
+
+type ProcessMetrics struct {
+	previous map[int]*procExtendedStat
+	current  map[int]*procExtendedStat
+}
+
+func NewProcessMetrics() *ProcessMetrics {
+	return &ProcessMetrics{
+		previous: make(map[int]*procExtendedStat),
+		current:  make(map[int]*procExtendedStat),
+	}
+}
+
+// the metrics of all the instances of a monitored process, keyed by the
+// metric name without the server.stats.procs prefix
+func (self *ProcessMetrics) Collect(instances []*ProcStat, processes ProcsByPid, now time.Time) map[string]float64 {
+	metrics := make(map[string]float64)
+	if len(instances) == 0 {
+		return metrics
+	}
+
+	pids := make(map[int]bool)
+	var uptime time.Duration = -1
+	for _, instance := range instances {
+		pids[instance.pid] = true
+
+		// the youngest instance shows when the process was last restarted
+		started := time.Unix(0, int64(instance.cpu.StartTime)*int64(time.Millisecond))
+		if instanceUptime := now.Sub(started); uptime < 0 || instanceUptime < uptime {
+			uptime = instanceUptime
+		}
+	}
+	metrics["uptime"] = uptime.Seconds()
+
+	children := 0
+	for pid, process := range processes {
+		if !pids[pid] && pids[process.state.Ppid] {
+			children++
+		}
+	}
+	metrics["children"] = float64(children)
+
+	threads, fds := 0, 0
+	fdsUsage := 0.0
+	var readRate, writeRate, contextSwitchesRate float64
+	hasFds, hasRates, hasIoRates := false, false, false
+	for _, instance := range instances {
+		stat, err := getProcExtendedStat(instance.pid, now)
+		if err != nil {
+			continue
+		}
+		self.current[instance.pid] = stat
+
+		threads += stat.threads
+		if stat.hasFds {
+			hasFds = true
+			fds += stat.fds
+		}
+		// the instance closest to its limit
+		if stat.hasFds && stat.fdsLimit > 0 {
+			if usage := float64(stat.fds) / float64(stat.fdsLimit) * 100; usage > fdsUsage {
+				fdsUsage = usage
+			}
+		}
+
+		previous, ok := self.previous[instance.pid]
+		if !ok {
+			continue
+		}
+		seconds := stat.now.Sub(previous.now).Seconds()
+		if seconds <= 0 {
+			continue
+		}
+		if stat.contextSwitches >= previous.contextSwitches {
+			contextSwitchesRate += float64(stat.contextSwitches-previous.contextSwitches) / seconds
+			hasRates = true
+		}
+		if stat.hasIo && previous.hasIo && stat.readBytes >= previous.readBytes && stat.writeBytes >= previous.writeBytes {
+			readRate += float64(stat.readBytes-previous.readBytes) / seconds
+			writeRate += float64(stat.writeBytes-previous.writeBytes) / seconds
+			hasIoRates = true
+		}
+	}
+
+	metrics["threads"] = float64(threads)
+	if hasFds {
+		metrics["fds"] = float64(fds)
+		metrics["fds.usage"] = fdsUsage
+	}
+	if hasRates {
+		metrics["context_switches"] = contextSwitchesRate
+	}
+	if hasIoRates {
+		metrics["io.read_bytes"] = readRate
+		metrics["io.write_bytes"] = writeRate
+	}
+	return metrics
+}
+
+// forget the pids that weren't collected since the previous call
+func (self *ProcessMetrics) Next() {
+	self.previous = self.current
+	self.current = make(map[int]*procExtendedStat)
+}
+
+func getProcExtendedStat(pid int, now time.Time) (*procExtendedStat, error) {
+	pidDir := path.Join(procDir, strconv.Itoa(pid))
+	stat := &procExtendedStat{now: now}
+
+	status, err := readProcFields(path.Join(pidDir, "status"))
+	if err != nil {
+		return nil, err
+	}
+	stat.threads = int(status["Threads"])
+	stat.contextSwitches = status["voluntary_ctxt_switches"] + status["nonvoluntary_ctxt_switches"]
+
+	// the fds and io of processes owned by other users are only readable by root
+	if fds, err := ioutil.ReadDir(path.Join(pidDir, "fd")); err == nil {
+		stat.hasFds = true
+		stat.fds = len(fds)
+	}
+	stat.fdsLimit = openFilesLimit(path.Join(pidDir, "limits"))
+
+	if io, err := readProcFields(path.Join(pidDir, "io")); err == nil {
+		stat.hasIo = true
+		stat.readBytes = io["read_bytes"]
+		stat.writeBytes = io["write_bytes"]
+	}
+	return stat, nil
+}
+
+// parse the numeric fields of files like /proc/<pid>/status
+func readProcFields(file string) (map[string]uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		nameAndValue := strings.SplitN(scanner.Text(), ":", 2)
+		if len(nameAndValue) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(nameAndValue[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		fields[strings.TrimSpace(nameAndValue[0])] = value
+	}
+	return fields, scanner.Err()
+}
+
+// the soft limit of open files in /proc/<pid>/limits, 0 if unlimited
+func openFilesLimit(file string) int {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) == 0 {
+			return 0
+		}
+		limit, _ := strconv.Atoi(fields[0])
+		return limit
+	}
+	return 0
+}
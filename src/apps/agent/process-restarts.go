@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+	. "utils"
+)
+
+// Keeps track of the restarts and the down transitions of the monitored
+// processes to apply their restart policy. The restarts and transitions
+// older than the restart window are forgotten, so a process that gave up
+// or was flapping recovers once it stays stable for a whole window.
+
+type processHistory struct {
+	restarts []time.Time
+	downs    []time.Time
+	gaveUp   bool
+	flapping bool
+}
+
+type ProcessRestarts struct {
+	processes map[string]*processHistory
+}
+
+func NewProcessRestarts() *ProcessRestarts {
+	return &ProcessRestarts{make(map[string]*processHistory)}
+}
+
+func (self *ProcessRestarts) history(process *Process, now time.Time) *processHistory {
+	history, ok := self.processes[process.Nickname]
+	if !ok {
+		history = &processHistory{}
+		self.processes[process.Nickname] = history
+	}
+	history.restarts = dropOlderThan(history.restarts, now.Add(-process.RestartWindow))
+	history.downs = dropOlderThan(history.downs, now.Add(-process.RestartWindow))
+	return history
+}
+
+func dropOlderThan(times []time.Time, threshold time.Time) []time.Time {
+	for len(times) > 0 && times[0].Before(threshold) {
+		times = times[1:]
+	}
+	return times
+}
+
+// records a transition of the process to the given status and returns
+// whether the process is flapping and whether it just started flapping
+func (self *ProcessRestarts) Transition(process *Process, status Status, now time.Time) (flapping, started bool) {
+	history := self.history(process, now)
+	if status == DOWN {
+		history.downs = append(history.downs, now)
+	}
+
+	wasFlapping := history.flapping
+	history.flapping = len(history.downs) >= process.FlapThreshold
+	return history.flapping, history.flapping && !wasFlapping
+}
+
+// whether the down process should be restarted now and whether the agent
+// just gave up restarting it
+func (self *ProcessRestarts) ShouldRestart(process *Process, now time.Time) (restart, gaveUp bool) {
+	history := self.history(process, now)
+
+	if process.MaxRestarts > 0 && len(history.restarts) >= process.MaxRestarts {
+		wasGivenUp := history.gaveUp
+		history.gaveUp = true
+		return false, !wasGivenUp
+	}
+	history.gaveUp = false
+
+	if len(history.restarts) == 0 {
+		return true, false
+	}
+	last := history.restarts[len(history.restarts)-1]
+	return !now.Before(last.Add(restartBackoff(process, len(history.restarts)))), false
+}
+
+func (self *ProcessRestarts) Restarted(process *Process, now time.Time) {
+	history := self.history(process, now)
+	history.restarts = append(history.restarts, now)
+}
+
+// the number of restarts in the restart window
+func (self *ProcessRestarts) Count(process *Process, now time.Time) int {
+	return len(self.history(process, now).restarts)
+}
+
+// the time to wait after the given number of restarts
+func restartBackoff(process *Process, restarts int) time.Duration {
+	backoff := process.RestartBackoff
+	for i := 1; i < restarts && backoff < process.MaxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > process.MaxRestartBackoff {
+		backoff = process.MaxRestartBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"os/user"
+	"time"
+	. "utils"
+)
+
+type ProcessCommandSuite struct{}
+
+var _ = Suite(&ProcessCommandSuite{})
+
+func (self *ProcessCommandSuite) TestRunCommand(c *C) {
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+
+	result := runProcessCommand(Command{"sh", "-c", "echo 'started my app'"}, current.Username, time.Second)
+	c.Assert(result.Failed(), Equals, false)
+	c.Assert(result.ExitCode, Equals, 0)
+	c.Assert(result.Output, Equals, "started my app\n")
+
+	result = runProcessCommand(Command{"sh", "-c", "echo cannot start >&2; exit 3"}, current.Username, time.Second)
+	c.Assert(result.Failed(), Equals, true)
+	c.Assert(result.ExitCode, Equals, 3)
+	c.Assert(result.String(), Matches, "sh -c 'echo cannot start >&2; exit 3' failed in .*exit status 3. Output: cannot start")
+}
+
+func (self *ProcessCommandSuite) TestCommandTimeout(c *C) {
+	result := runProcessCommand(Command{"sleep", "10"}, "", 100*time.Millisecond)
+	c.Assert(result.Failed(), Equals, true)
+	c.Assert(result.Err.Error(), Equals, "Didn't finish in 100ms")
+	c.Assert(result.Duration < 5*time.Second, Equals, true)
+}
+
+// the start commands of daemons often leave a child holding their stdout
+func (self *ProcessCommandSuite) TestBackgroundedChild(c *C) {
+	result := runProcessCommand(Command{"sh", "-c", "sleep 10 & echo started"}, "", 5*time.Second)
+	c.Assert(result.Failed(), Equals, false)
+	c.Assert(result.Output, Equals, "started\n")
+	c.Assert(result.Duration < 5*time.Second, Equals, true)
+}
+
+func (self *ProcessCommandSuite) TestRunAsUser(c *C) {
+	if current, _ := user.Current(); current == nil || current.Uid != "0" {
+		c.Skip("requires root")
+	}
+
+	result := runProcessCommand(Command{"id", "-un"}, "nobody", time.Second)
+	c.Assert(result.Failed(), Equals, false)
+	c.Assert(result.Output, Equals, "nobody\n")
+}
+
+func (self *ProcessCommandSuite) TestEmptyCommand(c *C) {
+	result := runProcessCommand(nil, "", time.Second)
+	c.Assert(result.Failed(), Equals, true)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"os"
+	"os/user"
+	"path"
+	"time"
+	. "utils"
+)
+
+type ProcessDependenciesSuite struct{}
+
+var _ = Suite(&ProcessDependenciesSuite{})
+
+// the name of the test binary as seen by the name status check
+func currentProcessName(c *C) string {
+	_, processes := getProcesses()
+	current, ok := processes[os.Getpid()]
+	c.Assert(ok, Equals, true)
+	return current.state.Name
+}
+
+func (self *ProcessDependenciesSuite) TestDependenciesDown(c *C) {
+	db := &Process{Nickname: "db", LastStatus: DOWN}
+	cache := &Process{Nickname: "cache", LastStatus: UP}
+	app := &Process{Nickname: "app", DependsOn: []string{"db", "cache"}}
+	processes := []*Process{db, cache, app}
+
+	c.Assert(dependenciesDown(app, processes), DeepEquals, []string{"db"})
+	db.LastStatus = UP
+	c.Assert(dependenciesDown(app, processes), HasLen, 0)
+}
+
+func (self *ProcessDependenciesSuite) TestProcessDependents(c *C) {
+	db := &Process{Nickname: "db"}
+	cache := &Process{Nickname: "cache"}
+	app := &Process{Nickname: "app", DependsOn: []string{"db"}}
+	worker := &Process{Nickname: "worker", DependsOn: []string{"cache", "app"}}
+	processes := []*Process{db, cache, app, worker}
+
+	c.Assert(processDependents(db, processes), DeepEquals, []*Process{app, worker})
+	c.Assert(processDependents(cache, processes), DeepEquals, []*Process{worker})
+	c.Assert(processDependents(worker, processes), HasLen, 0)
+}
+
+func (self *ProcessDependenciesSuite) TestWaitForProcessUp(c *C) {
+	processUpPollInterval = 10 * time.Millisecond
+	defer func() { processUpPollInterval = time.Second }()
+
+	process := &Process{Name: "not-running", StatusCmd: "name", MinInstances: 1}
+	c.Assert(waitForProcessUp(process, 50*time.Millisecond), Equals, false)
+
+	process = &Process{Name: currentProcessName(c), StatusCmd: "name", MinInstances: 1}
+	c.Assert(waitForProcessUp(process, 0), Equals, true)
+}
+
+func (self *ProcessDependenciesSuite) newProcess(c *C, nickname string, dependsOn ...string) *Process {
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+	// the test binary always matches
+	return &Process{
+		Name:           nickname,
+		Nickname:       nickname,
+		StatusCmd:      "regex",
+		Regex:          ".",
+		MinInstances:   1,
+		User:           current.Username,
+		StartCmd:       Command{"true"},
+		StopCmd:        Command{"true"},
+		CommandTimeout: time.Second,
+		DependsOn:      dependsOn,
+	}
+}
+
+func (self *ProcessDependenciesSuite) TestRestartWithDependents(c *C) {
+	processEventsLock.Lock()
+	processEvents = processEvents[:0]
+	processEventsLock.Unlock()
+	reporter := &ReporterMock{}
+	processEventsReporter = reporter
+	defer func() { processEventsReporter = nil }()
+
+	db := self.newProcess(c, "db")
+	app := self.newProcess(c, "app", "db")
+	processes := []*Process{db, app, self.newProcess(c, "other")}
+
+	c.Assert(restartWithDependents(db, processes), IsNil)
+
+	events := getProcessEvents("")
+	c.Assert(events, HasLen, 6)
+	c.Assert(events[0].Process, Equals, "db")
+	c.Assert(events[1].Status, Equals, "start-command-succeeded")
+	c.Assert(events[2].Status, Equals, "restart-succeeded")
+	c.Assert(events[3].Process, Equals, "app")
+	c.Assert(events[3].Context, Equals, "db was restarted")
+	// the events of the restart requested by the user are sent
+	c.Assert(reporter.events, HasLen, 6)
+	_, restarting := restartingProcesses.Get("app")
+	c.Assert(restarting, Equals, false)
+
+	app.StartCmd = Command{"false"}
+	c.Assert(restartWithDependents(db, processes), ErrorMatches, "Cannot start app.*")
+}
+
+func (self *ProcessDependenciesSuite) TestSnoozedDependentsAreLeftAlone(c *C) {
+	processEventsLock.Lock()
+	processEvents = processEvents[:0]
+	processEventsLock.Unlock()
+
+	db := self.newProcess(c, "db")
+	app := self.newProcess(c, "app", "db")
+	app.StartCmd = Command{"false"}
+	snoozedProcesses.Set("app", true, time.Minute)
+	defer snoozedProcesses.Delete("app")
+
+	c.Assert(restartWithDependents(db, []*Process{db, app}), IsNil)
+	c.Assert(getProcessEvents("app"), HasLen, 0)
+}
+
+func (self *ProcessDependenciesSuite) TestRestartedProcessIsUnsnoozed(c *C) {
+	db := self.newProcess(c, "db")
+	snoozedProcesses.Set(db.Name, true, time.Minute)
+	defer snoozedProcesses.Delete(db.Name)
+
+	c.Assert(restartWithDependents(db, []*Process{db}), IsNil)
+	_, snoozed := snoozedProcesses.Get(db.Name)
+	c.Assert(snoozed, Equals, false)
+}
+
+func (self *ProcessDependenciesSuite) TestProcessesBeingRestartedAreNotRestartedByTheMonitor(c *C) {
+	marker := path.Join(c.MkDir(), "started")
+	process := self.newProcess(c, "db")
+	process.StartCmd = Command{"touch", marker}
+	process.RestartWindow = time.Minute
+	process.FlapThreshold = 5
+	restartingProcesses.Set("db", true, -1)
+	defer restartingProcesses.Delete("db")
+
+	handleProcessStatus(&ReporterMock{}, process, DOWN, "", []*Process{process}, NewProcessRestarts(), time.Now())
+
+	_, err := os.Stat(marker)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
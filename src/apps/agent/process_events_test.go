@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/errplane/errplane-go"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"os/user"
+	"time"
+	. "utils"
+)
+
+type ProcessEventsSuite struct{}
+
+var _ = Suite(&ProcessEventsSuite{})
+
+func (self *ProcessEventsSuite) SetUpTest(c *C) {
+	processEventsLock.Lock()
+	processEvents = processEvents[:0]
+	processEventsLock.Unlock()
+}
+
+func (self *ProcessEventsSuite) TestHistoryIsBounded(c *C) {
+	process := &Process{Name: "worker", Nickname: "worker"}
+	for i := 0; i < PROCESS_EVENTS_HISTORY+10; i++ {
+		reportProcessEvent(nil, process, fmt.Sprintf("event %d", i), "down")
+	}
+
+	events := getProcessEvents("worker")
+	c.Assert(events, HasLen, PROCESS_EVENTS_HISTORY)
+	c.Assert(events[0].Context, Equals, "event 10")
+	c.Assert(getProcessEvents("nginx"), HasLen, 0)
+}
+
+func (self *ProcessEventsSuite) TestRestartEvents(c *C) {
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+	reporter := &ReporterMock{}
+	process := &Process{
+		Name:           "worker",
+		Nickname:       "worker",
+		User:           current.Username,
+		StartCmd:       Command{"sh", "-c", "echo cannot start; exit 2"},
+		CommandTimeout: time.Second,
+	}
+
+	attemptRestart(reporter, process, "restart 1 in 30m0s")
+
+	events := getProcessEvents("worker")
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].Status, Equals, "restart-attempted")
+	c.Assert(events[1].Status, Equals, "restart-failed")
+	c.Assert(*events[1].ExitCode, Equals, 2)
+	c.Assert(events[1].Output, Equals, "cannot start\n")
+
+	c.Assert(reporter.events, HasLen, 2)
+	c.Assert(reporter.events[1].dimensions["status"], Equals, "restart-failed")
+	c.Assert(reporter.events[1].context, Matches, ".*exit status 2. Output: cannot start")
+
+	// the events of snoozed processes are only kept locally
+	snoozedProcesses.Set("worker", true, time.Minute)
+	defer snoozedProcesses.Delete("worker")
+	reportProcessEvent(reporter, process, "", "down")
+	c.Assert(getProcessEvents("worker"), HasLen, 3)
+	c.Assert(reporter.events, HasLen, 2)
+}
+
+func (self *ProcessEventsSuite) TestSuccessfulStartCommand(c *C) {
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+	process := &Process{
+		Name:           "worker",
+		Nickname:       "worker",
+		User:           current.Username,
+		StartCmd:       Command{"true"},
+		CommandTimeout: time.Second,
+	}
+
+	// the process isn't known to be up until the next check
+	attemptRestart(&ReporterMock{}, process, "restart 1 in 30m0s")
+	events := getProcessEvents("worker")
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[1].Status, Equals, "start-command-succeeded")
+}
+
+func (self *ProcessEventsSuite) TestRestartSucceeded(c *C) {
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+	reporter := &ReporterMock{}
+	process := &Process{
+		Name:           "worker",
+		Nickname:       "worker",
+		User:           current.Username,
+		StartCmd:       Command{"true"},
+		CommandTimeout: time.Second,
+		FlapThreshold:  3,
+		LastStatus:     DOWN,
+	}
+	restarts := NewProcessRestarts()
+
+	attemptRestart(reporter, process, "restart 1 in 30m0s")
+	handleProcessStatus(reporter, process, UP, "", nil, restarts, time.Now())
+
+	events := getProcessEvents("worker")
+	c.Assert(events, HasLen, 4)
+	c.Assert(events[2].Status, Equals, "up")
+	c.Assert(events[3].Status, Equals, "restart-succeeded")
+	c.Assert(reporter.events, HasLen, 4)
+	c.Assert(reporter.events[3].dimensions["status"], Equals, "restart-succeeded")
+
+	// the process came back up without being restarted
+	process.LastStatus = DOWN
+	handleProcessStatus(reporter, process, UP, "", nil, restarts, time.Now())
+	events = getProcessEvents("worker")
+	c.Assert(events, HasLen, 5)
+	c.Assert(events[4].Status, Equals, "up")
+}
+
+func (self *ProcessEventsSuite) TestNilReporters(c *C) {
+	process := &Process{Name: "worker", Nickname: "worker"}
+	// the agent didn't start yet
+	reportProcessEvent(processEventsReporter, process, "", "snoozed")
+	var ep *errplane.Errplane
+	reportProcessEvent(ep, process, "", "down")
+	c.Assert(getProcessEvents("worker"), HasLen, 2)
+}
+
+func (self *ProcessEventsSuite) TestEventsEndpoint(c *C) {
+	reportProcessEvent(nil, &Process{Name: "worker", Nickname: "worker"}, "0 instances running, expected at least 1", "down")
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/process_events", nil)
+	processEventsOutput(recorder, req)
+
+	events := []*ProcessEvent{}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &events), IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Process, Equals, "worker")
+	c.Assert(events[0].Status, Equals, "down")
+	c.Assert(events[0].ExitCode, IsNil)
+}
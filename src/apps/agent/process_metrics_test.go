@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"time"
+)
+
+type ProcessMetricsSuite struct {
+	procDir string
+}
+
+var _ = Suite(&ProcessMetricsSuite{})
+
+func (self *ProcessMetricsSuite) SetUpTest(c *C) {
+	self.procDir = procDir
+	procDir = c.MkDir()
+}
+
+func (self *ProcessMetricsSuite) TearDownTest(c *C) {
+	procDir = self.procDir
+}
+
+func (self *ProcessMetricsSuite) writeProcFiles(c *C, pid, threads, contextSwitches, readBytes, fds string) {
+	dir := path.Join(procDir, pid)
+	c.Assert(os.MkdirAll(path.Join(dir, "fd"), 0755), IsNil)
+	status := "Name:\tworker\nThreads:\t" + threads + "\nvoluntary_ctxt_switches:\t" + contextSwitches + "\nnonvoluntary_ctxt_switches:\t0\n"
+	c.Assert(ioutil.WriteFile(path.Join(dir, "status"), []byte(status), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "io"), []byte("read_bytes: "+readBytes+"\nwrite_bytes: 0\n"), 0644), IsNil)
+	limits := "Limit                     Soft Limit           Hard Limit           Units\nMax open files            10                   4096                 files\n"
+	c.Assert(ioutil.WriteFile(path.Join(dir, "limits"), []byte(limits), 0644), IsNil)
+	for i := 0; i < len(fds); i++ {
+		c.Assert(ioutil.WriteFile(path.Join(dir, "fd", fds[i:i+1]), nil, 0644), IsNil)
+	}
+}
+
+func (self *ProcessMetricsSuite) TestCollect(c *C) {
+	now := time.Unix(time.Now().Unix(), 0)
+	first, second := fakeProcStat(10, "worker"), fakeProcStat(11, "worker")
+	first.cpu.StartTime = uint64(now.Add(-time.Hour).UnixNano() / int64(time.Millisecond))
+	second.cpu.StartTime = uint64(now.Add(-time.Minute).UnixNano() / int64(time.Millisecond))
+	child := fakeProcStat(12, "sh")
+	child.state.Ppid = 10
+	processes := ProcsByPid{10: first, 11: second, 12: child}
+
+	self.writeProcFiles(c, "10", "4", "100", "1000", "0123")
+	self.writeProcFiles(c, "11", "2", "50", "0", "01")
+
+	metrics := NewProcessMetrics()
+	values := metrics.Collect([]*ProcStat{first, second}, processes, now)
+	c.Assert(values["threads"], Equals, 6.0)
+	c.Assert(values["fds"], Equals, 6.0)
+	c.Assert(values["fds.usage"], Equals, 40.0)
+	c.Assert(values["children"], Equals, 1.0)
+	c.Assert(values["uptime"], Equals, 60.0)
+	_, ok := values["io.read_bytes"]
+	c.Assert(ok, Equals, false)
+	metrics.Next()
+
+	self.writeProcFiles(c, "10", "4", "200", "3000", "0123")
+	self.writeProcFiles(c, "11", "2", "150", "1000", "01")
+	values = metrics.Collect([]*ProcStat{first, second}, processes, now.Add(10*time.Second))
+	c.Assert(values["context_switches"], Equals, 20.0)
+	c.Assert(values["io.read_bytes"], Equals, 300.0)
+	c.Assert(values["io.write_bytes"], Equals, 0.0)
+}
+
+func (self *ProcessMetricsSuite) TestUnreadableFds(c *C) {
+	now := time.Now()
+	process := fakeProcStat(10, "worker")
+	self.writeProcFiles(c, "10", "4", "100", "1000", "")
+	c.Assert(os.Remove(path.Join(procDir, "10", "fd")), IsNil)
+
+	values := NewProcessMetrics().Collect([]*ProcStat{process}, ProcsByPid{10: process}, now)
+	c.Assert(values["threads"], Equals, 4.0)
+	_, ok := values["fds"]
+	c.Assert(ok, Equals, false)
+	_, ok = values["fds.usage"]
+	c.Assert(ok, Equals, false)
+}
+
+func (self *ProcessMetricsSuite) TestUnlimitedOpenFiles(c *C) {
+	file := path.Join(procDir, "limits")
+	c.Assert(ioutil.WriteFile(file, []byte("Max open files            unlimited            unlimited            files\n"), 0644), IsNil)
+	c.Assert(openFilesLimit(file), Equals, 0)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+	. "utils"
+)
+
+type ProcessRestartsSuite struct{}
+
+var _ = Suite(&ProcessRestartsSuite{})
+
+func restartPolicy(maxRestarts int) *Process {
+	return &Process{
+		Nickname:          "worker",
+		MaxRestarts:       maxRestarts,
+		RestartWindow:     10 * time.Minute,
+		RestartBackoff:    10 * time.Second,
+		MaxRestartBackoff: 30 * time.Second,
+		FlapThreshold:     3,
+	}
+}
+
+func (self *ProcessRestartsSuite) TestBackoff(c *C) {
+	process := restartPolicy(0)
+	c.Assert(restartBackoff(process, 1), Equals, 10*time.Second)
+	c.Assert(restartBackoff(process, 2), Equals, 20*time.Second)
+	c.Assert(restartBackoff(process, 3), Equals, 30*time.Second)
+	c.Assert(restartBackoff(process, 10), Equals, 30*time.Second)
+
+	restarts := NewProcessRestarts()
+	now := time.Now()
+	restart, _ := restarts.ShouldRestart(process, now)
+	c.Assert(restart, Equals, true)
+	restarts.Restarted(process, now)
+
+	restart, _ = restarts.ShouldRestart(process, now.Add(5*time.Second))
+	c.Assert(restart, Equals, false)
+	restart, _ = restarts.ShouldRestart(process, now.Add(10*time.Second))
+	c.Assert(restart, Equals, true)
+	restarts.Restarted(process, now.Add(10*time.Second))
+
+	// the second restart doubles the backoff
+	restart, _ = restarts.ShouldRestart(process, now.Add(20*time.Second))
+	c.Assert(restart, Equals, false)
+	restart, _ = restarts.ShouldRestart(process, now.Add(30*time.Second))
+	c.Assert(restart, Equals, true)
+	c.Assert(restarts.Count(process, now.Add(30*time.Second)), Equals, 2)
+}
+
+func (self *ProcessRestartsSuite) TestGiveUp(c *C) {
+	process := restartPolicy(2)
+	restarts := NewProcessRestarts()
+	now := time.Now()
+
+	restarts.Restarted(process, now)
+	restarts.Restarted(process, now.Add(time.Minute))
+
+	restart, gaveUp := restarts.ShouldRestart(process, now.Add(2*time.Minute))
+	c.Assert(restart, Equals, false)
+	c.Assert(gaveUp, Equals, true)
+
+	// the agent gives up only once
+	restart, gaveUp = restarts.ShouldRestart(process, now.Add(3*time.Minute))
+	c.Assert(restart, Equals, false)
+	c.Assert(gaveUp, Equals, false)
+
+	// and tries again once the restarts are out of the window
+	restart, gaveUp = restarts.ShouldRestart(process, now.Add(11*time.Minute))
+	c.Assert(restart, Equals, true)
+	c.Assert(gaveUp, Equals, false)
+}
+
+func (self *ProcessRestartsSuite) TestFlapping(c *C) {
+	process := restartPolicy(0)
+	restarts := NewProcessRestarts()
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		flapping, _ := restarts.Transition(process, DOWN, now.Add(time.Duration(i)*time.Minute))
+		c.Assert(flapping, Equals, false)
+		restarts.Transition(process, UP, now.Add(time.Duration(i)*time.Minute))
+	}
+
+	flapping, started := restarts.Transition(process, DOWN, now.Add(2*time.Minute))
+	c.Assert(flapping, Equals, true)
+	c.Assert(started, Equals, true)
+
+	flapping, started = restarts.Transition(process, UP, now.Add(3*time.Minute))
+	c.Assert(flapping, Equals, true)
+	c.Assert(started, Equals, false)
+
+	flapping, _ = restarts.Transition(process, DOWN, now.Add(20*time.Minute))
+	c.Assert(flapping, Equals, false)
+}
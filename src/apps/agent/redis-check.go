@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// builtin replacement of the redis plugin, it sends INFO to the redis
+// instance and reports every numeric field to plugins.redis.<field>, the
+// keyspace section is reported to plugins.redis.<db>.<keys|expires|avg_ttl>
+//
+// Arguments:
+//   host, port: the address of the redis server (default localhost:6379)
+//   socket:     the unix socket of the redis server, takes precedence over host and port
+//   password:   sent with AUTH before INFO if not empty
+//   timeout:    connection and read timeout (default 5s)
+
+const (
+	REDIS_DEFAULT_HOST    = "localhost"
+	REDIS_DEFAULT_PORT    = "6379"
+	REDIS_DEFAULT_TIMEOUT = 5 * time.Second
+)
+
+func init() {
+	RegisterBuiltinPlugin(func() BuiltinPlugin { return &RedisCheck{} },
+		"total_connections_received",
+		"total_commands_processed",
+		"keyspace_hits",
+		"keyspace_misses",
+		"expired_keys",
+		"evicted_keys",
+		"rejected_connections",
+	)
+}
+
+type RedisCheck struct {
+	network  string
+	address  string
+	password string
+	timeout  time.Duration
+}
+
+func (self *RedisCheck) Name() string {
+	return "redis"
+}
+
+func (self *RedisCheck) Configure(args map[string]string) error {
+	timeout, err := parseDurationArg(args, "timeout", REDIS_DEFAULT_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	self.network = "tcp"
+	self.address = net.JoinHostPort(REDIS_DEFAULT_HOST, REDIS_DEFAULT_PORT)
+	self.timeout = timeout
+
+	if socket := args["socket"]; socket != "" {
+		self.network = "unix"
+		self.address = socket
+	} else if args["host"] != "" || args["port"] != "" {
+		host, port := args["host"], args["port"]
+		if host == "" {
+			host = REDIS_DEFAULT_HOST
+		}
+		if port == "" {
+			port = REDIS_DEFAULT_PORT
+		}
+		self.address = net.JoinHostPort(host, port)
+	}
+
+	self.password = args["password"]
+	return nil
+}
+
+func (self *RedisCheck) ShouldMonitor() bool {
+	if err := self.Configure(nil); err != nil {
+		return false
+	}
+	conn, err := net.DialTimeout(self.network, self.address, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (self *RedisCheck) Collect() (*PluginOutput, error) {
+	info, err := self.info()
+	if err != nil {
+		return &PluginOutput{
+			state: CRITICAL,
+			msg:   fmt.Sprintf("Critical: redis instance at %s isn't running. Error: %s", self.address, err),
+		}, nil
+	}
+
+	fields, keyspace := parseRedisInfo(info)
+
+	metrics := make(map[string]float64)
+	for name, value := range fields {
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			metrics[name] = number
+		}
+	}
+	for db, stats := range keyspace {
+		for name, value := range stats {
+			metrics[db+"."+name] = value
+		}
+	}
+
+	msg := fmt.Sprintf("Ok: redis %s is running", fields["redis_version"])
+	return &PluginOutput{state: OK, msg: msg, metrics: metrics, timestamp: time.Now()}, nil
+}
+
+func (self *RedisCheck) info() (string, error) {
+	conn, err := net.DialTimeout(self.network, self.address, self.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(self.timeout))
+
+	reader := bufio.NewReader(conn)
+
+	if self.password != "" {
+		if _, err := redisCommand(conn, reader, "AUTH", self.password); err != nil {
+			return "", err
+		}
+	}
+
+	return redisCommand(conn, reader, "INFO")
+}
+
+// send a command using the unified request protocol and read the reply,
+// see http://redis.io/topics/protocol
+func redisCommand(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	request := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		request += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return "", err
+	}
+	return readRedisReply(reader)
+}
+
+func readRedisReply(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return "", fmt.Errorf("Empty reply from redis")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("Redis error: %s", line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if length < 0 {
+			return "", nil
+		}
+		buffer := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			return "", err
+		}
+		return string(buffer[:length]), nil
+	default:
+		return "", fmt.Errorf("Unsupported redis reply '%s'", line)
+	}
+}
+
+// parse the output of INFO into a map of fields and a map of per
+// database keyspace statistics
+func parseRedisInfo(info string) (map[string]string, map[string]map[string]float64) {
+	fields := make(map[string]string)
+	keyspace := make(map[string]map[string]float64)
+	section := ""
+
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			section = strings.ToLower(strings.TrimSpace(line[1:]))
+			continue
+		}
+
+		nameAndValue := strings.SplitN(line, ":", 2)
+		if len(nameAndValue) != 2 {
+			continue
+		}
+		name, value := nameAndValue[0], nameAndValue[1]
+
+		// older versions of redis don't have sections, but databases
+		// are always called db<n>
+		if section == "keyspace" || strings.HasPrefix(name, "db") && strings.Contains(value, "keys=") {
+			stats := make(map[string]float64)
+			for _, stat := range strings.Split(value, ",") {
+				statNameAndValue := strings.SplitN(stat, "=", 2)
+				if len(statNameAndValue) != 2 {
+					continue
+				}
+				if number, err := strconv.ParseFloat(statNameAndValue[1], 64); err == nil {
+					stats[statNameAndValue[0]] = number
+				}
+			}
+			keyspace[name] = stats
+			continue
+		}
+
+		fields[name] = value
+	}
+	return fields, keyspace
+}
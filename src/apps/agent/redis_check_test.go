@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net"
+	"strings"
+	"sync"
+)
+
+type RedisCheckSuite struct {
+	listener net.Listener
+	// guards the password and info, the server reads them while the tests change them
+	lock     sync.Mutex
+	password string
+	info     string
+}
+
+var _ = Suite(&RedisCheckSuite{})
+
+const REDIS_INFO = `# Server
+redis_version:2.6.10
+redis_mode:standalone
+uptime_in_seconds:340305
+
+# Clients
+connected_clients:1
+blocked_clients:0
+
+# Memory
+used_memory:845760
+used_memory_human:825.94K
+mem_fragmentation_ratio:2.44
+
+# Stats
+total_connections_received:1728
+total_commands_processed:1727
+
+# Keyspace
+db0:keys=3,expires=1,avg_ttl=0
+db2:keys=10,expires=0
+`
+
+/* Mocks */
+
+// a tiny redis server that understands AUTH and INFO
+func (self *RedisCheckSuite) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	self.lock.Lock()
+	password, info := self.password, self.info
+	self.lock.Unlock()
+	authenticated := password == ""
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var count int
+		fmt.Sscanf(line, "*%d", &count)
+		args := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			reader.ReadString('\n') // length
+			arg, _ := reader.ReadString('\n')
+			args = append(args, strings.TrimRight(arg, "\r\n"))
+		}
+
+		switch {
+		case len(args) == 2 && args[0] == "AUTH" && args[1] == password:
+			authenticated = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case len(args) > 0 && args[0] == "AUTH":
+			fmt.Fprint(conn, "-ERR invalid password\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case len(args) > 0 && args[0] == "INFO":
+			info := strings.Replace(info, "\n", "\r\n", -1)
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(info), info)
+		default:
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+func (self *RedisCheckSuite) SetUpTest(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	self.listener = listener
+	self.setPassword("")
+	self.lock.Lock()
+	self.info = REDIS_INFO
+	self.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go self.serve(conn)
+		}
+	}()
+}
+
+func (self *RedisCheckSuite) TearDownTest(c *C) {
+	self.listener.Close()
+}
+
+func (self *RedisCheckSuite) setPassword(password string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.password = password
+}
+
+func (self *RedisCheckSuite) args() map[string]string {
+	host, port, _ := net.SplitHostPort(self.listener.Addr().String())
+	return map[string]string{"host": host, "port": port}
+}
+
+/* Tests */
+
+func (self *RedisCheckSuite) TestCollectingInfo(c *C) {
+	check := &RedisCheck{}
+	c.Assert(check.Configure(self.args()), IsNil)
+	output, err := check.Collect()
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, OK)
+	c.Assert(output.msg, Equals, "Ok: redis 2.6.10 is running")
+	c.Assert(output.metrics, DeepEquals, map[string]float64{
+		"uptime_in_seconds":          340305,
+		"connected_clients":          1,
+		"blocked_clients":            0,
+		"used_memory":                845760,
+		"mem_fragmentation_ratio":    2.44,
+		"total_connections_received": 1728,
+		"total_commands_processed":   1727,
+		"db0.keys":                   3,
+		"db0.expires":                1,
+		"db0.avg_ttl":                0,
+		"db2.keys":                   10,
+		"db2.expires":                0,
+	})
+}
+
+func (self *RedisCheckSuite) TestAuthentication(c *C) {
+	self.setPassword("secret")
+
+	check := &RedisCheck{}
+	c.Assert(check.Configure(self.args()), IsNil)
+	output, err := check.Collect()
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, CRITICAL)
+
+	args := self.args()
+	args["password"] = "secret"
+	c.Assert(check.Configure(args), IsNil)
+	output, err = check.Collect()
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, OK)
+	c.Assert(output.metrics["connected_clients"], Equals, 1.0)
+}
+
+func (self *RedisCheckSuite) TestRedisDown(c *C) {
+	args := self.args()
+	self.listener.Close()
+
+	check := &RedisCheck{}
+	c.Assert(check.Configure(args), IsNil)
+	output, err := check.Collect()
+	c.Assert(err, IsNil)
+	c.Assert(output.state, Equals, CRITICAL)
+}
+
+func (self *RedisCheckSuite) TestParsingInfoWithoutSections(c *C) {
+	fields, keyspace := parseRedisInfo("redis_version:2.4.17\r\nconnected_clients:2\r\ndb0:keys=5,expires=0\r\n")
+	c.Assert(fields["connected_clients"], Equals, "2")
+	c.Assert(keyspace["db0"], DeepEquals, map[string]float64{"keys": 5, "expires": 0})
+}
@@ -59,9 +59,38 @@ log-file: /data/errplane-agent/shared/log.txt # the log file of the agent
 log-level: info                               # debug, info, warn, error
 top-n-processes: 5                            # For processes stats the agent will report the top n processes (by memory and cpu usage)
 top-n-sleep:     1m                           # Sampling frequency of the top n processes
+# top-n-aggregate-by: [pid]                     # report the top n processes (pid) or group them by name, user or tree (a process and its children)
+# top-n-max-series: 100                         # maximum number of groups reported for each aggregation, the others are reported as "other"
 monitored-sleep: 10s                          # Sampling frequency of the monitored processes
+# proc-connector: false                         # get notified when monitored processes exit using the linux proc connector (requires root)
 config-service:  %s											      # the location of the configuration service
 
+# plugins-public-key: /etc/errplane-agent/plugins.pem # verify the signature of downloaded plugins with this RSA public key
+# plugins-retained-versions: 3                        # number of plugins versions kept on disk for rollbacks
+# max-concurrent-plugins: 10                          # maximum number of plugins running at the same time
+# auto-discover-plugins: false                        # run the plugins detected on this server even if they aren't enabled
+
+# plugins-sandbox:                  # restrictions applied to the plugins processes
+#   user: nobody                    # run the plugins as this user, requires the agent to run as root
+#   working-directory: /tmp         # default is the plugin directory
+#   environment:                    # plugins only get PATH, HOME, USER, LOGNAME, LANG and these variables
+#     FOO: bar
+#   max-cpu-time: 30s
+#   max-memory: 512                 # in megabytes
+#   max-open-files: 256
+#   max-file-size: 10               # in megabytes
+#   max-output: 65536               # in bytes, the rest of the plugin output is ignored
+#   plugins:                        # per plugin overrides of the above settings
+#     redis:
+#       user: redis
+
+# maintenance-windows:              # suppress restarts, process events and anomalies during recurring windows
+#   - name: backups                 # optional, default is the schedule
+#     schedule: "0 3 * * 0"         # when the window starts: minute hour day-of-month month day-of-week, or @daily, @weekly...
+#     duration: 2h
+#     processes: [mysqld]           # the windows apply to the whole host if no process or plugin is given
+#     plugins: [mysql]
+
 # processes:
 #   - name:   mysqld
 #     start:  service mysql start             # the command to run to start the service
@@ -69,6 +98,7 @@ config-service:  %s											      # the location of the configuration service
 #     status: name                            # check the status of the process using the specified method:
 #     regex: .*ruby.*status-monitor.*         # see 'status' above
 #     user:   root                            # the agent will run the start and stop command using 'sudo -u username command-to-run'
+#     depends-on: [nfs]                       # nicknames of the processes that must be up before this one is started
 
 # enabled-plugins:
 #   - name: redis       # the name of the plugin
@@ -52,31 +52,25 @@ func main() {
 	}
 
 	for procIdx, proc := range monitoredProcesses {
-		startCmdFields := strings.Fields(proc.StartCmd)
-		startCmdPath, err := exec.LookPath(startCmdFields[0])
+		startCmd, err := sudoersCommand(proc.StartCmd)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Cannot find executable %s on path\n", startCmdFields[0])
+			fmt.Fprintf(os.Stderr, "%s\n", err)
 			os.Exit(1)
 		}
-		startCmdFields[0] = startCmdPath
-		startCmd := strings.Join(startCmdFields, " ")
-
-		stopCmd := ""
-		if proc.StopCmd != "" {
-			stopCmdFields := strings.Fields(proc.StopCmd)
-			stopCmdPath, err := exec.LookPath(stopCmdFields[0])
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Cannot find executable %s on path\n", startCmdFields[0])
-				os.Exit(1)
-			}
-			stopCmdFields[0] = stopCmdPath
-			stopCmd = strings.Join(stopCmdFields, " ")
+
+		// the agent kills the process when it doesn't have a stop command
+		stopCmd := Command{"kill"}
+		if len(proc.StopCmd) > 0 && !(len(proc.StopCmd) == 1 && proc.StopCmd[0] == "kill") {
+			stopCmd = proc.StopCmd
+		}
+		stopCmdLine, err := sudoersCommand(stopCmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
 		}
 
 		fmt.Fprintf(errplaneSection, "\t(%s) NOPASSWD: %s", proc.User, startCmd)
-		if stopCmd != "" {
-			fmt.Fprintf(errplaneSection, ", \\\n\t(%s) NOPASSWD: %s", proc.User, stopCmd)
-		}
+		fmt.Fprintf(errplaneSection, ", \\\n\t(%s) NOPASSWD: %s", proc.User, stopCmdLine)
 
 		if procIdx < len(monitoredProcesses)-1 {
 			fmt.Fprintf(errplaneSection, ", \\\n")
@@ -129,6 +123,27 @@ func main() {
 	os.Exit(0)
 }
 
+// the command with the absolute path of the executable, the kill command
+// is allowed with any argument
+func sudoersCommand(command Command) (string, error) {
+	if len(command) == 0 {
+		return "", fmt.Errorf("Empty command")
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return "", fmt.Errorf("Cannot find executable %s on path", command[0])
+	}
+
+	args := []string{path}
+	for _, arg := range command[1:] {
+		for _, special := range []string{"\\", ",", ":", "="} {
+			arg = strings.Replace(arg, special, "\\"+special, -1)
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " "), nil
+}
+
 func removeErrplaneSection(content string) string {
 	lines := strings.Split(content, "\n")
 	newLines := make([]string, 0)
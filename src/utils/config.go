@@ -26,6 +26,28 @@ type Config struct {
 	LogLevel          string `yaml:"log-level"`
 	ConfigService     string `yaml:"config-service"`
 	TopNProcesses     int    `yaml:"top-n-processes"`
+	// report the top n processes individually (pid) or grouped by name,
+	// user or process tree, the groups beyond top-n-max-series are
+	// reported as "other"
+	TopNAggregateBy []string `yaml:"top-n-aggregate-by,flow"`
+	TopNMaxSeries   int      `yaml:"top-n-max-series"`
+
+	// use the linux proc connector to notice the exits of the monitored
+	// processes between two polls
+	ProcConnector bool `yaml:"proc-connector"`
+
+	// plugins installation
+	PluginsPublicKey        string `yaml:"plugins-public-key"`
+	PluginsRetainedVersions int    `yaml:"plugins-retained-versions"`
+	MaxConcurrentPlugins    int    `yaml:"max-concurrent-plugins"`
+
+	// plugins execution
+	PluginsSandbox      PluginSandbox `yaml:"plugins-sandbox"`
+	AutoDiscoverPlugins bool          `yaml:"auto-discover-plugins"`
+
+	// recurring windows during which restarts, process events and
+	// anomalies aren't reported, the config service can add more windows
+	MaintenanceWindows []*MaintenanceWindow `yaml:"maintenance-windows"`
 
 	// aggregator configuration
 	Percentiles      []float64     `yaml:"percentiles,flow"`
@@ -78,6 +100,39 @@ func InitConfig(path string) error {
 	if err != nil {
 		return err
 	}
+
+	if len(AgentConfig.TopNAggregateBy) == 0 {
+		AgentConfig.TopNAggregateBy = []string{"pid"}
+	}
+	for _, aggregation := range AgentConfig.TopNAggregateBy {
+		switch aggregation {
+		case "pid", "name", "user", "tree":
+		default:
+			return fmt.Errorf("Unknown top-n-aggregate-by '%s', must be one of pid, name, user or tree", aggregation)
+		}
+	}
+
+	if AgentConfig.TopNMaxSeries <= 0 {
+		AgentConfig.TopNMaxSeries = 100
+	}
+
+	if AgentConfig.PluginsRetainedVersions <= 0 {
+		AgentConfig.PluginsRetainedVersions = 3
+	}
+
+	if AgentConfig.MaxConcurrentPlugins <= 0 {
+		AgentConfig.MaxConcurrentPlugins = 10
+	}
+
+	if err := AgentConfig.PluginsSandbox.parse(); err != nil {
+		return err
+	}
+
+	for _, window := range AgentConfig.MaintenanceWindows {
+		if err := window.Parse(); err != nil {
+			return fmt.Errorf("Invalid maintenance window '%s'. Error: %s", window.Name, err)
+		}
+	}
 	// for _, process := range AgentConfig.MonitoredProcesses {
 	// 	process.CompiledRegex, err = regexp.Compile(process.Regex)
 	// 	if err != nil {
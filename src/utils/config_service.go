@@ -8,14 +8,13 @@ import (
 	"github.com/errplane/errplane-go-common/monitoring"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"os/exec"
-	"path"
 )
 
 const (
 	PLUGINS_DIR        = "/data/errplane-agent/shared/plugins"
 	CUSTOM_PLUGINS_DIR = "/data/errplane-agent/shared/custom-plugins"
+	PLUGINS_DEPS_DIR   = "/data/errplane-agent/shared/plugins-dependencies"
+	AGENT_STATE_DIR    = "/data/errplane-agent/shared/state"
 )
 
 type PluginInformation struct {
@@ -32,13 +31,24 @@ type PluginInformation struct {
 }
 
 type AgentConfiguration struct {
-	Plugins   map[string][]*Instance `json:"plugins"`
-	Processes []*Process             `json:"processes"`
+	Plugins            map[string][]*Instance `json:"plugins"`
+	Processes          []*Process             `json:"processes"`
+	MaintenanceWindows []*MaintenanceWindow   `json:"maintenance-windows"`
 }
 
 type AgentStatus struct {
-	Plugins   []string `json:"plugins"`
-	Timestamp int64    `json:"timestamp"`
+	Plugins    []string                    `json:"plugins"`
+	Detections map[string]*PluginDetection `json:"detections"`
+	Timestamp  int64                       `json:"timestamp"`
+}
+
+// the result of a plugin should_monitor check, reason is the first line
+// printed by should_monitor or the reason it failed. Instances are the
+// instances discovered by should_monitor, e.g. one per mysql port.
+type PluginDetection struct {
+	Available bool        `json:"available"`
+	Reason    string      `json:"reason"`
+	Instances []*Instance `json:"instances,omitempty"`
 }
 
 var AgentInfo *AgentConfiguration
@@ -122,49 +132,6 @@ func GetMonitoringConfig() (*monitoring.MonitorConfig, error) {
 	return monitoring.ParseMonitorConfig(string(body), false)
 }
 
-func GetInstalledPluginsVersion() (string, error) {
-	version, err := ioutil.ReadFile(path.Join(PLUGINS_DIR, "version"))
-	if err != nil {
-		return "", err
-	}
-	return string(version), nil
-}
-
-func InstallPlugin(version string) {
-	database := AgentConfig.Database()
-	url := configServerUrl("/databases/%s/plugins/%s", database, version)
-	plugins, err := GetBody(url)
-	if err != nil {
-		log.Error("Cannot download plugin version from url '%s'. Error: %s", url, err)
-		return
-	}
-
-	filename := path.Join(PLUGINS_DIR, version+".tar.gz")
-	if err := ioutil.WriteFile(filename, plugins, 0644); err != nil {
-		log.Error("Cannot write to %s. Error: %s", filename, err)
-		return
-	}
-	versionFilename := path.Join(PLUGINS_DIR, "version")
-	if err := ioutil.WriteFile(versionFilename, []byte(version), 0644); err != nil {
-		log.Error("Cannot write to %s. Error: %s", filename, err)
-		return
-	}
-
-	dir := path.Join(PLUGINS_DIR, version)
-	err = os.Mkdir(dir, 0755)
-	if err != nil {
-		log.Error("Cannot create directory '%s'", dir)
-		return
-	}
-	cmd := exec.Command("tar", "-xvzf", filename)
-	cmd.Dir = dir
-	err = cmd.Run()
-	if err != nil {
-		log.Error("Cannot extract %s. Error: %s", filename, err)
-		return
-	}
-}
-
 func GetCurrentPluginsVersion() (string, error) {
 	database := AgentConfig.Database()
 	url := configServerUrl("/databases/%s/plugins/current_version", database)
@@ -193,8 +160,29 @@ func GetMonitoredProcesses(processes []*Process) ([]*Process, error) {
 			process.User = "root"
 		}
 
-		if process.StartCmd == "" {
-			process.StartCmd = fmt.Sprintf("service %s start", process.Nickname)
+		if err := validateStatusCheck(process); err != nil {
+			log.Error("Cannot monitor process %s. Error: %s", process.Nickname, err)
+			continue
+		}
+
+		if len(process.StartCmd) == 0 && process.StatusCmd == "systemd" {
+			process.StartCmd = Command{"systemctl", "start", process.Unit}
+		} else if len(process.StartCmd) == 0 {
+			process.StartCmd = Command{"service", process.Nickname, "start"}
+		}
+
+		if err := process.parse(); err != nil {
+			log.Error("Invalid restart policy or command timeout for process %s. Error: %s", process.Nickname, err)
+			continue
+		}
+
+		if process.MinInstances <= 0 {
+			process.MinInstances = 1
+		}
+
+		if process.MaxInstances > 0 && process.MaxInstances < process.MinInstances {
+			log.Error("Process %s has max-instances %d lower than min-instances %d, ignoring max-instances", process.Nickname, process.MaxInstances, process.MinInstances)
+			process.MaxInstances = 0
 		}
 
 		if p := processesMap[process.Nickname]; p != nil {
@@ -202,7 +190,72 @@ func GetMonitoredProcesses(processes []*Process) ([]*Process, error) {
 		}
 		returnedProcesses = append(returnedProcesses, process)
 	}
-	return returnedProcesses, nil
+	return sortByDependencies(returnedProcesses), nil
+}
+
+// order the processes so that the dependencies of a process come before
+// it, unknown dependencies and dependencies that create a cycle are
+// ignored
+func sortByDependencies(processes []*Process) []*Process {
+	const (
+		visiting = iota + 1
+		visited
+	)
+
+	byNickname := make(map[string]*Process)
+	for _, process := range processes {
+		byNickname[process.Nickname] = process
+	}
+
+	sorted := make([]*Process, 0, len(processes))
+	state := make(map[*Process]int)
+	var visit func(process *Process)
+	visit = func(process *Process) {
+		state[process] = visiting
+		dependencies := make([]string, 0, len(process.DependsOn))
+		for _, nickname := range process.DependsOn {
+			dependency, ok := byNickname[nickname]
+			switch {
+			case !ok:
+				log.Error("Process %s depends on %s which isn't monitored, ignoring the dependency", process.Nickname, nickname)
+				continue
+			case state[dependency] == visiting:
+				log.Error("The dependency of %s on %s creates a cycle, ignoring the dependency", process.Nickname, nickname)
+				continue
+			case state[dependency] == 0:
+				visit(dependency)
+			}
+			dependencies = append(dependencies, nickname)
+		}
+		process.DependsOn = dependencies
+		state[process] = visited
+		sorted = append(sorted, process)
+	}
+
+	for _, process := range processes {
+		if state[process] == 0 {
+			visit(process)
+		}
+	}
+	return sorted
+}
+
+func validateStatusCheck(process *Process) error {
+	switch process.StatusCmd {
+	case "pidfile":
+		if process.PidFile == "" {
+			return fmt.Errorf("The pidfile status check requires a pidfile")
+		}
+	case "systemd":
+		if process.Unit == "" {
+			return fmt.Errorf("The systemd status check requires a unit")
+		}
+	case "port":
+		if process.Port <= 0 || process.Port > 65535 {
+			return fmt.Errorf("Invalid port %d", process.Port)
+		}
+	}
+	return nil
 }
 
 func GetPluginsToRun() (*AgentConfiguration, error) {
@@ -221,5 +274,30 @@ func GetPluginsToRun() (*AgentConfiguration, error) {
 		return nil, err
 	}
 	log.Debug("Parsed response: %v", config)
+	validateInstances(config)
 	return config, nil
 }
+
+// the invalid intervals and timeouts of the instances are reported once
+// and replaced by the defaults of the plugins
+func validateInstances(config *AgentConfiguration) {
+	for plugin, instances := range config.Plugins {
+		for _, instance := range instances {
+			if instance == nil {
+				continue
+			}
+			if instance.Interval != "" {
+				if _, err := ParsePositiveDuration(instance.Interval); err != nil {
+					log.Error("Invalid interval '%s' for plugin %s. Error: %s", instance.Interval, plugin, err)
+					instance.Interval = ""
+				}
+			}
+			if instance.Timeout != "" {
+				if _, err := ParsePositiveDuration(instance.Timeout); err != nil {
+					log.Error("Invalid timeout '%s' for plugin %s. Error: %s", instance.Timeout, plugin, err)
+					instance.Timeout = ""
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type ConfigServiceSuite struct{}
+
+var _ = Suite(&ConfigServiceSuite{})
+
+func (self *ConfigServiceSuite) TestInvalidInstanceDurations(c *C) {
+	config := &AgentConfiguration{
+		Plugins: map[string][]*Instance{
+			"redis": []*Instance{
+				{Name: "valid", Interval: "30s", Timeout: "10s"},
+				{Name: "zero", Interval: "0s", Timeout: "-1s"},
+				{Name: "invalid", Interval: "often", Timeout: "10s"},
+				nil,
+			},
+		},
+	}
+	validateInstances(config)
+
+	instances := config.Plugins["redis"]
+	c.Assert(instances[0].Interval, Equals, "30s")
+	c.Assert(instances[0].Timeout, Equals, "10s")
+	c.Assert(instances[1].Interval, Equals, "")
+	c.Assert(instances[1].Timeout, Equals, "")
+	c.Assert(instances[2].Interval, Equals, "")
+	c.Assert(instances[2].Timeout, Equals, "10s")
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MAX_MAINTENANCE_WINDOW = 7 * 24 * time.Hour
+
+// A recurring maintenance window, it starts every time the cron schedule
+// matches and lasts Duration. Restarts, process events and anomaly reports
+// of the given processes and plugins are suppressed during the window, the
+// window applies to the whole host if no process or plugin is given.
+type MaintenanceWindow struct {
+	Name        string        `json:"name" yaml:"name"`
+	Schedule    string        `json:"schedule" yaml:"schedule"`
+	RawDuration string        `json:"duration" yaml:"duration"`
+	Duration    time.Duration `json:"-" yaml:"-"`
+	Processes   []string      `json:"processes,omitempty" yaml:"processes,flow"`
+	Plugins     []string      `json:"plugins,omitempty" yaml:"plugins,flow"`
+
+	schedule *cronSchedule
+}
+
+func (self *MaintenanceWindow) Parse() error {
+	var err error
+	if self.schedule, err = parseCronSchedule(self.Schedule); err != nil {
+		return err
+	}
+	if self.Duration, err = time.ParseDuration(self.RawDuration); err != nil {
+		return err
+	}
+	if self.Duration <= 0 || self.Duration > MAX_MAINTENANCE_WINDOW {
+		return fmt.Errorf("The duration of a maintenance window must be between 0 and %s", MAX_MAINTENANCE_WINDOW)
+	}
+	if self.Name == "" {
+		self.Name = self.Schedule
+	}
+	return nil
+}
+
+func (self *MaintenanceWindow) WholeHost() bool {
+	return len(self.Processes) == 0 && len(self.Plugins) == 0
+}
+
+// true if the window applies to the process with the given name or nickname
+func (self *MaintenanceWindow) AppliesToProcess(process *Process) bool {
+	if self.WholeHost() {
+		return true
+	}
+	for _, name := range self.Processes {
+		if name == process.Name || name == process.Nickname {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *MaintenanceWindow) AppliesToPlugin(plugin string) bool {
+	if self.WholeHost() {
+		return true
+	}
+	for _, name := range self.Plugins {
+		if name == plugin {
+			return true
+		}
+	}
+	return false
+}
+
+// the start of the window that includes now, windows that overlap are
+// merged by returning the latest start. Like NextStart it skips the
+// months, days and hours that don't match instead of every minute.
+func (self *MaintenanceWindow) ActiveSince(now time.Time) (time.Time, bool) {
+	t := now.Truncate(time.Minute)
+	for now.Sub(t) < self.Duration {
+		switch {
+		case !self.schedule.months.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !self.schedule.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !self.schedule.hours.has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !self.schedule.minutes.has(t.Minute()):
+			t = t.Add(-time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// the next time the window starts after now, returns false if the
+// schedule doesn't match in the next year, e.g. 0 0 30 2 *
+func (self *MaintenanceWindow) NextStart(now time.Time) (time.Time, bool) {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(1, 0, 0)
+	for t.Before(end) {
+		switch {
+		case !self.schedule.months.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !self.schedule.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !self.schedule.hours.has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !self.schedule.minutes.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+type cronField uint64
+
+func (self cronField) has(value int) bool {
+	return self&(1<<uint(value)) != 0
+}
+
+// a standard 5 fields cron schedule, minute hour day-of-month month
+// day-of-week
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays cronField
+	// the day matches if either the day of month or the day of week
+	// matches, unless one of them is *
+	anyDay, anyWeekday bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+func parseCronSchedule(schedule string) (*cronSchedule, error) {
+	if expanded, ok := cronMacros[strings.TrimSpace(schedule)]; ok {
+		schedule = expanded
+	}
+	fields := strings.Fields(schedule)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid schedule '%s', expected 5 fields: minute hour day-of-month month day-of-week", schedule)
+	}
+
+	parsed := &cronSchedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	var err error
+	if parsed.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if parsed.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if parsed.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if parsed.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if parsed.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// both 0 and 7 are sunday
+	if parsed.weekdays.has(7) {
+		parsed.weekdays |= 1
+	}
+	return parsed, nil
+}
+
+// parses a comma separated list of values, ranges (a-b) and steps (*/n or
+// a-b/n)
+func parseCronField(field string, min, max int) (cronField, error) {
+	var parsed cronField
+	for _, part := range strings.Split(field, ",") {
+		rangeAndStep := strings.SplitN(part, "/", 2)
+		step := 1
+		if len(rangeAndStep) == 2 {
+			var err error
+			if step, err = strconv.Atoi(rangeAndStep[1]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("Invalid step in '%s'", field)
+			}
+		}
+
+		from, to := min, max
+		if rangeAndStep[0] != "*" {
+			bounds := strings.SplitN(rangeAndStep[0], "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("Invalid value in '%s'", field)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("Invalid range in '%s'", field)
+				}
+			} else if len(rangeAndStep) == 2 {
+				// a/n means from a to the maximum every n
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", field, min, max)
+		}
+
+		for value := from; value <= to; value += step {
+			parsed |= 1 << uint(value)
+		}
+	}
+	return parsed, nil
+}
+
+func (self *cronSchedule) matchesDay(t time.Time) bool {
+	day := self.days.has(t.Day())
+	weekday := self.weekdays.has(int(t.Weekday()))
+	if self.anyDay || self.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+func (self *cronSchedule) matches(t time.Time) bool {
+	return self.minutes.has(t.Minute()) &&
+		self.hours.has(t.Hour()) &&
+		self.months.has(int(t.Month())) &&
+		self.matchesDay(t)
+}
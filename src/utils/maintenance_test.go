@@ -0,0 +1,117 @@
+package utils
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type MaintenanceSuite struct{}
+
+var _ = Suite(&MaintenanceSuite{})
+
+func (self *MaintenanceSuite) TestParseCronSchedule(c *C) {
+	schedule, err := parseCronSchedule("*/15 1-3 * * 1,5")
+	c.Assert(err, IsNil)
+	c.Assert(schedule.minutes, Equals, cronField(1|1<<15|1<<30|1<<45))
+	c.Assert(schedule.hours, Equals, cronField(1<<1|1<<2|1<<3))
+	c.Assert(schedule.weekdays, Equals, cronField(1<<1|1<<5))
+
+	// 7 is also sunday
+	schedule, err = parseCronSchedule("0 0 * * 7")
+	c.Assert(err, IsNil)
+	c.Assert(schedule.weekdays.has(0), Equals, true)
+
+	for _, invalid := range []string{"* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "a * * * *", "* * 0 * *"} {
+		_, err := parseCronSchedule(invalid)
+		c.Assert(err, NotNil, Commentf("%s", invalid))
+	}
+}
+
+func (self *MaintenanceSuite) TestActiveSince(c *C) {
+	window := &MaintenanceWindow{Schedule: "30 2 * * 0", RawDuration: "2h"}
+	c.Assert(window.Parse(), IsNil)
+	c.Assert(window.Name, Equals, "30 2 * * 0")
+
+	// sunday 2:30 to 4:30
+	start := time.Date(2014, 3, 2, 2, 30, 0, 0, time.UTC)
+	since, active := window.ActiveSince(start.Add(90 * time.Minute))
+	c.Assert(active, Equals, true)
+	c.Assert(since, Equals, start)
+
+	_, active = window.ActiveSince(start.Add(-time.Minute))
+	c.Assert(active, Equals, false)
+	_, active = window.ActiveSince(start.Add(2 * time.Hour))
+	c.Assert(active, Equals, false)
+	_, active = window.ActiveSince(start.AddDate(0, 0, 1))
+	c.Assert(active, Equals, false)
+}
+
+func (self *MaintenanceSuite) TestActiveSinceMatchesEveryMinute(c *C) {
+	schedules := []string{"30 2 * * 0", "*/20 8-10 * * 1-5", "0 0 1 1 *", "0 0 1 * 1", "15 23 31 * *"}
+	for _, schedule := range schedules {
+		window := &MaintenanceWindow{Schedule: schedule, RawDuration: "168h"}
+		c.Assert(window.Parse(), IsNil)
+
+		for now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC); now.Year() == 2014; now = now.Add(613 * time.Minute) {
+			// the start of the window checking every minute
+			var expected time.Time
+			for start := now; now.Sub(start) < window.Duration; start = start.Add(-time.Minute) {
+				if window.schedule.matches(start) {
+					expected = start
+					break
+				}
+			}
+
+			since, active := window.ActiveSince(now)
+			c.Assert(active, Equals, !expected.IsZero(), Commentf("%s at %s", schedule, now))
+			c.Assert(since, Equals, expected, Commentf("%s at %s", schedule, now))
+		}
+	}
+}
+
+func (self *MaintenanceSuite) TestDayOfMonthOrDayOfWeek(c *C) {
+	// the 1st of the month or any monday
+	window := &MaintenanceWindow{Schedule: "0 0 1 * 1", RawDuration: "1m"}
+	c.Assert(window.Parse(), IsNil)
+
+	_, active := window.ActiveSince(time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(active, Equals, true)
+	_, active = window.ActiveSince(time.Date(2014, 3, 3, 0, 0, 0, 0, time.UTC))
+	c.Assert(active, Equals, true)
+	_, active = window.ActiveSince(time.Date(2014, 3, 4, 0, 0, 0, 0, time.UTC))
+	c.Assert(active, Equals, false)
+}
+
+func (self *MaintenanceSuite) TestNextStart(c *C) {
+	window := &MaintenanceWindow{Schedule: "@monthly", RawDuration: "1h"}
+	c.Assert(window.Parse(), IsNil)
+	next, ok := window.NextStart(time.Date(2014, 12, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(ok, Equals, true)
+	c.Assert(next, Equals, time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	window = &MaintenanceWindow{Schedule: "0 0 30 2 *", RawDuration: "1h"}
+	c.Assert(window.Parse(), IsNil)
+	_, ok = window.NextStart(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(ok, Equals, false)
+}
+
+func (self *MaintenanceSuite) TestInvalidDuration(c *C) {
+	for _, duration := range []string{"", "0s", "8d", "200h"} {
+		window := &MaintenanceWindow{Schedule: "@daily", RawDuration: duration}
+		c.Assert(window.Parse(), NotNil, Commentf("%s", duration))
+	}
+}
+
+func (self *MaintenanceSuite) TestAppliesTo(c *C) {
+	process := &Process{Name: "mysqld", Nickname: "mysql"}
+
+	window := &MaintenanceWindow{}
+	c.Assert(window.AppliesToProcess(process), Equals, true)
+	c.Assert(window.AppliesToPlugin("redis"), Equals, true)
+
+	window = &MaintenanceWindow{Processes: []string{"mysql"}, Plugins: []string{"mysql"}}
+	c.Assert(window.AppliesToProcess(process), Equals, true)
+	c.Assert(window.AppliesToProcess(&Process{Name: "nginx", Nickname: "nginx"}), Equals, false)
+	c.Assert(window.AppliesToPlugin("mysql"), Equals, true)
+	c.Assert(window.AppliesToPlugin("redis"), Equals, false)
+}
@@ -1,19 +1,49 @@
 package utils
 
+import (
+	"fmt"
+	"time"
+)
+
 type Instance struct {
-	Name     string
-	Args     map[string]string
+	Name     string            `json:"name"`
+	Args     map[string]string `json:"args,omitempty"`
 	ArgsList []string
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+const (
+	PLUGIN_MODE_ONESHOT   = "oneshot"
+	PLUGIN_MODE_STREAMING = "streaming"
+)
+
+// the interval and timeout of the plugins and instances must be positive
+func ParsePositiveDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("The duration must be positive")
+	}
+	return duration, nil
 }
 
 type PluginMetadata struct {
 	Name            string
-	Verion          string
+	Verion          string `yaml:"version"`
 	Output          string
-	HasDependencies bool     `yaml:"needs-dependencies"`
-	Path            string   `yaml:"-"`
-	IsCustom        bool     `yaml:"-"`
-	CalculateRates  []string `yaml:"calculate-rates"`
+	Mode            string
+	HasDependencies bool          `yaml:"needs-dependencies"`
+	Path            string        `yaml:"-"`
+	IsCustom        bool          `yaml:"-"`
+	IsBuiltin       bool          `yaml:"-"`
+	CalculateRates  []string      `yaml:"calculate-rates"`
+	RawInterval     string        `yaml:"interval"`
+	Interval        time.Duration `yaml:"-"`
+	RawTimeout      string        `yaml:"timeout"`
+	Timeout         time.Duration `yaml:"-"`
 }
 
 type Plugin struct {
@@ -22,3 +52,88 @@ type Plugin struct {
 	Instances []*Instance
 	Metadata  PluginMetadata
 }
+
+// Restrictions applied to the plugin processes, configured with
+// plugins-sandbox in the agent configuration. The settings in the
+// plugins section override the defaults for the given plugin.
+type PluginSandbox struct {
+	User             string
+	WorkingDirectory string            `yaml:"working-directory"`
+	Environment      map[string]string `yaml:"environment"`
+	RawMaxCpuTime    string            `yaml:"max-cpu-time"`
+	MaxCpuTime       time.Duration     `yaml:"-"`
+	MaxMemory        uint64            `yaml:"max-memory"`     // in megabytes
+	MaxOpenFiles     uint64            `yaml:"max-open-files"` // number of file descriptors
+	MaxFileSize      uint64            `yaml:"max-file-size"`  // in megabytes
+	MaxOutput        int               `yaml:"max-output"`     // in bytes
+
+	Plugins map[string]*PluginSandbox `yaml:"plugins"`
+}
+
+func (self *PluginSandbox) parse() error {
+	if self.RawMaxCpuTime != "" {
+		var err error
+		self.MaxCpuTime, err = time.ParseDuration(self.RawMaxCpuTime)
+		if err != nil {
+			return err
+		}
+	}
+	for _, sandbox := range self.Plugins {
+		if sandbox == nil {
+			continue
+		}
+		if err := sandbox.parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the sandbox of the given plugin, i.e. the defaults merged with the
+// plugin specific settings
+func (self *PluginSandbox) ForPlugin(name string) *PluginSandbox {
+	sandbox := &PluginSandbox{
+		User:             self.User,
+		WorkingDirectory: self.WorkingDirectory,
+		Environment:      make(map[string]string),
+		MaxCpuTime:       self.MaxCpuTime,
+		MaxMemory:        self.MaxMemory,
+		MaxOpenFiles:     self.MaxOpenFiles,
+		MaxFileSize:      self.MaxFileSize,
+		MaxOutput:        self.MaxOutput,
+	}
+	for key, value := range self.Environment {
+		sandbox.Environment[key] = value
+	}
+
+	override := self.Plugins[name]
+	if override == nil {
+		return sandbox
+	}
+
+	if override.User != "" {
+		sandbox.User = override.User
+	}
+	if override.WorkingDirectory != "" {
+		sandbox.WorkingDirectory = override.WorkingDirectory
+	}
+	for key, value := range override.Environment {
+		sandbox.Environment[key] = value
+	}
+	if override.MaxCpuTime != 0 {
+		sandbox.MaxCpuTime = override.MaxCpuTime
+	}
+	if override.MaxMemory != 0 {
+		sandbox.MaxMemory = override.MaxMemory
+	}
+	if override.MaxOpenFiles != 0 {
+		sandbox.MaxOpenFiles = override.MaxOpenFiles
+	}
+	if override.MaxFileSize != 0 {
+		sandbox.MaxFileSize = override.MaxFileSize
+	}
+	if override.MaxOutput != 0 {
+		sandbox.MaxOutput = override.MaxOutput
+	}
+	return sandbox
+}
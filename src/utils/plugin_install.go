@@ -0,0 +1,413 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	log "code.google.com/p/log4go"
+	"compress/gzip"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	PLUGINS_VERSION_FILE     = "version"
+	PLUGINS_HISTORY_FILE     = "history"
+	PLUGINS_ROLLED_BACK_FILE = "rolled-back"
+)
+
+// overridden by the tests
+var pluginsDir = PLUGINS_DIR
+
+// install, rollback and pruning rename and remove the version
+// directories and rewrite the same files, only one of them can run at a
+// time
+var pluginsLock sync.Mutex
+
+func GetInstalledPluginsVersion() (string, error) {
+	version, err := ioutil.ReadFile(path.Join(pluginsDir, PLUGINS_VERSION_FILE))
+	if err != nil {
+		return "", err
+	}
+	return string(version), nil
+}
+
+// returns true if the given version was rolled back by the user and
+// shouldn't be installed again
+func IsRolledBackPluginsVersion(version string) bool {
+	rolledBack, err := ioutil.ReadFile(path.Join(pluginsDir, PLUGINS_ROLLED_BACK_FILE))
+	if err != nil {
+		return false
+	}
+	return string(rolledBack) == version
+}
+
+// Download, verify and extract the given plugins version. The version
+// becomes the active one only if all the previous steps succeeded,
+// otherwise the previously installed version is left untouched.
+func InstallPlugin(version string) error {
+	pluginsLock.Lock()
+	err := installPluginsVersion(version)
+	pluginsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	prunePluginsVersions()
+	return nil
+}
+
+func installPluginsVersion(version string) error {
+	if version == "" || version == "." || version == ".." || strings.Contains(version, "/") {
+		return fmt.Errorf("Invalid plugins version '%s'", version)
+	}
+	dir := path.Join(pluginsDir, version)
+
+	history, err := getPluginsHistory()
+	if err != nil {
+		return err
+	}
+
+	if containsString(history, version) {
+		if _, err := os.Stat(dir); err == nil {
+			log.Info("Plugins version %s is already extracted, activating it", version)
+			return activatePluginsVersion(version)
+		}
+	}
+
+	database := AgentConfig.Database()
+	url := configServerUrl("/databases/%s/plugins/%s", database, version)
+	bundle, err := GetBody(url)
+	if err != nil {
+		return fmt.Errorf("Cannot download plugin version from url '%s'. Error: %s", url, err)
+	}
+
+	if err := verifyPluginsBundle(version, bundle); err != nil {
+		return err
+	}
+
+	tempDir, err := ioutil.TempDir(pluginsDir, ".install-"+version+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := extractPluginsBundle(bundle, tempDir); err != nil {
+		return fmt.Errorf("Cannot extract plugins version %s. Error: %s", version, err)
+	}
+
+	// a directory that isn't in the history was left behind by an older
+	// agent and can't be trusted
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tempDir, dir); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := activatePluginsVersion(version); err != nil {
+		return err
+	}
+
+	log.Info("Installed plugins version %s", version)
+	return nil
+}
+
+// Switch back to the most recent previous version that is still on
+// disk. The current version is removed and won't be installed again
+// until the config service reports a different version.
+func RollbackPlugins() (string, error) {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+
+	history, err := getPluginsHistory()
+	if err != nil {
+		return "", err
+	}
+
+	current, err := GetInstalledPluginsVersion()
+	if err != nil {
+		return "", err
+	}
+
+	previous := ""
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i] == current {
+			continue
+		}
+		if _, err := os.Stat(path.Join(pluginsDir, history[i])); err == nil {
+			previous = history[i]
+			break
+		}
+	}
+
+	if previous == "" {
+		return "", fmt.Errorf("No previous plugins version to rollback to")
+	}
+
+	if err := writeFileAtomically(path.Join(pluginsDir, PLUGINS_ROLLED_BACK_FILE), []byte(current)); err != nil {
+		return "", err
+	}
+	if err := activatePluginsVersion(previous); err != nil {
+		return "", err
+	}
+	if err := setPluginsHistory(removeString(history, current)); err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(path.Join(pluginsDir, current)); err != nil {
+		log.Warn("Cannot remove plugins version %s. Error: %s", current, err)
+	}
+
+	log.Info("Rolled back plugins from version %s to %s", current, previous)
+	return previous, nil
+}
+
+func verifyPluginsBundle(version string, bundle []byte) error {
+	database := AgentConfig.Database()
+	url := configServerUrl("/databases/%s/plugins/%s/checksum", database, version)
+	checksum, err := GetBody(url)
+	digest := sha256.Sum256(bundle)
+	if err == nil {
+		if hex.EncodeToString(digest[:]) != strings.ToLower(strings.TrimSpace(string(checksum))) {
+			return fmt.Errorf("Checksum mismatch for plugins version %s", version)
+		}
+	} else if AgentConfig.PluginsPublicKey == "" {
+		return fmt.Errorf("Cannot download plugin checksum from url '%s'. Error: %s", url, err)
+	} else {
+		// the signature covers the digest of the bundle
+		log.Info("No checksum for plugins version %s, relying on its signature", version)
+	}
+
+	if AgentConfig.PluginsPublicKey == "" {
+		return nil
+	}
+
+	publicKey, err := readPublicKey(AgentConfig.PluginsPublicKey)
+	if err != nil {
+		return err
+	}
+
+	url = configServerUrl("/databases/%s/plugins/%s/signature", database, version)
+	encodedSignature, err := GetBody(url)
+	if err != nil {
+		return fmt.Errorf("Cannot download plugin signature from url '%s'. Error: %s", url, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedSignature)))
+	if err != nil {
+		return fmt.Errorf("Invalid signature for plugins version %s. Error: %s", version, err)
+	}
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("Signature verification failed for plugins version %s. Error: %s", version, err)
+	}
+	return nil
+}
+
+func readPublicKey(filename string) (*rsa.PublicKey, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s doesn't contain a PEM encoded key", filename)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't contain an RSA public key", filename)
+	}
+	return publicKey, nil
+}
+
+// Extract the gzipped tarball into dir, refusing any entry that would
+// end up outside of dir
+func extractPluginsBundle(bundle []byte, dir string) error {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(bundle))
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	reader := tar.NewReader(gzipReader)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := bundleEntryPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		if target == dir {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				return err
+			}
+			mode := os.FileMode(header.Mode).Perm() & 0755
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, reader)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// relative links without '..' can only point inside the bundle
+			if path.IsAbs(header.Linkname) || containsString(strings.Split(header.Linkname, "/"), "..") {
+				return fmt.Errorf("Symlink %s points outside of the bundle", header.Name)
+			}
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			log.Warn("Skipping %s, unsupported entry type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+func bundleEntryPath(dir, name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("Bundle entry %s has an absolute path", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("Bundle entry %s points outside of the bundle", name)
+	}
+	return path.Join(dir, cleaned), nil
+}
+
+func activatePluginsVersion(version string) error {
+	// read before the version file changes, the history might be seeded
+	// with the installed version
+	history, err := getPluginsHistory()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(path.Join(pluginsDir, PLUGINS_VERSION_FILE), []byte(version)); err != nil {
+		return err
+	}
+	return setPluginsHistory(append(removeString(history, version), version))
+}
+
+// remove the versions that are older than the last
+// AgentConfig.PluginsRetainedVersions versions
+func prunePluginsVersions() {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+
+	history, err := getPluginsHistory()
+	if err != nil {
+		log.Error("Cannot read plugins history. Error: %s", err)
+		return
+	}
+
+	retained := AgentConfig.PluginsRetainedVersions
+	if len(history) <= retained {
+		return
+	}
+
+	for _, version := range history[:len(history)-retained] {
+		log.Info("Removing old plugins version %s", version)
+		if err := os.RemoveAll(path.Join(pluginsDir, version)); err != nil {
+			log.Error("Cannot remove plugins version %s. Error: %s", version, err)
+		}
+	}
+
+	if err := setPluginsHistory(history[len(history)-retained:]); err != nil {
+		log.Error("Cannot write plugins history. Error: %s", err)
+	}
+}
+
+// returns the installed versions ordered by activation time, the active
+// version is the last one
+func getPluginsHistory() ([]string, error) {
+	content, err := ioutil.ReadFile(path.Join(pluginsDir, PLUGINS_HISTORY_FILE))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		// the agents that didn't keep a history only installed the current
+		// version, keep it so that it can be rolled back to and pruned
+		if version, err := GetInstalledPluginsVersion(); err == nil {
+			if _, err := os.Stat(path.Join(pluginsDir, version)); err == nil {
+				return []string{version}, nil
+			}
+		}
+		return nil, nil
+	}
+
+	history := make([]string, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			history = append(history, line)
+		}
+	}
+	return history, nil
+}
+
+func setPluginsHistory(history []string) error {
+	content := strings.Join(history, "\n") + "\n"
+	return writeFileAtomically(path.Join(pluginsDir, PLUGINS_HISTORY_FILE), []byte(content))
+}
+
+func writeFileAtomically(filename string, content []byte) error {
+	tempFile := filename + ".tmp"
+	if err := ioutil.WriteFile(tempFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, filename)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(values []string, value string) []string {
+	filtered := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != value {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
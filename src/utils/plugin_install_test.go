@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type PluginInstallSuite struct {
+	dir string
+}
+
+var _ = Suite(&PluginInstallSuite{})
+
+type bundleEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func createBundle(c *C, entries []bundleEntry) []byte {
+	buffer := bytes.NewBuffer(nil)
+	gzipWriter := gzip.NewWriter(buffer)
+	writer := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Mode:     0755,
+			Size:     int64(len(entry.content)),
+			Linkname: entry.linkname,
+		}
+		c.Assert(writer.WriteHeader(header), IsNil)
+		if entry.typeflag == tar.TypeReg {
+			_, err := writer.Write([]byte(entry.content))
+			c.Assert(err, IsNil)
+		}
+	}
+	c.Assert(writer.Close(), IsNil)
+	c.Assert(gzipWriter.Close(), IsNil)
+	return buffer.Bytes()
+}
+
+func (self *PluginInstallSuite) SetUpTest(c *C) {
+	var err error
+	self.dir, err = ioutil.TempDir(os.TempDir(), "plugins")
+	c.Assert(err, IsNil)
+}
+
+func (self *PluginInstallSuite) TearDownTest(c *C) {
+	os.RemoveAll(self.dir)
+}
+
+func (self *PluginInstallSuite) TestExtractingBundle(c *C) {
+	bundle := createBundle(c, []bundleEntry{
+		{"./", tar.TypeDir, "", ""},
+		{"./redis/", tar.TypeDir, "", ""},
+		{"./redis/info.yml", tar.TypeReg, "output: nagios\n", ""},
+		{"./redis/status", tar.TypeReg, "#!/bin/sh\n", ""},
+		{"./redis/should_monitor", tar.TypeSymlink, "", "status"},
+	})
+
+	c.Assert(extractPluginsBundle(bundle, self.dir), IsNil)
+	content, err := ioutil.ReadFile(path.Join(self.dir, "redis", "info.yml"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "output: nagios\n")
+	content, err = ioutil.ReadFile(path.Join(self.dir, "redis", "should_monitor"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "#!/bin/sh\n")
+}
+
+func (self *PluginInstallSuite) TestExtractingRejectsPathTraversal(c *C) {
+	for _, entry := range []bundleEntry{
+		{"../evil", tar.TypeReg, "evil", ""},
+		{"redis/../../evil", tar.TypeReg, "evil", ""},
+		{"/tmp/evil", tar.TypeReg, "evil", ""},
+		{"redis/link", tar.TypeSymlink, "", "../../etc"},
+		{"redis/link", tar.TypeSymlink, "", "/etc"},
+	} {
+		bundle := createBundle(c, []bundleEntry{entry})
+		c.Assert(extractPluginsBundle(bundle, self.dir), NotNil)
+	}
+
+	_, err := os.Stat(path.Join(path.Dir(self.dir), "evil"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+// serves the bundles, checksums and signatures of the given versions like
+// the config service
+func (self *PluginInstallSuite) startConfigService(c *C, bundles map[string][]byte, checksums bool, key *rsa.PrivateKey) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/databases/app/plugins/"), "/")
+		bundle, ok := bundles[parts[0]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		digest := sha256.Sum256(bundle)
+		switch {
+		case len(parts) == 1:
+			w.Write(bundle)
+		case parts[1] == "checksum" && checksums:
+			w.Write([]byte(hex.EncodeToString(digest[:])))
+		case parts[1] == "signature" && key != nil:
+			signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+			c.Assert(err, IsNil)
+			w.Write([]byte(base64.StdEncoding.EncodeToString(signature)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	AgentConfig.ConfigService = strings.TrimPrefix(server.URL, "http://")
+	return server
+}
+
+func (self *PluginInstallSuite) setUpInstall(c *C) func() {
+	previousConfig := AgentConfig
+	previousDir := pluginsDir
+	AgentConfig.AppKey = "app"
+	AgentConfig.Environment = ""
+	AgentConfig.PluginsRetainedVersions = 2
+	pluginsDir = self.dir
+	return func() {
+		AgentConfig = previousConfig
+		pluginsDir = previousDir
+	}
+}
+
+func (self *PluginInstallSuite) bundle(c *C, version string) []byte {
+	return createBundle(c, []bundleEntry{
+		{"./redis/", tar.TypeDir, "", ""},
+		{"./redis/status", tar.TypeReg, "#!/bin/sh\necho " + version + "\n", ""},
+	})
+}
+
+func (self *PluginInstallSuite) TestInstallRollbackAndPrune(c *C) {
+	defer self.setUpInstall(c)()
+
+	// installed by an agent that didn't keep a history
+	c.Assert(os.Mkdir(path.Join(self.dir, "1"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(self.dir, PLUGINS_VERSION_FILE), []byte("1"), 0644), IsNil)
+
+	bundles := map[string][]byte{"2": self.bundle(c, "2"), "3": self.bundle(c, "3"), "4": self.bundle(c, "4")}
+	server := self.startConfigService(c, bundles, true, nil)
+	defer server.Close()
+
+	c.Assert(InstallPlugin("2"), IsNil)
+	history, err := getPluginsHistory()
+	c.Assert(err, IsNil)
+	c.Assert(history, DeepEquals, []string{"1", "2"})
+
+	previous, err := RollbackPlugins()
+	c.Assert(err, IsNil)
+	c.Assert(previous, Equals, "1")
+	version, _ := GetInstalledPluginsVersion()
+	c.Assert(version, Equals, "1")
+	c.Assert(IsRolledBackPluginsVersion("2"), Equals, true)
+	_, err = os.Stat(path.Join(self.dir, "2"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(InstallPlugin("3"), IsNil)
+	c.Assert(InstallPlugin("4"), IsNil)
+	history, err = getPluginsHistory()
+	c.Assert(err, IsNil)
+	c.Assert(history, DeepEquals, []string{"3", "4"})
+	_, err = os.Stat(path.Join(self.dir, "1"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	content, err := ioutil.ReadFile(path.Join(self.dir, "4", "redis", "status"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "#!/bin/sh\necho 4\n")
+}
+
+func (self *PluginInstallSuite) TestMissingChecksum(c *C) {
+	defer self.setUpInstall(c)()
+
+	server := self.startConfigService(c, map[string][]byte{"1": self.bundle(c, "1")}, false, nil)
+	c.Assert(InstallPlugin("1"), ErrorMatches, "Cannot download plugin checksum.*")
+	_, err := GetInstalledPluginsVersion()
+	c.Assert(err, NotNil)
+	server.Close()
+
+	// the checksum isn't required when the bundles are signed
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	c.Assert(err, IsNil)
+	AgentConfig.PluginsPublicKey = path.Join(c.MkDir(), "plugins.pem")
+	c.Assert(ioutil.WriteFile(AgentConfig.PluginsPublicKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}), 0644), IsNil)
+
+	server = self.startConfigService(c, map[string][]byte{"1": self.bundle(c, "1")}, false, key)
+	defer server.Close()
+	c.Assert(InstallPlugin("1"), IsNil)
+	version, _ := GetInstalledPluginsVersion()
+	c.Assert(version, Equals, "1")
+}
+
+func (self *PluginInstallSuite) TestConcurrentInstalls(c *C) {
+	defer self.setUpInstall(c)()
+
+	bundles := map[string][]byte{"1": self.bundle(c, "1"), "2": self.bundle(c, "2"), "3": self.bundle(c, "3")}
+	server := self.startConfigService(c, bundles, true, nil)
+	defer server.Close()
+
+	errors := make(chan error)
+	for version := range bundles {
+		go func(version string) {
+			for i := 0; i < 5; i++ {
+				errors <- InstallPlugin(version)
+			}
+		}(version)
+	}
+	for i := 0; i < 5*len(bundles); i++ {
+		c.Assert(<-errors, IsNil)
+	}
+
+	version, err := GetInstalledPluginsVersion()
+	c.Assert(err, IsNil)
+	history, err := getPluginsHistory()
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 2)
+	c.Assert(history[1], Equals, version)
+	for _, version := range history {
+		_, err := os.Stat(path.Join(self.dir, version, "redis", "status"))
+		c.Assert(err, IsNil)
+	}
+}
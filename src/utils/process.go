@@ -1,19 +1,185 @@
 package utils
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
 type Status int
 
 const (
 	UP Status = iota
 	DOWN
+	// more instances than MaxInstances are running, the process is
+	// reported but not restarted
+	TOO_MANY_INSTANCES
+)
+
+const (
+	DEFAULT_RESTART_WINDOW      = 30 * time.Minute
+	DEFAULT_RESTART_BACKOFF     = 10 * time.Second
+	DEFAULT_MAX_RESTART_BACKOFF = 5 * time.Minute
+	DEFAULT_FLAP_THRESHOLD      = 5
+	DEFAULT_COMMAND_TIMEOUT     = 1 * time.Minute
 )
 
+// a command given either as a string, which is split like a shell would
+// without any expansion, or as an argv array
+type Command []string
+
+func (self *Command) UnmarshalJSON(data []byte) error {
+	argv := []string{}
+	if err := json.Unmarshal(data, &argv); err == nil {
+		*self = argv
+		return nil
+	}
+
+	var command string
+	if err := json.Unmarshal(data, &command); err != nil {
+		return fmt.Errorf("A command must be a string or an array of strings")
+	}
+	var err error
+	*self, err = ParseCommand(command)
+	return err
+}
+
+func (self Command) String() string {
+	quoted := make([]string, 0, len(self))
+	for _, arg := range self {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// split the command into arguments, single and double quotes group
+// arguments and a backslash escapes the next character except in single
+// quotes
+func ParseCommand(command string) (Command, error) {
+	argv := Command{}
+	arg := []rune{}
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, c := range command {
+		switch {
+		case escaped:
+			arg = append(arg, c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg = append(arg, c)
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				argv = append(argv, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+		default:
+			arg = append(arg, c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("Unterminated quote or escape in '%s'", command)
+	}
+	if inArg {
+		argv = append(argv, string(arg))
+	}
+	return argv, nil
+}
+
 type Process struct {
-	Name       string `json:"name"`
-	Regex      string `json:"regex"`
-	StartCmd   string `json:"start"`
-	StopCmd    string `json:"stop"`
-	StatusCmd  string `json:"status"`
-	User       string `json:"user"`
-	LastStatus Status `json:"-"`
-	Nickname   string `json:"nickname"`
+	Name       string  `json:"name"`
+	Regex      string  `json:"regex"`
+	StartCmd   Command `json:"start"`
+	StopCmd    Command `json:"stop"`
+	StatusCmd  string  `json:"status"`
+	User       string  `json:"user"`
+	LastStatus Status  `json:"-"`
+	Nickname   string  `json:"nickname"`
+	// used by the pidfile, systemd and port status checks
+	PidFile string `json:"pidfile"`
+	Unit    string `json:"unit"`
+	Port    int    `json:"port"`
+	// the process is up when the number of running instances is between
+	// MinInstances and MaxInstances, a MaxInstances of 0 means no maximum
+	MinInstances int `json:"min-instances"`
+	MaxInstances int `json:"max-instances"`
+	// restart policy, the agent gives up after MaxRestarts restarts in
+	// RestartWindow (0 means no limit) and waits RestartBackoff between
+	// restarts, doubling it up to MaxRestartBackoff after each restart.
+	// The process is flapping if it went down FlapThreshold times in
+	// RestartWindow.
+	MaxRestarts          int           `json:"max-restarts"`
+	RawRestartWindow     string        `json:"restart-window"`
+	RestartWindow        time.Duration `json:"-"`
+	RawRestartBackoff    string        `json:"restart-backoff"`
+	RestartBackoff       time.Duration `json:"-"`
+	RawMaxRestartBackoff string        `json:"max-restart-backoff"`
+	MaxRestartBackoff    time.Duration `json:"-"`
+	FlapThreshold        int           `json:"flap-threshold"`
+	// the maximum duration of the start and stop commands
+	RawCommandTimeout string        `json:"command-timeout"`
+	CommandTimeout    time.Duration `json:"-"`
+	// the nicknames of the processes that must be up before this process
+	// is started, they are started first and restarting one of them
+	// restarts this process too
+	DependsOn []string `json:"depends-on"`
+}
+
+// parse the restart policy and the command timeout and set their defaults
+func (self *Process) parse() error {
+	durations := []struct {
+		raw          string
+		value        *time.Duration
+		defaultValue time.Duration
+	}{
+		{self.RawRestartWindow, &self.RestartWindow, DEFAULT_RESTART_WINDOW},
+		{self.RawRestartBackoff, &self.RestartBackoff, DEFAULT_RESTART_BACKOFF},
+		{self.RawMaxRestartBackoff, &self.MaxRestartBackoff, DEFAULT_MAX_RESTART_BACKOFF},
+		{self.RawCommandTimeout, &self.CommandTimeout, DEFAULT_COMMAND_TIMEOUT},
+	}
+	for _, duration := range durations {
+		*duration.value = duration.defaultValue
+		if duration.raw == "" {
+			continue
+		}
+		var err error
+		if *duration.value, err = time.ParseDuration(duration.raw); err != nil {
+			return err
+		}
+	}
+
+	if self.MaxRestartBackoff < self.RestartBackoff {
+		self.MaxRestartBackoff = self.RestartBackoff
+	}
+	if self.FlapThreshold <= 0 {
+		self.FlapThreshold = DEFAULT_FLAP_THRESHOLD
+	}
+	return nil
+}
+
+// whether the given number of running instances is healthy
+func (self *Process) InstancesStatus(count int) Status {
+	if count < self.MinInstances || count == 0 {
+		return DOWN
+	}
+	if self.MaxInstances > 0 && count > self.MaxInstances {
+		return TOO_MANY_INSTANCES
+	}
+	return UP
 }
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type ProcessSuite struct{}
+
+var _ = Suite(&ProcessSuite{})
+
+func (self *ProcessSuite) TestParseCommand(c *C) {
+	commands := map[string]Command{
+		"service mysql start":              Command{"service", "mysql", "start"},
+		"  /usr/bin/app   --name 'my app'": Command{"/usr/bin/app", "--name", "my app"},
+		`sh -c "echo \"hi\" > /tmp/x"`:     Command{"sh", "-c", `echo "hi" > /tmp/x`},
+		`app --empty '' it\'s`:             Command{"app", "--empty", "", "it's"},
+	}
+	for command, expected := range commands {
+		argv, err := ParseCommand(command)
+		c.Assert(err, IsNil)
+		c.Assert(argv, DeepEquals, expected)
+	}
+
+	_, err := ParseCommand("app 'unterminated")
+	c.Assert(err, NotNil)
+}
+
+func (self *ProcessSuite) TestCommandString(c *C) {
+	argv := Command{"app", "--name", "my app", "it's"}
+	c.Assert(argv.String(), Equals, `app --name 'my app' 'it'\''s'`)
+	parsed, err := ParseCommand(Command{"app", "--name", "my app"}.String())
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, Command{"app", "--name", "my app"})
+}
+
+func (self *ProcessSuite) TestUnmarshalProcess(c *C) {
+	process := &Process{}
+	err := json.Unmarshal([]byte(`{"start": ["/usr/bin/app", "--name", "my app"], "stop": "pkill -f 'my app'", "command-timeout": "5s"}`), process)
+	c.Assert(err, IsNil)
+	c.Assert(process.StartCmd, DeepEquals, Command{"/usr/bin/app", "--name", "my app"})
+	c.Assert(process.StopCmd, DeepEquals, Command{"pkill", "-f", "my app"})
+
+	c.Assert(process.parse(), IsNil)
+	c.Assert(process.CommandTimeout, Equals, 5*time.Second)
+	c.Assert(process.RestartWindow, Equals, DEFAULT_RESTART_WINDOW)
+
+	c.Assert(json.Unmarshal([]byte(`{"start": 1}`), process), NotNil)
+}
+
+func (self *ProcessSuite) TestSortByDependencies(c *C) {
+	app := &Process{Nickname: "app", DependsOn: []string{"db", "cache"}}
+	db := &Process{Nickname: "db"}
+	cache := &Process{Nickname: "cache", DependsOn: []string{"db"}}
+	worker := &Process{Nickname: "worker", DependsOn: []string{"app", "unknown"}}
+
+	sorted := sortByDependencies([]*Process{worker, app, cache, db})
+	c.Assert(sorted, DeepEquals, []*Process{db, cache, app, worker})
+	c.Assert(worker.DependsOn, DeepEquals, []string{"app"})
+}
+
+func (self *ProcessSuite) TestDependencyCycles(c *C) {
+	a := &Process{Nickname: "a", DependsOn: []string{"b"}}
+	b := &Process{Nickname: "b", DependsOn: []string{"a"}}
+	loop := &Process{Nickname: "loop", DependsOn: []string{"loop"}}
+
+	sorted := sortByDependencies([]*Process{a, b, loop})
+	c.Assert(sorted, DeepEquals, []*Process{b, a, loop})
+	c.Assert(a.DependsOn, DeepEquals, []string{"b"})
+	c.Assert(b.DependsOn, HasLen, 0)
+	c.Assert(loop.DependsOn, HasLen, 0)
+}
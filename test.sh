@@ -30,4 +30,4 @@ if [ "x$regex" != "x" ]; then
     gocheck_args="-gocheck.f $regex"
 fi
 
-go test -v apps/agent $gocheck_args
+go test -v apps/agent utils $gocheck_args